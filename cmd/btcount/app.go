@@ -11,10 +11,14 @@ import (
 	"time"
 
 	"github.com/ferux/btcount/internal/api"
+	"github.com/ferux/btcount/internal/btcontext"
 	"github.com/ferux/btcount/internal/btcount"
 	"github.com/ferux/btcount/internal/bthttp"
 	"github.com/ferux/btcount/internal/btlog"
 	"github.com/ferux/btcount/internal/cache"
+	"github.com/ferux/btcount/internal/disk"
+	"github.com/ferux/btcount/internal/memory"
+	"github.com/ferux/btcount/internal/notify"
 	"github.com/ferux/btcount/internal/postgres"
 	"github.com/ferux/btcount/internal/worker"
 
@@ -33,17 +37,45 @@ func app(ctx context.Context, cfg btcount.Config) (err error) {
 		zap.Bool("development", isDevelopment()),
 	)
 
-	var db btcount.Database
-	db, err = postgres.Open(ctx, cfg.DBAddr, postgres.Config{
-		MinConns: cfg.DBMinConn,
-		MaxConns: cfg.DBMaxConn,
-	})
-	if err != nil {
-		return fmt.Errorf("opening database: %w", err)
-	}
+	var (
+		store         btcount.Store
+		schemaVersion int64
+	)
+	switch cfg.Storage {
+	case btcount.StorageMemory:
+		log.Warn("using memory storage, the data will be lost on shutdown")
+
+		store = memory.Open()
+	case btcount.StorageFile:
+		var sync disk.SyncPolicy
+		sync, err = disk.ParseSyncPolicy(cfg.FileSync)
+		if err != nil {
+			return fmt.Errorf("parsing file sync policy: %w", err)
+		}
 
-	hstore := postgres.NewHistoryStore()
-	tstore := postgres.NewTransactionStore()
+		store, err = disk.Open(cfg.FilePath, disk.Config{
+			Sync:         sync,
+			SyncInterval: cfg.FileSyncInterval,
+		}, log)
+		if err != nil {
+			return fmt.Errorf("opening database file: %w", err)
+		}
+	default:
+		schemaVersion, err = prepareSchema(ctx, cfg.DBAddr, cfg.DBMigrate, log)
+		if err != nil {
+			return fmt.Errorf("preparing schema: %w", err)
+		}
+
+		log.Info("database schema checked", zap.Int64("schema_version", schemaVersion))
+
+		store, err = postgres.Open(ctx, cfg.DBAddr, postgres.Config{
+			MinConns: cfg.DBMinConn,
+			MaxConns: cfg.DBMaxConn,
+		})
+		if err != nil {
+			return fmt.Errorf("opening database: %w", err)
+		}
+	}
 
 	httpapi := bthttp.NewServer(bthttp.Config{
 		WriteTimeout: cfg.HTTPTimeout,
@@ -51,18 +83,48 @@ func app(ctx context.Context, cfg btcount.Config) (err error) {
 		IdleTimeout:  cfg.HTTPTimeout,
 	}, log)
 	httpapi.MountDebug()
+	httpapi.MountStatus(bthttp.Status{
+		Revision:      revision,
+		Storage:       cfg.Storage,
+		SchemaVersion: schemaVersion,
+	})
 
 	statcache, err := cache.InitHistoryStatCollector(ctx, cache.HistoryStatParams{
-		HStore: hstore,
-		TStore: tstore,
-		DB:     db,
+		Store: store,
 	}, log)
 	if err != nil {
 		log.Warn("unable to init cache", zap.Error(err))
 		statcache = nil
 	}
-	walletAPI := api.NewWalletAPI(db, hstore, tstore, statcache)
+	events := notify.NewBroker(cfg.EventsHistory)
+
+	// Other instances sharing the store change it as well, so the cache
+	// and the events follow their changes. Transactions saved by this
+	// instance are delivered by the feed too, so they are not published
+	// by the api.
+	feed, following := store.(btcount.ChangeFeed)
+	apiEvents := events
+	if following {
+		apiEvents = nil
+	}
+
+	walletAPI := api.NewWalletAPI(api.WalletAPIParams{
+		Store:            store,
+		AmountScale:      cfg.AmountScale,
+		HistoryMaxPoints: cfg.HistoryMaxPoints,
+		FuturePolicy:     cfg.FuturePolicy,
+		StatCollector:    statcache,
+		Events:           apiEvents,
+	})
 	httpapi.MountWalletAPI(walletAPI)
+	err = httpapi.MountEvents(walletAPI, events, bthttp.EventsConfig{
+		Heartbeat: cfg.EventsHeartbeat,
+		Buffer:    cfg.EventsBuffer,
+	})
+	if err != nil {
+		return fmt.Errorf("mounting events: %w", err)
+	}
+	httpapi.MountAdmin(walletAPI, cfg.AdminToken)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -88,6 +150,25 @@ func app(ctx context.Context, cfg btcount.Config) (err error) {
 		}
 	}()
 
+	if following {
+		handlers := btcount.ChangeHandlers{notify.NewFollower(events, store, log)}
+		if statcache != nil {
+			handlers = append(handlers, cache.NewFollower(statcache, store, log))
+		}
+
+		wg.Add(1)
+		go func() {
+			defer panicRecover(log)
+			defer wg.Done()
+			defer log.Info("change feed finished")
+
+			errfeed := feed.Follow(btcontext.WithLogger(ctx, log), handlers)
+			if !errors.Is(errfeed, context.Canceled) {
+				log.Error("unable to follow changes", zap.Error(errfeed))
+			}
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer panicRecover(log)
@@ -95,16 +176,22 @@ func app(ctx context.Context, cfg btcount.Config) (err error) {
 		defer log.Info("worker finished")
 
 		wcfg := worker.StatMakerWorkerConfig{
-			TStore:     tstore,
-			HStore:     hstore,
-			DB:         db,
+			Store:      store,
 			RetryDelay: cfg.StatWorkerRetryDelay,
+			Events:     events,
 		}
 
 		worker.RunStatMakerWorker(ctx, wcfg, log)
 	}()
 
 	wg.Wait()
+
+	// Closing flushes the data to the file storage.
+	err = store.Close()
+	if err != nil {
+		return fmt.Errorf("closing database: %w", err)
+	}
+
 	return nil
 }
 
@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	// Embed the time zone database for images without tzdata.
+	_ "time/tzdata"
 
 	"github.com/ferux/btcount/internal/btcount"
 )
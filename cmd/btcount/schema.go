@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/ferux/btcount/internal/migrate"
+
+	// Import pgx driver to the sql driver list.
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"go.uber.org/zap"
+)
+
+// prepareSchema applies pending migrations if apply is set and checks
+// the schema of the database is known to the app. It returns the version
+// of the schema.
+func prepareSchema(ctx context.Context, dsn string, apply bool, log *zap.Logger) (version int64, err error) {
+	migrations, err := migrate.Migrations()
+	if err != nil {
+		return 0, fmt.Errorf("loading migrations: %w", err)
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return 0, fmt.Errorf("dialing db: %w", err)
+	}
+	defer func() {
+		// Migrations are committed already.
+		_ = db.Close()
+	}()
+
+	m := migrate.New(db, migrations)
+
+	if apply {
+		var applied []migrate.Migration
+		applied, err = m.Up(ctx)
+		for _, migration := range applied {
+			log.Info("migration applied", zap.String("migration", migration.ID()))
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("applying migrations: %w", err)
+		}
+	}
+
+	version, pending, err := m.Check(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("checking schema: %w", err)
+	}
+
+	if pending > 0 {
+		log.Warn("database schema is outdated, run migrations",
+			zap.Int64("schema_version", version),
+			zap.Int("pending_migrations", pending),
+		)
+	}
+
+	return version, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// Kinds of exported data.
+const (
+	exportTransactions = "transactions"
+	exportStats        = "stats"
+)
+
+// farFuture is the default end of the exported range, so scheduled
+// transactions are exported too.
+var farFuture = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// exportStat is the history stat with JSON names of the candles of the
+// server API.
+type exportStat struct {
+	Datetime time.Time       `json:"datetime"`
+	Open     btcount.Decimal `json:"open"`
+	High     btcount.Decimal `json:"high"`
+	Low      btcount.Decimal `json:"low"`
+	Close    btcount.Decimal `json:"close"`
+	Inflow   btcount.Decimal `json:"inflow"`
+	Outflow  btcount.Decimal `json:"outflow"`
+	Count    int64           `json:"count"`
+}
+
+var (
+	transactionHeader = []string{"id", "datetime", "amount", "externalId", "createdAt"}
+	statHeader        = []string{"datetime", "open", "high", "low", "close", "inflow", "outflow", "count"}
+)
+
+func runExport(ctx context.Context, args []string) (err error) {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), "Usage: btcountctl export [flags]\n\n"+
+			"Exports transactions or hourly history stats dated in [since, till).\n"+
+			"Withdrawals are exported with negative amounts.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	walletID := flags.Int64("wallet", btcount.DefaultWalletID, "id of the wallet")
+	what := flags.String("what", exportTransactions, "data to export: transactions or stats")
+	format := flags.String("format", formatCSV, "format of the output: csv, ndjson or json")
+	since := flags.String("since", "", "RFC 3339 datetime the range starts at (default: the beginning)")
+	till := flags.String("till", "", "RFC 3339 datetime the range ends before (default: the end)")
+	outPath := flags.String("o", "", "file to write to (default: stdout)")
+
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	query := btcount.NewTimeRangeQuery(time.Time{}, farFuture)
+	if *since != "" {
+		query.Since, err = time.Parse(time.RFC3339Nano, *since)
+		if err != nil {
+			return fmt.Errorf("%w: since", btcount.ErrInvalidParameter)
+		}
+	}
+
+	if *till != "" {
+		query.Till, err = time.Parse(time.RFC3339Nano, *till)
+		if err != nil {
+			return fmt.Errorf("%w: till", btcount.ErrInvalidParameter)
+		}
+	}
+
+	query.Since, query.Till = query.Since.UTC(), query.Till.UTC()
+
+	var header []string
+	switch *what {
+	case exportTransactions:
+		header = transactionHeader
+	case exportStats:
+		header = statHeader
+	default:
+		return fmt.Errorf("%w: export of %q", btcount.ErrInvalidParameter, *what)
+	}
+
+	switch *format {
+	case formatCSV, formatNDJSON, formatJSON:
+	default:
+		return fmt.Errorf("%w: export format %q", btcount.ErrInvalidParameter, *format)
+	}
+
+	cfg, err := btcount.ParseConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store, &err)
+
+	r := store.Repos()
+
+	_, err = r.Wallets.Get(ctx, *walletID)
+	if err != nil {
+		return fmt.Errorf("loading wallet %d: %w", *walletID, err)
+	}
+
+	var rows []interface{}
+	var records [][]string
+	switch *what {
+	case exportTransactions:
+		var ts []btcount.Transaction
+		ts, err = r.Transactions.Load(ctx, *walletID, query)
+		if err != nil {
+			return fmt.Errorf("loading transactions: %w", err)
+		}
+
+		for _, t := range ts {
+			rows = append(rows, t)
+			records = append(records, transactionRecord(t))
+		}
+	case exportStats:
+		var stats []btcount.HistoryStat
+		stats, err = r.History.Load(ctx, *walletID, query)
+		if err != nil {
+			return fmt.Errorf("loading history stats: %w", err)
+		}
+
+		for _, stat := range stats {
+			rows = append(rows, toExportStat(stat))
+			records = append(records, statRecord(stat))
+		}
+	}
+
+	output := io.Writer(os.Stdout)
+	if *outPath != "" {
+		var f *os.File
+		f, err = os.Create(*outPath)
+		if err != nil {
+			return fmt.Errorf("creating output: %w", err)
+		}
+		defer func() {
+			errclose := f.Close()
+			if err == nil && errclose != nil {
+				err = fmt.Errorf("closing output: %w", errclose)
+			}
+		}()
+
+		output = f
+	}
+
+	buf := bufio.NewWriter(output)
+	switch *format {
+	case formatCSV:
+		err = writeCSV(buf, header, records)
+	case formatNDJSON:
+		err = writeNDJSON(buf, rows)
+	case formatJSON:
+		if rows == nil {
+			rows = []interface{}{}
+		}
+
+		err = json.NewEncoder(buf).Encode(rows)
+	}
+	if err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+
+	err = buf.Flush()
+	if err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+
+	return nil
+}
+
+func toExportStat(stat btcount.HistoryStat) exportStat {
+	return exportStat{
+		Datetime: stat.Datetime,
+		Open:     stat.Open,
+		High:     stat.High,
+		Low:      stat.Low,
+		Close:    stat.Amount,
+		Inflow:   stat.Inflow,
+		Outflow:  stat.Outflow,
+		Count:    stat.Count,
+	}
+}
+
+func transactionRecord(t btcount.Transaction) []string {
+	return []string{
+		strconv.FormatInt(t.ID, 10),
+		t.Datetime.Format(time.RFC3339Nano),
+		t.Amount.String(),
+		t.IdempotencyKey,
+		t.CreatedAt.Format(time.RFC3339Nano),
+	}
+}
+
+func statRecord(stat btcount.HistoryStat) []string {
+	return []string{
+		stat.Datetime.Format(time.RFC3339Nano),
+		stat.Open.String(),
+		stat.High.String(),
+		stat.Low.String(),
+		stat.Amount.String(),
+		stat.Inflow.String(),
+		stat.Outflow.String(),
+		strconv.FormatInt(stat.Count, 10),
+	}
+}
+
+func writeCSV(w io.Writer, header []string, records [][]string) (err error) {
+	writer := csv.NewWriter(w)
+
+	err = writer.Write(header)
+	if err != nil {
+		return err
+	}
+
+	err = writer.WriteAll(records)
+	if err != nil {
+		return err
+	}
+
+	return writer.Error()
+}
+
+func writeNDJSON(w io.Writer, rows []interface{}) (err error) {
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		err = enc.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
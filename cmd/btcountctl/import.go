@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ferux/btcount/internal/api"
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// Formats of imported and exported data.
+const (
+	formatAuto   = "auto"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+	formatJSON   = "json"
+)
+
+const (
+	typeDeposit    = "deposit"
+	typeWithdrawal = "withdrawal"
+)
+
+// maxExternalIDLength is the same limit as the one of the server API.
+const maxExternalIDLength = 256
+
+// importRow is a transaction read from the input. Err is set if the row
+// is invalid.
+type importRow struct {
+	source string
+	// line is the number of the line for NDJSON and the number of the
+	// record for CSV.
+	line int
+	item api.BatchItem
+	err  error
+}
+
+// importRequest is a single line of NDJSON, the same as the request of
+// the server API.
+type importRequest struct {
+	Amount     btcount.Decimal `json:"amount"`
+	Datetime   time.Time       `json:"datetime"`
+	Type       string          `json:"type"`
+	ExternalID string          `json:"externalId"`
+}
+
+// importStats counts processed rows.
+type importStats struct {
+	created  int
+	replayed int
+	failed   int
+	valid    int
+}
+
+func runImport(ctx context.Context, args []string) (err error) {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), "Usage: btcountctl import [flags] [file ...]\n\n"+
+			"Imports transactions from files or stdin if there are no files or the file is -.\n"+
+			"CSV has the columns datetime,amount[,type[,externalId]] or the header with them.\n"+
+			"NDJSON has the same objects as the request of the server API.\n"+
+			"Negative amounts without the type are withdrawals.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	walletID := flags.Int64("wallet", btcount.DefaultWalletID, "id of the wallet")
+	format := flags.String("format", formatAuto, "format of the input: auto, csv or ndjson; auto is ndjson for .ndjson and .jsonl files and csv otherwise")
+	dryRun := flags.Bool("dry-run", false, "validate the input without saving transactions")
+	reportPath := flags.String("report", "", "file to write the CSV report of failed rows to (default: stderr)")
+	batchSize := flags.Int("batch", 1000, "amount of transactions saved at once")
+
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *batchSize <= 0 || *batchSize > api.MaxBatchSize {
+		return fmt.Errorf("%w: batch should be in range [1, %d]", btcount.ErrInvalidParameter, api.MaxBatchSize)
+	}
+
+	cfg, err := btcount.ParseConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	report := csv.NewWriter(os.Stderr)
+	if *reportPath != "" {
+		var f *os.File
+		f, err = os.Create(*reportPath)
+		if err != nil {
+			return fmt.Errorf("creating report: %w", err)
+		}
+		defer func() {
+			errclose := f.Close()
+			if err == nil && errclose != nil {
+				err = fmt.Errorf("closing report: %w", errclose)
+			}
+		}()
+
+		report = csv.NewWriter(f)
+	}
+
+	err = report.Write([]string{"source", "line", "error"})
+	if err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+
+	imp := importer{
+		walletID:    *walletID,
+		amountScale: cfg.AmountScale,
+		batchSize:   *batchSize,
+		report:      report,
+	}
+
+	if !*dryRun {
+		var store btcount.Store
+		store, err = openStore(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer closeStore(store, &err)
+
+		imp.wapi = api.NewWalletAPI(api.WalletAPIParams{
+			Store:            store,
+			AmountScale:      cfg.AmountScale,
+			HistoryMaxPoints: cfg.HistoryMaxPoints,
+			FuturePolicy:     cfg.FuturePolicy,
+		})
+
+		_, err = imp.wapi.GetWallet(ctx, imp.walletID)
+		if err != nil {
+			return err
+		}
+	}
+
+	sources := flags.Args()
+	if len(sources) == 0 {
+		sources = []string{"-"}
+	}
+
+	for _, source := range sources {
+		err = imp.importSource(ctx, source, *format)
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = imp.flush(ctx)
+	}
+
+	report.Flush()
+	if errreport := report.Error(); err == nil && errreport != nil {
+		err = fmt.Errorf("writing report: %w", errreport)
+	}
+
+	if *dryRun {
+		log.Printf("dry run: %d valid, %d failed", imp.stats.valid, imp.stats.failed)
+	} else {
+		log.Printf("imported: %d created, %d replayed, %d failed", imp.stats.created, imp.stats.replayed, imp.stats.failed)
+	}
+
+	if err == nil && imp.stats.failed > 0 {
+		err = fmt.Errorf("%d rows failed", imp.stats.failed)
+	}
+
+	return err
+}
+
+// importer validates transactions and saves them in batches. Nothing is
+// saved if the api is not set.
+type importer struct {
+	wapi        api.WalletAPI
+	walletID    int64
+	amountScale int32
+	batchSize   int
+	report      *csv.Writer
+
+	batch []importRow
+	stats importStats
+}
+
+func (imp *importer) importSource(ctx context.Context, source, format string) (err error) {
+	input := io.Reader(os.Stdin)
+	if source != "-" {
+		var f *os.File
+		f, err = os.Open(source)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", source, err)
+		}
+		defer func() {
+			// The file is opened for reading only.
+			_ = f.Close()
+		}()
+
+		input = f
+	}
+
+	if format == formatAuto {
+		switch strings.ToLower(filepath.Ext(source)) {
+		case ".ndjson", ".jsonl":
+			format = formatNDJSON
+		default:
+			format = formatCSV
+		}
+	}
+
+	add := func(row importRow) error {
+		row.source = source
+		if row.err == nil {
+			row.err = imp.validate(row.item)
+		}
+
+		return imp.add(ctx, row)
+	}
+
+	switch format {
+	case formatCSV:
+		err = readCSV(input, add)
+	case formatNDJSON:
+		err = readNDJSON(input, add)
+	default:
+		return fmt.Errorf("%w: import format %q", btcount.ErrInvalidParameter, format)
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", source, err)
+	}
+
+	return nil
+}
+
+// validate checks the transaction the same way as the server does
+// except for checks made by the storage.
+func (imp *importer) validate(item api.BatchItem) (err error) {
+	t := item.Transaction
+	switch {
+	case t.Datetime.IsZero():
+		return fmt.Errorf("%w: %s", btcount.ErrInvalidParameter, "datetime")
+	case !t.Amount.IsPositive():
+		return fmt.Errorf("%w: %s", btcount.ErrNegativeValue, "amount")
+	case !t.Amount.FitsScale(imp.amountScale):
+		return fmt.Errorf("%w: amount has more than %d digits after the decimal point", btcount.ErrInvalidParameter, imp.amountScale)
+	case utf8.RuneCountInString(t.IdempotencyKey) > maxExternalIDLength:
+		return fmt.Errorf("%w: externalId is longer than %d characters", btcount.ErrInvalidParameter, maxExternalIDLength)
+	}
+
+	return nil
+}
+
+func (imp *importer) add(ctx context.Context, row importRow) (err error) {
+	if row.err != nil {
+		return imp.fail(row, row.err)
+	}
+
+	imp.batch = append(imp.batch, row)
+	if len(imp.batch) < imp.batchSize {
+		return nil
+	}
+
+	return imp.flush(ctx)
+}
+
+// flush saves the batch. Batches saved before a failure stay saved.
+func (imp *importer) flush(ctx context.Context) (err error) {
+	batch := imp.batch
+	imp.batch = imp.batch[:0]
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if imp.wapi == nil {
+		imp.stats.valid += len(batch)
+
+		return nil
+	}
+
+	items := make([]api.BatchItem, len(batch))
+	for i := range batch {
+		items[i] = batch[i].item
+	}
+
+	results, err := imp.wapi.CreateTransactions(ctx, imp.walletID, items)
+	if err != nil {
+		return fmt.Errorf("saving transactions of %s since line %d: %w", batch[0].source, batch[0].line, err)
+	}
+
+	for i, result := range results {
+		switch {
+		case result.Err != nil:
+			err = imp.fail(batch[i], result.Err)
+			if err != nil {
+				return err
+			}
+		case result.Replayed:
+			imp.stats.replayed++
+		default:
+			imp.stats.created++
+		}
+	}
+
+	return nil
+}
+
+func (imp *importer) fail(row importRow, reason error) (err error) {
+	imp.stats.failed++
+
+	err = imp.report.Write([]string{row.source, fmt.Sprint(row.line), reason.Error()})
+	if err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+
+	return nil
+}
+
+// readCSV reads transactions from CSV. The columns are taken from the
+// header if the first record is not a transaction.
+func readCSV(input io.Reader, fn func(row importRow) error) (err error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	columns := map[string]int{"datetime": 0, "amount": 1, "type": 2, "externalid": 3}
+
+	for line := 1; ; line++ {
+		var record []string
+		record, err = reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			err = fn(importRow{line: line, err: err})
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if line == 1 && isCSVHeader(record) {
+			columns = make(map[string]int, len(record))
+			for i, name := range record {
+				columns[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+
+			continue
+		}
+
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+
+			return strings.TrimSpace(record[i])
+		}
+
+		row := importRow{line: line}
+		row.item, row.err = parseItem(field("datetime"), field("amount"), field("type"), field("externalid"))
+
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isCSVHeader reports whether the record names the columns.
+func isCSVHeader(record []string) bool {
+	for _, name := range record {
+		if strings.EqualFold(strings.TrimSpace(name), "datetime") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseItem parses the transaction from CSV fields.
+func parseItem(datetime, amount, kind, externalID string) (item api.BatchItem, err error) {
+	item.Transaction.Datetime, err = time.Parse(time.RFC3339Nano, datetime)
+	if err != nil {
+		return item, fmt.Errorf("%w: datetime %q", btcount.ErrInvalidParameter, datetime)
+	}
+
+	item.Transaction.Amount, err = btcount.DecimalFromString(amount)
+	if err != nil {
+		return item, fmt.Errorf("%w: amount %q", btcount.ErrInvalidParameter, amount)
+	}
+
+	item.Transaction.IdempotencyKey = externalID
+
+	return withType(item, kind)
+}
+
+// withType marks withdrawals by the type or by the negative amount if
+// the type is empty.
+func withType(item api.BatchItem, kind string) (typed api.BatchItem, err error) {
+	switch strings.ToLower(kind) {
+	case "":
+		if item.Transaction.Amount.IsNegative() {
+			item.Transaction.Amount = item.Transaction.Amount.Neg()
+			item.Withdrawal = true
+		}
+	case typeDeposit:
+	case typeWithdrawal:
+		item.Withdrawal = true
+	default:
+		return item, fmt.Errorf("%w: type %q should be either %s or %s", btcount.ErrInvalidParameter, kind, typeDeposit, typeWithdrawal)
+	}
+
+	return item, nil
+}
+
+// readNDJSON reads transactions from NDJSON skipping empty lines.
+func readNDJSON(input io.Reader, fn func(row importRow) error) (err error) {
+	const maxLineSize = 64 * 1024
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+
+		row := importRow{line: line}
+
+		var req importRequest
+		row.err = json.Unmarshal([]byte(raw), &req)
+		if row.err == nil {
+			row.item, row.err = withType(api.BatchItem{
+				Transaction: btcount.Transaction{
+					Amount:         req.Amount,
+					Datetime:       req.Datetime,
+					IdempotencyKey: req.ExternalID,
+				},
+			}, req.Type)
+		}
+
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
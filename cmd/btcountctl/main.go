@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	// Embed the time zone database for images without tzdata.
+	_ "time/tzdata"
+
+	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/btlog"
+	"github.com/ferux/btcount/internal/disk"
+	"github.com/ferux/btcount/internal/postgres"
+
+	"go.uber.org/zap"
+)
+
+const usage = `Usage: btcountctl command [flags] [args]
+
+Commands:
+  import    import transactions from CSV or NDJSON files or stdin
+  export    export transactions or history stats of the time range
+  reconcile recompute history stats of the time range and report or fix
+            discrepancies
+
+The storage is set the same way as for the service, e.g. by BTCOUNT_DB_ADDR
+environment variable. Run btcountctl command -h for flags of the command.
+`
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "import":
+		err = runImport(ctx, args)
+	case "export":
+		err = runExport(ctx, args)
+	case "reconcile":
+		err = runReconcile(ctx, args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		err = fmt.Errorf("unknown command %q", command)
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	exitOnError(err)
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openStore opens the storage set by the config of the service.
+func openStore(ctx context.Context, cfg btcount.Config) (store btcount.Store, err error) {
+	switch cfg.Storage {
+	case btcount.StoragePostgres:
+		store, err = postgres.Open(ctx, cfg.DBAddr, postgres.Config{
+			MinConns: 1,
+			MaxConns: 2,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("opening database: %w", err)
+		}
+	case btcount.StorageFile:
+		var sync disk.SyncPolicy
+		sync, err = disk.ParseSyncPolicy(cfg.FileSync)
+		if err != nil {
+			return nil, fmt.Errorf("parsing file sync policy: %w", err)
+		}
+
+		var zlog *zap.Logger
+		zlog, err = btlog.NewLog(cfg.LogLevel, btlog.LogFormat(cfg.LogFormat), false)
+		if err != nil {
+			return nil, fmt.Errorf("making new log: %w", err)
+		}
+
+		store, err = disk.Open(cfg.FilePath, disk.Config{
+			Sync:         sync,
+			SyncInterval: cfg.FileSyncInterval,
+		}, zlog)
+		if err != nil {
+			return nil, fmt.Errorf("opening database file: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: storage %s is not persistent", btcount.ErrInvalidParameter, cfg.Storage)
+	}
+
+	return store, nil
+}
+
+// closeStore closes the store returning the error if err is nil or
+// logging it otherwise.
+func closeStore(store btcount.Store, err *error) {
+	errclose := store.Close()
+	if errclose == nil {
+		return
+	}
+
+	if *err == nil {
+		*err = fmt.Errorf("closing storage: %w", errclose)
+	} else {
+		log.Printf("unable to close storage: %v", errclose)
+	}
+}
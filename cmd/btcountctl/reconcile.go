@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ferux/btcount/internal/api"
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// States of the stat discrepancy.
+const (
+	stateMissing    = "missing"
+	stateUnexpected = "unexpected"
+	stateMismatched = "mismatched"
+)
+
+func runReconcile(ctx context.Context, args []string) (err error) {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), "Usage: btcountctl reconcile [flags]\n\n"+
+			"Recomputes hourly history stats of transactions dated in [since, till)\n"+
+			"and reports the ones differing from the stored stats. The range is\n"+
+			"aligned to hours and limited by the current hour.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	walletID := flags.Int64("wallet", btcount.DefaultWalletID, "id of the wallet")
+	since := flags.String("since", "", "RFC 3339 datetime the range starts at (default: the beginning)")
+	till := flags.String("till", "", "RFC 3339 datetime the range ends before (default: the current hour)")
+	rewrite := flags.Bool("rewrite", false, "replace stored stats of the range by the recomputed ones")
+
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var params api.ReconcileParams
+	params.Rewrite = *rewrite
+	if *since != "" {
+		params.Since, err = time.Parse(time.RFC3339Nano, *since)
+		if err != nil {
+			return fmt.Errorf("%w: since", btcount.ErrInvalidParameter)
+		}
+	}
+
+	if *till != "" {
+		params.Till, err = time.Parse(time.RFC3339Nano, *till)
+		if err != nil {
+			return fmt.Errorf("%w: till", btcount.ErrInvalidParameter)
+		}
+	}
+
+	cfg, err := btcount.ParseConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store, &err)
+
+	wapi := api.NewWalletAPI(api.WalletAPIParams{
+		Store:            store,
+		AmountScale:      cfg.AmountScale,
+		HistoryMaxPoints: cfg.HistoryMaxPoints,
+		FuturePolicy:     cfg.FuturePolicy,
+	})
+
+	report, err := wapi.ReconcileStats(ctx, *walletID, params)
+	if err != nil {
+		return fmt.Errorf("reconciling stats: %w", err)
+	}
+
+	if len(report.Discrepancies) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DATETIME\tSTATE\tSTORED\tEXPECTED")
+		for _, d := range report.Discrepancies {
+			state, stored, expected := stateMismatched, "-", "-"
+			switch {
+			case d.Stored == nil:
+				state = stateMissing
+			case d.Expected == nil:
+				state = stateUnexpected
+			}
+
+			if d.Stored != nil {
+				stored = formatStat(*d.Stored)
+			}
+
+			if d.Expected != nil {
+				expected = formatStat(*d.Expected)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Datetime.Format(time.RFC3339), state, stored, expected)
+		}
+
+		err = w.Flush()
+		if err != nil {
+			return fmt.Errorf("writing report: %w", err)
+		}
+	}
+
+	log.Printf("reconciled [%s, %s): %d checked, %d discrepancies, rewritten: %t",
+		report.Since.Format(time.RFC3339), report.Till.Format(time.RFC3339),
+		report.Checked, len(report.Discrepancies), report.Rewritten)
+
+	return nil
+}
+
+// formatStat formats the stat as open/high/low/close inflow/outflow count.
+func formatStat(stat btcount.HistoryStat) string {
+	return fmt.Sprintf("%s/%s/%s/%s %s/%s %d",
+		stat.Open, stat.High, stat.Low, stat.Amount,
+		stat.Inflow, stat.Outflow, stat.Count)
+}
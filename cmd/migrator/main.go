@@ -4,160 +4,182 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ferux/btcount/internal/migrate"
 
 	// Import pgx driver to the sql driver list.
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
-func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
+const usage = `Usage: migrator [flags] [command]
 
-	dsn := os.Getenv("DATABASE_DSN")
+Commands:
+  up              apply all pending migrations (default)
+  down [N]        revert N latest migrations (default: 1)
+  status          show the state of every migration
+  goto VERSION    migrate up or down to the version, 0 reverts everything
+  create NAME     create empty up and down migrations
 
-	db, err := opendb(ctx, dsn)
-	exitOnError(err)
+The database is set by DATABASE_DSN environment variable.
 
-	err = makeschema(ctx, db)
-	exitOnError(err)
+Flags:
+`
 
-	migrations := getmigrations()
+func main() {
+	dir := flag.String("dir", migrate.Dir, "directory to create migrations in")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	err = migrate(ctx, db, migrations)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	err := run(ctx, *dir, flag.Args())
 	exitOnError(err)
 }
 
-func exitOnError(err error) {
-	if err != nil {
-		log.Fatal(err)
+func run(ctx context.Context, dir string, args []string) (err error) {
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
 	}
-}
 
-func opendb(ctx context.Context, dsn string) (db *sql.DB, err error) {
-	db, err = sql.Open("pgx", dsn)
+	migrations, err := migrate.Migrations()
 	if err != nil {
-		return nil, fmt.Errorf("dialing db: %w", err)
+		return fmt.Errorf("loading migrations: %w", err)
 	}
 
-	err = db.PingContext(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("pinging database: %w", err)
+	switch command {
+	case "up", "down", "goto", "status", "create":
+	default:
+		flag.Usage()
+
+		return fmt.Errorf("unknown command %q", command)
 	}
 
-	return db, nil
-}
+	if command == "create" {
+		if len(args) != 1 {
+			return errors.New("create requires the name of the migration")
+		}
 
-type migration struct {
-	name string
-	sql  string
-}
+		var paths []string
+		_, paths, err = migrate.Create(dir, args[0], migrations)
+		for _, path := range paths {
+			log.Printf("created %s", path)
+		}
 
-func migrate(ctx context.Context, db *sql.DB, migrations []migration) (err error) {
-	var tx *sql.Tx
-	tx, err = db.Begin()
-	if err != nil {
-		return fmt.Errorf("starting transaction: %w", err)
+		return err
 	}
 
+	db, err := opendb(ctx, os.Getenv("DATABASE_DSN"))
+	if err != nil {
+		return err
+	}
 	defer func() {
-		var errtx error
-		if err != nil {
-			log.Println("rolling back changes")
-			errtx = tx.Rollback()
-		} else {
-			log.Println("commiting changes")
-			errtx = tx.Commit()
-		}
-
-		if errtx != nil {
-			if err == nil {
-				err = errtx
-			} else {
-				log.Printf("finishing transaction: %v", err)
-			}
-		}
+		// Migrations are committed already.
+		_ = db.Close()
 	}()
 
-	var applied bool
-	for _, m := range migrations {
-		applied, err = checkApplied(ctx, tx, m.name)
-		if err != nil {
-			return fmt.Errorf("checking migration %s: %w", m.name, err)
+	m := migrate.New(db, migrations)
+
+	switch command {
+	case "up":
+		var applied []migrate.Migration
+		applied, err = m.Up(ctx)
+		logMigrations("applied", applied)
+	case "down":
+		n := 1
+		if len(args) > 0 {
+			n, err = strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("parsing amount of migrations: %w", err)
+			}
 		}
 
-		if applied {
-			continue
+		var reverted []migrate.Migration
+		reverted, err = m.Down(ctx, n)
+		logMigrations("reverted", reverted)
+	case "goto":
+		if len(args) != 1 {
+			return errors.New("goto requires the version")
 		}
 
-		log.Printf("migration %s not applied", m.name)
-
-		err = applyMigration(ctx, tx, m)
+		var version int64
+		version, err = strconv.ParseInt(args[0], 10, 64)
 		if err != nil {
-			return fmt.Errorf("applying migration %s: %w", m.name, err)
+			return fmt.Errorf("parsing version: %w", err)
 		}
+
+		var applied, reverted []migrate.Migration
+		applied, reverted, err = m.Goto(ctx, version)
+		logMigrations("reverted", reverted)
+		logMigrations("applied", applied)
+	case "status":
+		err = printStatus(ctx, m)
 	}
 
-	return nil
+	return err
 }
 
-func getmigrations() []migration {
-	return []migration{{
-		name: "0001_init",
-		sql: `
-		CREATE SCHEMA IF NOT EXISTS btcount;
-		CREATE TABLE IF NOT EXISTS btcount.transactions (` +
-			`  "id" BIGSERIAL PRIMARY KEY` +
-			`, "datetime" TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT now()` +
-			`, "amount" FLOAT8 NOT NULL` +
-			`);
-		CREATE TABLE IF NOT EXISTS btcount.history_stats (` +
-			`  "id" BIGSERIAL PRIMARY KEY` +
-			`, "datetime" TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT now()` +
-			`, "amount" FLOAT8 NOT NULL` +
-			`);`,
-	}}
+func exitOnError(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func checkApplied(ctx context.Context, tx *sql.Tx, name string) (applied bool, err error) {
-	const query = `SELECT COUNT(1) FROM public.migrations WHERE "name" = $1`
-
-	var count int
-	err = tx.QueryRowContext(ctx, query, name).Scan(&count)
+func opendb(ctx context.Context, dsn string) (db *sql.DB, err error) {
+	db, err = sql.Open("pgx", dsn)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil
-		}
+		return nil, fmt.Errorf("dialing db: %w", err)
+	}
 
-		return false, err
+	err = db.PingContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("pinging database: %w", err)
 	}
 
-	return count == 1, nil
+	return db, nil
 }
 
-func applyMigration(ctx context.Context, tx *sql.Tx, m migration) (err error) {
-	_, err = tx.ExecContext(ctx, m.sql)
+func logMigrations(action string, migrations []migrate.Migration) {
+	for _, m := range migrations {
+		log.Printf("%s migration %s", action, m.ID())
+	}
+}
 
+func printStatus(ctx context.Context, m *migrate.Migrator) (err error) {
+	statuses, err := m.Status(ctx)
 	if err != nil {
-		return fmt.Errorf("making changes: %w", err)
+		return fmt.Errorf("loading status: %w", err)
 	}
 
-	const query = `INSERT INTO public.migrations (name) VALUES ($1)`
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT")
 
-	_, err = tx.ExecContext(ctx, query, m.name)
-	if err != nil {
-		return fmt.Errorf("inserting migration name to migrations: %w", err)
-	}
+	for _, s := range statuses {
+		state, appliedAt := "pending", ""
+		if s.Applied {
+			state, appliedAt = "applied", s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
 
-	return nil
-}
+		switch {
+		case s.Unknown:
+			state = "unknown"
+		case s.Modified:
+			state = "modified"
+		}
 
-func makeschema(ctx context.Context, db *sql.DB) (err error) {
-	const query = `CREATE TABLE IF NOT EXISTS public.migrations ("name" TEXT PRIMARY KEY);`
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+	}
 
-	_, err = db.ExecContext(ctx, query)
-	return err
+	return w.Flush()
 }
@@ -5,6 +5,7 @@ go 1.16
 require (
 	github.com/go-playground/validator/v10 v10.4.1
 	github.com/gorilla/mux v1.8.0
+	github.com/jackc/pgconn v1.8.1
 	github.com/jackc/pgx/v4 v4.11.0
 	github.com/shopspring/decimal v1.2.0
 	go.uber.org/zap v1.16.0
@@ -0,0 +1,277 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcontext"
+	"github.com/ferux/btcount/internal/btcount"
+	"go.uber.org/zap"
+)
+
+// MaxBatchSize is the maximum amount of transactions in the batch.
+const MaxBatchSize = 100000
+
+// BatchItem is a transaction of the batch. The amount is positive, the
+// withdrawal debits the wallet by it.
+type BatchItem struct {
+	Transaction btcount.Transaction
+	Withdrawal  bool
+}
+
+// BatchResult is the result of a single transaction of the batch. The
+// transaction is set unless Err is set.
+type BatchResult struct {
+	Transaction btcount.Transaction
+	// Replayed is set if the transaction was saved before with the same
+	// idempotency key.
+	Replayed bool
+	Err      error
+}
+
+// batchRow is the prepared item of the batch.
+type batchRow struct {
+	transaction btcount.Transaction
+	clamped     bool
+	// replayOf is the index of the row saved earlier in the same batch
+	// with the same idempotency key, or -1.
+	replayOf int
+}
+
+// CreateTransactions implements WalletAPI interface.
+func (api walletAPI) CreateTransactions(ctx context.Context, walletID int64, items []BatchItem) (results []BatchResult, err error) {
+	if len(items) > MaxBatchSize {
+		return nil, fmt.Errorf("%w: batch should have at most %d transactions", btcount.ErrInvalidParameter, MaxBatchSize)
+	}
+
+	_, err = api.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	results = make([]BatchResult, len(items))
+	rows := make([]batchRow, len(items))
+	for i, item := range items {
+		rows[i].replayOf = -1
+		rows[i].transaction, rows[i].clamped, results[i].Err = api.prepareTransaction(walletID, item.Transaction)
+		if item.Withdrawal {
+			rows[i].transaction.Amount = rows[i].transaction.Amount.Neg()
+		}
+	}
+
+	btcontext.Logger(ctx).Debug("saving batch", zap.Int64("wallet_id", walletID), zap.Int("size", len(items)))
+
+	// The wallet is locked so the balance is checked the same way as for
+	// a single withdrawal and history stats are repaired once.
+	var created []btcount.Transaction
+	err = api.store.WithinTx(ctx, func(r btcount.Repos) (err error) {
+		_, err = r.Wallets.Lock(ctx, walletID)
+		if err != nil {
+			return fmt.Errorf("locking wallet %d: %w", walletID, err)
+		}
+
+		var pending []int
+		pending, err = api.checkBatch(ctx, r, walletID, rows, results)
+		if err != nil {
+			return err
+		}
+
+		transactions := make([]btcount.Transaction, 0, len(pending))
+		for _, i := range pending {
+			transactions = append(transactions, rows[i].transaction)
+		}
+
+		var saved []btcount.Transaction
+		saved, err = r.Transactions.SaveMany(ctx, transactions)
+		if err != nil {
+			return fmt.Errorf("saving transactions to the storage: %w", err)
+		}
+
+		created = make([]btcount.Transaction, 0, len(saved))
+		var since time.Time
+		for j, i := range pending {
+			// Keys are checked with the wallet locked, so nothing should
+			// be skipped.
+			if saved[j].ID == 0 {
+				return fmt.Errorf("%w: idempotency key %q", btcount.ErrAlreadyExists, rows[i].transaction.IdempotencyKey)
+			}
+
+			results[i].Transaction = saved[j]
+			created = append(created, saved[j])
+
+			if since.IsZero() || saved[j].Datetime.Before(since) {
+				since = saved[j].Datetime
+			}
+		}
+
+		if len(created) == 0 {
+			return nil
+		}
+
+		return api.repairStats(ctx, r, walletID, since)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		if rows[i].replayOf >= 0 {
+			results[i].Transaction = results[rows[i].replayOf].Transaction
+		}
+	}
+
+	if api.statCollector != nil {
+		api.statCollector.CollectMany(created)
+	}
+
+	api.publishTransactions(ctx, walletID, created)
+
+	return results, nil
+}
+
+// checkBatch sets results of replayed rows and rows failing the balance
+// check, and returns indexes of rows to save. Rows are checked in order,
+// so a withdrawal may spend deposits made earlier in the same batch. The
+// backdated withdrawal should keep the past balance non-negative since it
+// is dated as well, so deposits of the batch dated by then raise the
+// lowest balance while all withdrawals of the batch lower it.
+func (api walletAPI) checkBatch(ctx context.Context, r btcount.Repos, walletID int64, rows []batchRow, results []BatchResult) (pending []int, err error) {
+	var keys []string
+	for i := range rows {
+		if results[i].Err == nil && rows[i].transaction.IdempotencyKey != "" {
+			keys = append(keys, rows[i].transaction.IdempotencyKey)
+		}
+	}
+
+	savedByKey := make(map[string]btcount.Transaction)
+	if len(keys) > 0 {
+		var saved []btcount.Transaction
+		saved, err = r.Transactions.LoadByIdempotencyKeys(ctx, walletID, keys)
+		if err != nil {
+			return nil, fmt.Errorf("loading transactions by idempotency keys: %w", err)
+		}
+
+		for _, t := range saved {
+			savedByKey[t.IdempotencyKey] = t
+		}
+	}
+
+	now := time.Now().UTC()
+	available, err := r.Transactions.SumAvailable(ctx, walletID, now)
+	if err != nil {
+		return nil, fmt.Errorf("calculating balance: %w", err)
+	}
+
+	var spent btcount.Decimal
+	credits := newBatchCredits(rows)
+	pendingByKey := make(map[string]int)
+	for i := range rows {
+		if results[i].Err != nil {
+			continue
+		}
+
+		t := rows[i].transaction
+		if t.IdempotencyKey != "" {
+			if saved, ok := savedByKey[t.IdempotencyKey]; ok {
+				results[i].Err = comparePayload(saved, t, rows[i].clamped)
+				if results[i].Err == nil {
+					results[i].Transaction = saved
+					results[i].Replayed = true
+				}
+
+				continue
+			}
+
+			if j, ok := pendingByKey[t.IdempotencyKey]; ok {
+				results[i].Err = comparePayload(rows[j].transaction, t, rows[i].clamped)
+				if results[i].Err == nil {
+					rows[i].replayOf = j
+					results[i].Replayed = true
+				}
+
+				continue
+			}
+		}
+
+		if t.Amount.IsNegative() {
+			err = checkWithdrawal(ctx, r, t, available, credits.sumBy(t.Datetime).Add(spent))
+			if errors.Is(err, btcount.ErrNegativeValue) {
+				results[i].Err = err
+
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			spent = spent.Add(t.Amount)
+		} else {
+			credits.add(t.Datetime, t.Amount)
+		}
+
+		// Scheduled deposits can not be spent until due.
+		if t.Amount.IsNegative() || !t.Datetime.After(now) {
+			available = available.Add(t.Amount)
+		}
+
+		if t.IdempotencyKey != "" {
+			pendingByKey[t.IdempotencyKey] = i
+		}
+
+		pending = append(pending, i)
+	}
+
+	return pending, nil
+}
+
+// batchCredits sums deposits of the batch by their datetime. It is the
+// Fenwick tree over the sorted datetimes of the batch, so every deposit
+// is added and summed in logarithmic time even for the largest batches.
+type batchCredits struct {
+	datetimes []time.Time
+	sums      []btcount.Decimal
+}
+
+func newBatchCredits(rows []batchRow) *batchCredits {
+	datetimes := make([]time.Time, 0, len(rows))
+	for i := range rows {
+		datetimes = append(datetimes, rows[i].transaction.Datetime)
+	}
+
+	sort.Slice(datetimes, func(i, j int) bool {
+		return datetimes[i].Before(datetimes[j])
+	})
+
+	return &batchCredits{
+		datetimes: datetimes,
+		sums:      make([]btcount.Decimal, len(datetimes)+1),
+	}
+}
+
+// add adds the deposit dated by ts. ts should be the datetime of a row of
+// the batch.
+func (c *batchCredits) add(ts time.Time, amount btcount.Decimal) {
+	for i := c.position(ts); i < len(c.sums); i += i & -i {
+		c.sums[i] = c.sums[i].Add(amount)
+	}
+}
+
+// sumBy sums deposits dated by ts inclusive.
+func (c *batchCredits) sumBy(ts time.Time) (sum btcount.Decimal) {
+	for i := c.position(ts); i > 0; i -= i & -i {
+		sum = sum.Add(c.sums[i])
+	}
+
+	return sum
+}
+
+// position returns the amount of datetimes not after ts, which is the
+// position of the last of them in the tree.
+func (c *batchCredits) position(ts time.Time) int {
+	return sort.Search(len(c.datetimes), func(i int) bool {
+		return c.datetimes[i].After(ts)
+	})
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcontext"
+	"github.com/ferux/btcount/internal/btcount"
+
+	"go.uber.org/zap"
+)
+
+// HistoryParams defines the time range and the shape of the balance
+// history.
+type HistoryParams struct {
+	Since time.Time
+	Till  time.Time
+	// Granularity is the size of buckets. Hourly buckets are used if it
+	// is not set.
+	Granularity btcount.Granularity
+	// Location defines boundaries of buckets and the location of
+	// datetimes in the result. UTC is used if it is not set.
+	Location *time.Location
+	// Fill defines how buckets without transactions are handled.
+	Fill FillMode
+}
+
+// FillMode defines how buckets without transactions are handled.
+type FillMode string
+
+const (
+	// FillNone omits buckets without transactions.
+	FillNone FillMode = "none"
+	// FillPrevious returns every bucket in the range carrying the balance
+	// of the previous one.
+	FillPrevious FillMode = "previous"
+)
+
+// FetchBalanceHistory implements WalletAPI interface.
+func (api walletAPI) FetchBalanceHistory(ctx context.Context, walletID int64, params HistoryParams) (stats []btcount.HistoryStat, err error) {
+	stats = make([]btcount.HistoryStat, 0)
+	err = api.StreamBalanceHistory(ctx, walletID, params, func(stat btcount.HistoryStat) error {
+		stats = append(stats, stat)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// StreamBalanceHistory implements WalletAPI interface.
+func (api walletAPI) StreamBalanceHistory(ctx context.Context, walletID int64, params HistoryParams, fn func(stat btcount.HistoryStat) error) (err error) {
+	_, err = api.GetWallet(ctx, walletID)
+	if err != nil {
+		return err
+	}
+
+	g := params.Granularity
+	if g.IsZero() {
+		g = btcount.GranularityHour
+	}
+
+	loc := params.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	// expand the range to the whole buckets in the requested location.
+	// The storage keeps datetimes in UTC.
+	since := g.Truncate(params.Since.In(loc)).UTC()
+	till := g.Ceil(params.Till.In(loc)).UTC()
+
+	btcontext.Logger(ctx).Debug("time ranges",
+		zap.Time("since", since),
+		zap.Time("till", till),
+		zap.Stringer("granularity", g),
+		zap.Stringer("location", loc),
+	)
+
+	fill := params.Fill == FillPrevious
+	if fill && btcount.CountBuckets(since.In(loc), till, g, api.historyMaxPoints) > api.historyMaxPoints {
+		return fmt.Errorf("%w: range has more than %d points", btcount.ErrInvalidParameter, api.historyMaxPoints)
+	}
+
+	// Hourly stats are partitioned by UTC hours, so they can be rolled
+	// up only if the location is shifted by whole hours.
+	rollup := g.IsHourly() && isShiftedByHours(loc, params.Since, till)
+
+	var opening btcount.Decimal
+	if fill || !rollup {
+		opening, err = api.balanceBefore(ctx, walletID, since)
+		if err != nil {
+			return err
+		}
+	}
+
+	emit := fn
+
+	var filler *btcount.StatFiller
+	if fill {
+		filler = btcount.NewStatFiller(walletID, opening, since.In(loc), till, g, fn)
+		emit = filler.Push
+	}
+
+	if rollup {
+		roller := btcount.NewStatRoller(g, emit)
+		err = api.iterateHourlyStats(ctx, walletID, since, till, func(stat btcount.HistoryStat) error {
+			stat.Datetime = stat.Datetime.In(loc)
+
+			return roller.Push(stat)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = roller.Flush()
+		if err != nil {
+			return err
+		}
+	} else {
+		// Buckets are partitioned in the location, so transactions are
+		// collected one by one the same way.
+		collector := btcount.NewStatCollector(g, opening, emit)
+		err = api.iterateTransactions(ctx, walletID, since, till, func(t btcount.Transaction) error {
+			t.Datetime = t.Datetime.In(loc)
+
+			return collector.Push(t)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = collector.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if fill {
+		return filler.Flush()
+	}
+
+	return nil
+}
+
+// isShiftedByHours checks the offset of the location is a whole number of
+// hours at the both ends of the range. The empty since is skipped because
+// zones had local mean time offsets in the distant past.
+func isShiftedByHours(loc *time.Location, since, till time.Time) bool {
+	const secondsInHour = 60 * 60
+
+	_, tillOffset := till.In(loc).Zone()
+	if since.IsZero() {
+		return tillOffset%secondsInHour == 0
+	}
+
+	_, sinceOffset := since.In(loc).Zone()
+
+	return sinceOffset%secondsInHour == 0 && tillOffset%secondsInHour == 0
+}
+
+// iterateHourlyStats passes hourly stats with datetime in (since, till]
+// to fn. Stats are saved by the worker with a delay, so the stats after
+// the last saved one are collected from transactions. The last saved stat
+// is loaded first, so stats saved by the worker meanwhile are neither
+// skipped nor passed twice.
+func (api walletAPI) iterateHourlyStats(ctx context.Context, walletID int64, since, till time.Time, fn func(stat btcount.HistoryStat) error) (err error) {
+	var lastStat btcount.HistoryStat
+	lastStat, err = api.store.Repos().History.LoadLastStat(ctx, walletID, till)
+	if err != nil && !errors.Is(err, btcount.ErrNotFound) {
+		return fmt.Errorf("loading last history stat: %w", err)
+	}
+
+	if lastStat.Datetime.After(since) {
+		err = api.store.Repos().History.Iterate(ctx, walletID, btcount.NewStatRangeQuery(since, lastStat.Datetime), fn)
+		if err != nil {
+			return fmt.Errorf("iterating history stats: %w", err)
+		}
+	}
+
+	if !lastStat.Datetime.Before(till) {
+		return nil
+	}
+
+	collector := btcount.NewStatCollector(btcount.GranularityHour, lastStat.Amount, func(stat btcount.HistoryStat) error {
+		if !stat.Datetime.After(since) {
+			return nil
+		}
+
+		return fn(stat)
+	})
+
+	err = api.iterateTransactions(ctx, walletID, lastStat.Datetime, till, collector.Push)
+	if err != nil {
+		return err
+	}
+
+	return collector.Flush()
+}
+
+// balanceBefore calculates the balance of the wallet by all transactions
+// made before ts.
+func (api walletAPI) balanceBefore(ctx context.Context, walletID int64, ts time.Time) (amount btcount.Decimal, err error) {
+	var lastStat btcount.HistoryStat
+	lastStat, err = api.store.Repos().History.LoadLastStat(ctx, walletID, ts)
+	if err != nil && !errors.Is(err, btcount.ErrNotFound) {
+		return amount, fmt.Errorf("loading last history stat: %w", err)
+	}
+
+	amount = lastStat.Amount
+	err = api.iterateTransactions(ctx, walletID, lastStat.Datetime, ts, func(t btcount.Transaction) error {
+		amount = amount.Add(t.Amount)
+
+		return nil
+	})
+	if err != nil {
+		return amount, err
+	}
+
+	return amount, nil
+}
+
+// iterateTransactions passes transactions with datetime in [since, till)
+// to fn.
+func (api walletAPI) iterateTransactions(ctx context.Context, walletID int64, since, till time.Time, fn func(t btcount.Transaction) error) (err error) {
+	err = api.store.Repos().Transactions.Iterate(ctx, walletID, btcount.NewTimeRangeQuery(since, till), fn)
+	if err != nil {
+		return fmt.Errorf("iterating transactions: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcontext"
+	"github.com/ferux/btcount/internal/btcount"
+	"go.uber.org/zap"
+)
+
+// ReconcileParams defines the range of hourly stats to reconcile. The
+// range is aligned to hours and limited by the current hour, so stats
+// covering transactions dated in [Since, Till) are reconciled. Empty
+// Till means the current hour.
+type ReconcileParams struct {
+	Since time.Time
+	Till  time.Time
+	// Rewrite replaces stored stats of the range by the recomputed ones
+	// if they differ.
+	Rewrite bool
+}
+
+// StatDiscrepancy is the stat which differs from the recomputed one.
+// Stored is nil if the stat is missing, Expected is nil if there should
+// be no stat.
+type StatDiscrepancy struct {
+	Datetime time.Time
+	Stored   *btcount.HistoryStat
+	Expected *btcount.HistoryStat
+}
+
+// ReconcileReport is the result of the reconciliation.
+type ReconcileReport struct {
+	Since time.Time
+	Till  time.Time
+	// Checked is the amount of stored and recomputed stats compared.
+	Checked       int
+	Discrepancies []StatDiscrepancy
+	// Rewritten is set if stored stats are replaced.
+	Rewritten bool
+}
+
+// ReconcileStats implements WalletAPI interface. Stats are recomputed
+// from transactions only, so the balance before the range is summed by
+// the storage from transactions too instead of being taken from stored
+// stats.
+func (api walletAPI) ReconcileStats(ctx context.Context, walletID int64, params ReconcileParams) (report ReconcileReport, err error) {
+	_, err = api.GetWallet(ctx, walletID)
+	if err != nil {
+		return report, err
+	}
+
+	// Stats are saved for the passed hours only.
+	current := time.Now().UTC().Truncate(time.Hour)
+	report.Since = params.Since.UTC().Truncate(time.Hour)
+	report.Till = params.Till.UTC().Truncate(time.Hour)
+	if params.Till.IsZero() || report.Till.After(current) {
+		report.Till = current
+	}
+
+	if !report.Since.Before(report.Till) {
+		return report, fmt.Errorf("%w: since should be before till and the current hour", btcount.ErrInvalidParameter)
+	}
+
+	// The wallet is locked so the worker and backdated transactions do
+	// not change stats while they are compared and rewritten.
+	err = api.store.WithinTx(ctx, func(r btcount.Repos) (err error) {
+		_, err = r.Wallets.Lock(ctx, walletID)
+		if err != nil {
+			return fmt.Errorf("locking wallet %d: %w", walletID, err)
+		}
+
+		var initial btcount.Decimal
+		initial, err = r.Transactions.SumBefore(ctx, walletID, report.Since)
+		if err != nil {
+			return fmt.Errorf("summing transactions before the range: %w", err)
+		}
+
+		var ts []btcount.Transaction
+		ts, err = r.Transactions.Load(ctx, walletID, btcount.NewTimeRangeQuery(report.Since, report.Till))
+		if err != nil {
+			return fmt.Errorf("loading transactions: %w", err)
+		}
+
+		query := btcount.NewStatRangeQuery(report.Since, report.Till)
+
+		var stored []btcount.HistoryStat
+		stored, err = r.History.Load(ctx, walletID, query)
+		if err != nil {
+			return fmt.Errorf("loading history stats: %w", err)
+		}
+
+		expected := btcount.CollectTransactionsIntoStats(ts, initial)
+		report.Checked, report.Discrepancies = diffStats(stored, expected)
+
+		if !params.Rewrite || len(report.Discrepancies) == 0 {
+			return nil
+		}
+
+		btcontext.Logger(ctx).Info("rewriting history stats",
+			zap.Int64("wallet_id", walletID),
+			zap.Time("since", report.Since),
+			zap.Time("till", report.Till),
+			zap.Int("discrepancies", len(report.Discrepancies)),
+		)
+
+		err = r.History.Delete(ctx, walletID, query)
+		if err != nil {
+			return fmt.Errorf("deleting history stats: %w", err)
+		}
+
+		err = r.History.SaveMany(ctx, expected)
+		if err != nil {
+			return fmt.Errorf("saving history stats: %w", err)
+		}
+
+		report.Rewritten = true
+
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// diffStats compares stats ordered by datetime and returns the amount of
+// compared datetimes with discrepancies between them.
+func diffStats(stored, expected []btcount.HistoryStat) (checked int, discrepancies []StatDiscrepancy) {
+	for i, j := 0, 0; i < len(stored) || j < len(expected); checked++ {
+		switch {
+		case j == len(expected) || i < len(stored) && stored[i].Datetime.Before(expected[j].Datetime):
+			discrepancies = append(discrepancies, StatDiscrepancy{
+				Datetime: stored[i].Datetime,
+				Stored:   &stored[i],
+			})
+			i++
+		case i == len(stored) || expected[j].Datetime.Before(stored[i].Datetime):
+			discrepancies = append(discrepancies, StatDiscrepancy{
+				Datetime: expected[j].Datetime,
+				Expected: &expected[j],
+			})
+			j++
+		default:
+			if !sameStat(stored[i], expected[j]) {
+				discrepancies = append(discrepancies, StatDiscrepancy{
+					Datetime: stored[i].Datetime,
+					Stored:   &stored[i],
+					Expected: &expected[j],
+				})
+			}
+			i++
+			j++
+		}
+	}
+
+	return checked, discrepancies
+}
+
+// sameStat reports whether stats of the same datetime have the same
+// values.
+func sameStat(a, b btcount.HistoryStat) bool {
+	return a.Amount.Equal(b.Amount) &&
+		a.Open.Equal(b.Open) &&
+		a.High.Equal(b.High) &&
+		a.Low.Equal(b.Low) &&
+		a.Inflow.Equal(b.Inflow) &&
+		a.Outflow.Equal(b.Outflow) &&
+		a.Count == b.Count
+}
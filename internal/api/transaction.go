@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// TransactionPage is a page of transactions. Next is set if there are
+// more transactions matching the query.
+type TransactionPage struct {
+	Transactions []btcount.Transaction
+	Next         *btcount.TransactionCursor
+}
+
+// GetTransaction implements WalletAPI interface.
+func (api walletAPI) GetTransaction(ctx context.Context, walletID, transactionID int64) (t btcount.Transaction, err error) {
+	t, err = api.store.Repos().Transactions.Get(ctx, walletID, transactionID)
+	if err != nil {
+		return t, fmt.Errorf("loading transaction %d: %w", transactionID, err)
+	}
+
+	return t, nil
+}
+
+// ListTransactions implements WalletAPI interface.
+func (api walletAPI) ListTransactions(ctx context.Context, walletID int64, query btcount.TransactionListQuery) (page TransactionPage, err error) {
+	_, err = api.GetWallet(ctx, walletID)
+	if err != nil {
+		return page, err
+	}
+
+	if query.Limit == 0 {
+		query.Limit = btcount.DefaultTransactionsLimit
+	}
+
+	if query.Limit < 0 || query.Limit > btcount.MaxTransactionsLimit {
+		return page, fmt.Errorf("%w: limit should be in range [1, %d]", btcount.ErrInvalidParameter, btcount.MaxTransactionsLimit)
+	}
+
+	if query.After != nil && query.After.Descending != query.Descending {
+		return page, fmt.Errorf("%w: cursor was made for another order", btcount.ErrInvalidParameter)
+	}
+
+	query.Since = query.Since.UTC()
+	query.Till = query.Till.UTC()
+
+	// One more transaction is loaded to find out whether there is the
+	// next page.
+	limit := query.Limit
+	query.Limit++
+
+	page.Transactions, err = api.store.Repos().Transactions.List(ctx, walletID, query)
+	if err != nil {
+		return page, fmt.Errorf("loading transactions: %w", err)
+	}
+
+	if len(page.Transactions) > limit {
+		page.Transactions = page.Transactions[:limit]
+		next := btcount.NewTransactionCursor(page.Transactions[limit-1], query.Descending)
+		page.Next = &next
+	}
+
+	return page, nil
+}
@@ -2,266 +2,538 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/ferux/btcount/internal/btcontext"
 	"github.com/ferux/btcount/internal/btcount"
 	"github.com/ferux/btcount/internal/cache"
+	"github.com/ferux/btcount/internal/notify"
 	"go.uber.org/zap"
 )
 
 // WalletAPI provides methods for interacting with wallet.
 type WalletAPI interface {
+	// CreateWallet creates a new wallet.
+	CreateWallet(ctx context.Context, wallet btcount.Wallet) (created btcount.Wallet, err error)
+	// GetWallet loads the wallet by its id.
+	GetWallet(ctx context.Context, walletID int64) (wallet btcount.Wallet, err error)
+	// ListWallets loads all wallets.
+	ListWallets(ctx context.Context) (wallets []btcount.Wallet, err error)
+	// DeleteWallet removes the wallet with all its transactions. The
+	// default wallet can not be deleted.
+	DeleteWallet(ctx context.Context, walletID int64) (err error)
 	// CreateTransaction saves transaction to the storage. It also check
-	// the amount is not less that 0 and the datetime is not empty.
-	CreateTransaction(ctx context.Context, t btcount.Transaction) (err error)
-	// FetchBalanceByHour loads balance of the wallet by the provided
-	// time range.
-	FetchBalanceByHour(ctx context.Context, from, till time.Time) (ts []btcount.HistoryStat, err error)
-	// GetCurrentBalance gets the actual balance.
-	GetCurrentBalance(ctx context.Context) (amount btcount.Decimal, err error)
+	// the amount is greater than 0 and the datetime is not empty. A
+	// transaction repeated with the same idempotency key is saved once,
+	// ErrConflict is returned if the payload differs from the saved one.
+	CreateTransaction(ctx context.Context, walletID int64, t btcount.Transaction) (created btcount.Transaction, err error)
+	// CreateWithdrawal saves transaction which debits the wallet by the
+	// provided positive amount. It returns ErrNegativeValue in case the
+	// balance of the wallet becomes less than 0 now or at any point since
+	// the datetime of the withdrawal. Idempotency keys are
+	// handled the same way as by CreateTransaction.
+	CreateWithdrawal(ctx context.Context, walletID int64, t btcount.Transaction) (created btcount.Transaction, err error)
+	// CreateTransactions saves the batch of transactions in a single
+	// storage transaction and returns the result of every one of them in
+	// the same order. Invalid transactions, conflicting replays and
+	// withdrawals making the balance negative fail alone while the other
+	// ones are saved. Idempotency keys are handled the same way as by
+	// CreateTransaction.
+	CreateTransactions(ctx context.Context, walletID int64, items []BatchItem) (results []BatchResult, err error)
+	// GetTransaction loads the transaction of the wallet by its id.
+	GetTransaction(ctx context.Context, walletID, transactionID int64) (t btcount.Transaction, err error)
+	// ListTransactions loads a page of transactions of the wallet.
+	ListTransactions(ctx context.Context, walletID int64, query btcount.TransactionListQuery) (page TransactionPage, err error)
+	// FetchBalanceHistory loads balance of the wallet by the provided
+	// time range partitioned by buckets of the requested granularity.
+	FetchBalanceHistory(ctx context.Context, walletID int64, params HistoryParams) (ts []btcount.HistoryStat, err error)
+	// StreamBalanceHistory passes the same stats as FetchBalanceHistory
+	// returns to fn one by one, so large ranges are not kept in memory.
+	// The streaming stops at the first error of fn.
+	StreamBalanceHistory(ctx context.Context, walletID int64, params HistoryParams, fn func(stat btcount.HistoryStat) error) (err error)
+	// GetCurrentBalance gets the actual balance of the wallet.
+	GetCurrentBalance(ctx context.Context, walletID int64) (amount btcount.Decimal, err error)
+	// GetBalanceAt gets the balance of the wallet at the provided moment.
+	// Transactions dated exactly at the moment are included.
+	GetBalanceAt(ctx context.Context, walletID int64, at time.Time) (amount btcount.Decimal, err error)
+	// ReconcileStats recomputes hourly stats of the wallet from its
+	// transactions, reports stored stats which differ and optionally
+	// rewrites them in a single storage transaction.
+	ReconcileStats(ctx context.Context, walletID int64, params ReconcileParams) (report ReconcileReport, err error)
+}
+
+// WalletAPIParams defines dependencies of the wallet api.
+type WalletAPIParams struct {
+	Store btcount.Store
+
+	// AmountScale is the maximum amount of digits after the decimal point
+	// accepted for transaction amounts.
+	AmountScale int32
+	// HistoryMaxPoints limits the amount of points in the filled history.
+	HistoryMaxPoints int
+	// FuturePolicy defines how transactions dated in the future are
+	// handled.
+	FuturePolicy btcount.FuturePolicy
+
+	// StatCollector is optional.
+	StatCollector *cache.CurrentHourStatCollector
+	// Events is optional. Saved transactions are published to it. It is
+	// not set if the events follow changes of every instance instead.
+	Events *notify.Broker
 }
 
 // NewWalletAPI creates a new wallet api.
-func NewWalletAPI(db btcount.Database, hstore btcount.HistoryStatStorage, tstore btcount.TransactionStorage, statCollector *cache.CurrentHourStatCollector) WalletAPI {
+func NewWalletAPI(params WalletAPIParams) WalletAPI {
 	return walletAPI{
-		db:            db,
-		tstore:        tstore,
-		hstore:        hstore,
-		statCollector: statCollector,
+		store:            params.Store,
+		amountScale:      params.AmountScale,
+		historyMaxPoints: params.HistoryMaxPoints,
+		futurePolicy:     params.FuturePolicy,
+		statCollector:    params.StatCollector,
+		events:           params.Events,
 	}
 }
 
 type walletAPI struct {
-	db     btcount.Database
-	tstore btcount.TransactionStorage
-	hstore btcount.HistoryStatStorage
+	store btcount.Store
+
+	amountScale      int32
+	historyMaxPoints int
+	futurePolicy     btcount.FuturePolicy
 
 	statCollector *cache.CurrentHourStatCollector
+	events        *notify.Broker
 }
 
-// CreateTransaction implements WalletAPI interface.
-func (api walletAPI) CreateTransaction(ctx context.Context, transaction btcount.Transaction) (err error) {
-	if transaction.Datetime.IsZero() {
-		return fmt.Errorf("%w: %s", btcount.ErrInvalidParameter, "datetime")
+// CreateWallet implements WalletAPI interface.
+func (api walletAPI) CreateWallet(ctx context.Context, wallet btcount.Wallet) (created btcount.Wallet, err error) {
+	if wallet.Name == "" {
+		return created, fmt.Errorf("%w: %s", btcount.ErrInvalidParameter, "name")
 	}
 
-	transaction.Datetime = transaction.Datetime.UTC()
+	created, err = api.store.Repos().Wallets.Create(ctx, wallet)
+	if err != nil {
+		return created, fmt.Errorf("saving wallet to the storage: %w", err)
+	}
 
-	btcontext.Logger(ctx).Debug("saving", zap.Any("transaction", transaction))
+	if api.statCollector != nil {
+		api.statCollector.Track(btcount.HistoryStat{WalletID: created.ID})
+	}
+
+	return created, nil
+}
+
+// GetWallet implements WalletAPI interface.
+func (api walletAPI) GetWallet(ctx context.Context, walletID int64) (wallet btcount.Wallet, err error) {
+	wallet, err = api.store.Repos().Wallets.Get(ctx, walletID)
+	if err != nil {
+		return wallet, fmt.Errorf("loading wallet %d: %w", walletID, err)
+	}
+
+	return wallet, nil
+}
 
-	err = api.tstore.Save(ctx, api.db, transaction)
+// ListWallets implements WalletAPI interface.
+func (api walletAPI) ListWallets(ctx context.Context) (wallets []btcount.Wallet, err error) {
+	wallets, err = api.store.Repos().Wallets.List(ctx)
 	if err != nil {
-		return fmt.Errorf("saving transaction to the storage: %w", err)
+		return nil, fmt.Errorf("loading wallets: %w", err)
+	}
+
+	return wallets, nil
+}
+
+// DeleteWallet implements WalletAPI interface.
+func (api walletAPI) DeleteWallet(ctx context.Context, walletID int64) (err error) {
+	if walletID == btcount.DefaultWalletID {
+		return fmt.Errorf("%w: %s", btcount.ErrInvalidParameter, "default wallet can not be deleted")
+	}
+
+	err = api.store.Repos().Wallets.Delete(ctx, walletID)
+	if err != nil {
+		return fmt.Errorf("deleting wallet %d: %w", walletID, err)
 	}
 
 	if api.statCollector != nil {
-		api.statCollector.Collect(transaction)
+		api.statCollector.Forget(walletID)
 	}
 
 	return nil
 }
 
-func (api walletAPI) FetchBalanceByHour(ctx context.Context, since time.Time, till time.Time) (stats []btcount.HistoryStat, err error) {
-	log := btcontext.Logger(ctx)
-	// get the start of the hour.
-	since = since.Truncate(time.Hour)
-	// round up till.
-	tillHour := till.Truncate(time.Hour)
-	if tillHour.Before(till) {
-		till = tillHour.Add(time.Hour)
-	} else {
-		till = tillHour
-	}
-	// calculate left time. This is needed because it's possible to collect
-	// history stats until the current hour. The left transactions might
-	// be cached, if cache is initied, or should be loaded from the database
-	// and prepared.
-	log.Debug("time ranges",
-		zap.Time("since", since),
-		zap.Time("till", till),
-	)
+// CreateTransaction implements WalletAPI interface.
+func (api walletAPI) CreateTransaction(ctx context.Context, walletID int64, transaction btcount.Transaction) (created btcount.Transaction, err error) {
+	var clamped bool
+	transaction, clamped, err = api.prepareTransaction(walletID, transaction)
+	if err != nil {
+		return created, err
+	}
+
+	btcontext.Logger(ctx).Debug("saving", zap.Any("transaction", transaction))
 
-	stats, err = api.hstore.Load(ctx, api.db, btcount.TimerangeQuery{
-		Since: since,
-		Till:  till,
+	// The wallet is locked so history stats are not changed
+	// concurrently while being repaired.
+	var replayed bool
+	err = api.store.WithinTx(ctx, func(r btcount.Repos) (err error) {
+		_, err = r.Wallets.Lock(ctx, walletID)
+		if err != nil {
+			return fmt.Errorf("locking wallet %d: %w", walletID, err)
+		}
+
+		created, err = r.Transactions.Save(ctx, transaction)
+		if errors.Is(err, btcount.ErrAlreadyExists) {
+			replayed = true
+			created, err = api.checkReplay(ctx, r, transaction, clamped)
+
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("saving transaction to the storage: %w", err)
+		}
+
+		return api.repairStats(ctx, r, walletID, created.Datetime)
 	})
 	if err != nil {
-		return nil, fmt.Errorf("loading history stats: %w", err)
+		return created, err
 	}
 
-	if len(stats) == 0 {
-		log.Debug("no stats loaded, using slow method")
-		return api.loadBalanceSlow(ctx, since, till)
+	if api.statCollector != nil && !replayed {
+		api.statCollector.Collect(created)
 	}
 
-	log.Debug("loaded history stats", zap.Int("len", len(stats)))
-	lastStat := stats[len(stats)-1]
-	// it means lastStat datetime is equal or after till and there's
-	// nothing left to do.
-	if !lastStat.Datetime.Before(till) {
-		return stats, nil
+	if !replayed {
+		api.publishTransactions(ctx, walletID, []btcount.Transaction{created})
 	}
 
-	hourStart := time.Now().Truncate(time.Hour)
-	if lastStat.Datetime.Before(hourStart) {
-		var ts []btcount.Transaction
-		ts, err = api.tstore.Load(ctx, api.db, btcount.TimerangeQuery{
-			Since: till,
-			Till:  hourStart,
-		})
+	return created, nil
+}
+
+// CreateWithdrawal implements WalletAPI interface.
+func (api walletAPI) CreateWithdrawal(ctx context.Context, walletID int64, transaction btcount.Transaction) (created btcount.Transaction, err error) {
+	var clamped bool
+	transaction, clamped, err = api.prepareTransaction(walletID, transaction)
+	if err != nil {
+		return created, err
+	}
+	transaction.Amount = transaction.Amount.Neg()
+
+	btcontext.Logger(ctx).Debug("saving", zap.Any("withdrawal", transaction))
+
+	// The wallet is locked so concurrent withdrawals are serialized
+	// and can not spend the same coins twice.
+	var replayed bool
+	err = api.store.WithinTx(ctx, func(r btcount.Repos) (err error) {
+		_, err = r.Wallets.Lock(ctx, walletID)
 		if err != nil {
-			return nil, fmt.Errorf("loading transactions: %w", err)
+			return fmt.Errorf("locking wallet %d: %w", walletID, err)
 		}
 
-		newstats := btcount.CollectTransactionsIntoStats(ts, lastStat.Amount)
-		if len(newstats) > 0 {
-			stats = append(stats, newstats...)
-			lastStat = stats[len(stats)-1]
+		// The replayed withdrawal is checked before the balance as it
+		// could be spent since the original one.
+		if transaction.IdempotencyKey != "" {
+			created, err = api.checkReplay(ctx, r, transaction, clamped)
+			if err == nil {
+				replayed = true
+
+				return nil
+			}
+
+			if !errors.Is(err, btcount.ErrNotFound) {
+				return err
+			}
 		}
+
+		var available btcount.Decimal
+		available, err = r.Transactions.SumAvailable(ctx, walletID, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("calculating balance: %w", err)
+		}
+
+		err = checkWithdrawal(ctx, r, transaction, available, btcount.Decimal{})
+		if err != nil {
+			return err
+		}
+
+		created, err = r.Transactions.Save(ctx, transaction)
+		if errors.Is(err, btcount.ErrAlreadyExists) {
+			replayed = true
+			created, err = api.checkReplay(ctx, r, transaction, clamped)
+
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("saving transaction to the storage: %w", err)
+		}
+
+		return api.repairStats(ctx, r, walletID, created.Datetime)
+	})
+	if err != nil {
+		return created, err
 	}
 
-	if api.statCollector != nil {
-		log.Debug("loading leftovers from cache")
+	if api.statCollector != nil && !replayed {
+		api.statCollector.Collect(created)
+	}
 
-		return append(stats, api.statCollector.GetStat()), nil
+	if !replayed {
+		api.publishTransactions(ctx, walletID, []btcount.Transaction{created})
 	}
 
-	var ts []btcount.Transaction
-	ts, err = api.tstore.Load(ctx, api.db, btcount.TimerangeQuery{
-		Since: hourStart,
-		Till:  till,
-	})
+	return created, nil
+}
+
+// checkWithdrawal checks the withdrawal keeps the balance of the wallet
+// non-negative now and at any point since its datetime, as the backdated
+// withdrawal changes the past balance too. Available is the balance
+// available now and pending is the change of the past balance since the
+// withdrawal by transactions not saved yet. The amount of the withdrawal
+// is negative. The error wraps btcount.ErrNegativeValue if the balance is
+// not enough.
+func checkWithdrawal(ctx context.Context, r btcount.Repos, withdrawal btcount.Transaction, available, pending btcount.Decimal) (err error) {
+	if available.Add(withdrawal.Amount).IsNegative() {
+		return fmt.Errorf("%w: balance %s is not enough", btcount.ErrNegativeValue, available)
+	}
+
+	low, err := r.Transactions.LowestBalance(ctx, withdrawal.WalletID, withdrawal.Datetime)
 	if err != nil {
-		return nil, fmt.Errorf("loading transactions for last hour: %w", err)
+		return fmt.Errorf("calculating lowest balance: %w", err)
 	}
 
-	newstats := btcount.CollectTransactionsIntoStats(ts, lastStat.Amount)
-	return append(stats, newstats...), nil
+	low = low.Add(pending)
+	if low.Add(withdrawal.Amount).IsNegative() {
+		return fmt.Errorf("%w: balance %s since %s is not enough",
+			btcount.ErrNegativeValue, low, withdrawal.Datetime.Format(time.RFC3339))
+	}
+
+	return nil
 }
 
-func (api walletAPI) GetCurrentBalance(ctx context.Context) (amount btcount.Decimal, err error) {
+// publishTransactions publishes events of saved transactions with the
+// current balance of the wallet. The balance is taken from the cache if
+// the wallet is tracked, otherwise it is loaded only if somebody is
+// subscribed to the wallet. Transactions are committed already, so the
+// balance is loaded even if ctx is canceled and failures are only logged.
+func (api walletAPI) publishTransactions(ctx context.Context, walletID int64, ts []btcount.Transaction) {
+	if api.events == nil || len(ts) == 0 {
+		return
+	}
+
+	var balance btcount.Decimal
+	var cached bool
 	if api.statCollector != nil {
-		return api.statCollector.GetStat().Amount, nil
+		var stat btcount.HistoryStat
+		stat, cached = api.statCollector.GetStat(walletID)
+		balance = stat.Amount
+	}
+
+	if !cached {
+		if api.events.Skip(walletID) {
+			return
+		}
+
+		log := btcontext.Logger(ctx)
+
+		var err error
+		balance, err = api.store.Repos().Transactions.Balance(btcontext.WithLogger(context.Background(), log), walletID, time.Now().UTC())
+		if err != nil {
+			log.Warn("unable to publish transactions", zap.Int64("wallet_id", walletID), zap.Error(err))
+
+			return
+		}
 	}
 
+	for i := range ts {
+		t := ts[i]
+		api.events.Publish(notify.Event{
+			Kind:        notify.KindTransaction,
+			WalletID:    walletID,
+			Transaction: &t,
+			Balance:     balance,
+		})
+	}
+}
+
+// repairStats recomputes saved history stats affected by transactions
+// backdated to since, i.e. stats of the hour of since and all the
+// following ones. Transactions of the hours without saved stats are
+// collected by the worker later. The wallet should be locked.
+func (api walletAPI) repairStats(ctx context.Context, r btcount.Repos, walletID int64, since time.Time) (err error) {
+	// Stats are saved for the passed hours only, so the latest one is
+	// before now.
 	var lastStat btcount.HistoryStat
-	lastStat, err = api.hstore.LoadLastStat(ctx, api.db, time.Now())
+	lastStat, err = r.History.LoadLastStat(ctx, walletID, time.Now().UTC())
+	if errors.Is(err, btcount.ErrNotFound) {
+		return nil
+	}
 	if err != nil {
-		return amount, fmt.Errorf("loading last history stat: %w", err)
+		return fmt.Errorf("loading last history stat: %w", err)
 	}
 
-	var ts []btcount.Transaction
-	ts, err = api.tstore.Load(ctx, api.db, btcount.TimerangeQuery{
-		Since: lastStat.Datetime,
-		Till:  time.Now(),
-	})
+	if !lastStat.Datetime.After(since) {
+		return nil
+	}
+
+	var baseStat btcount.HistoryStat
+	baseStat, err = r.History.LoadLastStat(ctx, walletID, since)
+	if err != nil && !errors.Is(err, btcount.ErrNotFound) {
+		return fmt.Errorf("loading history stat before the transaction: %w", err)
+	}
+
+	btcontext.Logger(ctx).Debug("repairing history stats",
+		zap.Int64("wallet_id", walletID),
+		zap.Time("since", baseStat.Datetime),
+		zap.Time("till", lastStat.Datetime),
+	)
+
+	err = r.History.Delete(ctx, walletID, btcount.NewStatRangeQuery(baseStat.Datetime, lastStat.Datetime))
 	if err != nil {
-		return amount, fmt.Errorf("loading transactions: %w", err)
+		return fmt.Errorf("deleting history stats: %w", err)
 	}
 
-	if len(ts) == 0 {
-		return lastStat.Amount, nil
+	var ts []btcount.Transaction
+	ts, err = r.Transactions.Load(ctx, walletID, btcount.NewTimeRangeQuery(baseStat.Datetime, lastStat.Datetime))
+	if err != nil {
+		return fmt.Errorf("loading transactions: %w", err)
 	}
 
-	stats := btcount.CollectTransactionsIntoStats(ts, lastStat.Amount)
-	if len(stats) == 0 {
-		return lastStat.Amount, nil
+	stats := btcount.CollectTransactionsIntoStats(ts, baseStat.Amount)
+
+	err = r.History.SaveMany(ctx, stats)
+	if err != nil {
+		return fmt.Errorf("saving history stats: %w", err)
 	}
 
-	return stats[len(stats)-1].Amount, nil
+	return nil
 }
 
-func (api walletAPI) loadBalanceSlow(ctx context.Context, since, till time.Time) (stats []btcount.HistoryStat, err error) {
-	now := time.Now().Truncate(time.Hour)
+// checkReplay compares the transaction with the saved one with the same
+// idempotency key and returns the saved one. The datetime of clamped
+// transactions is assigned by the server, so it is not compared. It
+// returns ErrConflict if payloads differ and ErrNotFound if there is no
+// such transaction.
+func (api walletAPI) checkReplay(ctx context.Context, r btcount.Repos, transaction btcount.Transaction, clamped bool) (saved btcount.Transaction, err error) {
+	saved, err = r.Transactions.LoadByIdempotencyKey(ctx, transaction.WalletID, transaction.IdempotencyKey)
+	if err != nil {
+		return saved, fmt.Errorf("loading transaction by idempotency key: %w", err)
+	}
 
-	var ts []btcount.Transaction
-	ts, err = api.tstore.Load(ctx, api.db, btcount.NewTimeRangeQuery(since, till))
+	err = comparePayload(saved, transaction, clamped)
 	if err != nil {
-		return nil, fmt.Errorf("loading transactions: %w", err)
+		return saved, err
 	}
 
-	stats = btcount.CollectTransactionsIntoStats(ts, btcount.DecimalFromFloat(0))
+	btcontext.Logger(ctx).Debug("replayed", zap.Any("transaction", saved))
 
-	if till.Before(now) {
-		return stats, nil
+	return saved, nil
+}
+
+// comparePayload returns ErrConflict if the transaction differs from the
+// saved one with the same idempotency key.
+func comparePayload(saved, transaction btcount.Transaction, clamped bool) (err error) {
+	if clamped {
+		transaction.Datetime = saved.Datetime
 	}
 
-	lastStat := stats[len(stats)-1]
-	if lastStat.Datetime.After(now) {
-		api.statCollector.Adjust(lastStat.Amount)
+	if !saved.SamePayload(transaction) {
+		return fmt.Errorf("%w: idempotency key %q is used by another transaction", btcount.ErrConflict, transaction.IdempotencyKey)
 	}
 
-	return stats, nil
+	return nil
 }
 
-// FetchBalanceByHour implements WalletAPI interface.
-func (api walletAPI) FetchBalanceByHour_old(ctx context.Context, since time.Time, till time.Time) (stats []btcount.HistoryStat, err error) {
-	log := btcontext.Logger(ctx)
-	// get the start of the hour.
-	since = since.Truncate(time.Hour)
-	// till should be rounded up but since truncate performs round down,
-	// check if till later than start of the hour and add addirional
-	// hour then.
-	now := time.Now().Truncate(time.Hour)
-	if till.After(now) {
-		till = now
-	}
-	// tillHour := till.Truncate(time.Hour)
-	// now := time.Now().Truncate(time.Hour)
-	// if till.After(tillHour) {
-	// 	till = tillHour.Add(time.Hour).Truncate(time.Hour)
-	// }
-
-	historyStatsQuery := btcount.TimerangeQuery{
-		Since: since,
-		Till:  till,
-	}
-
-	log.Debug("loaded history stats", zap.Any("bouds", historyStatsQuery))
-	stats, err = api.hstore.Load(ctx, api.db, historyStatsQuery)
+// prepareTransaction validates the transaction and applies the future
+// policy to its datetime. It reports whether the datetime is clamped.
+func (api walletAPI) prepareTransaction(walletID int64, transaction btcount.Transaction) (prepared btcount.Transaction, clamped bool, err error) {
+	err = api.validateTransaction(transaction)
+	if err != nil {
+		return prepared, false, err
+	}
+
+	requested := transaction.Datetime
+
+	transaction.WalletID = walletID
+	transaction.Datetime, err = api.futurePolicy.Apply(requested, time.Now())
 	if err != nil {
-		return nil, fmt.Errorf("loading history stats: %w", err)
+		return prepared, false, err
 	}
 
-	log.Debug("loaded history stats", zap.Int("len", len(stats)))
+	transaction.Datetime = transaction.Datetime.UTC()
+
+	return transaction, !transaction.Datetime.Equal(requested), nil
+}
+
+func (api walletAPI) validateTransaction(transaction btcount.Transaction) (err error) {
+	if transaction.Datetime.IsZero() {
+		return fmt.Errorf("%w: %s", btcount.ErrInvalidParameter, "datetime")
+	}
 
-	var startHour time.Time
-	initialBalance := btcount.DecimalFromFloat(0.0)
-	if len(stats) == 0 {
-		startHour = since
-	} else {
-		stat := stats[len(stats)-1]
-		initialBalance = stat.Amount
-		startHour = stat.Datetime
+	if !transaction.Amount.IsPositive() {
+		return fmt.Errorf("%w: %s", btcount.ErrNegativeValue, "amount")
 	}
 
-	if !till.After(startHour) {
-		return stats, nil
+	if !transaction.Amount.FitsScale(api.amountScale) {
+		return fmt.Errorf("%w: amount has more than %d digits after the decimal point", btcount.ErrInvalidParameter, api.amountScale)
+	}
+
+	return nil
+}
+
+// GetCurrentBalance implements WalletAPI interface.
+func (api walletAPI) GetCurrentBalance(ctx context.Context, walletID int64) (amount btcount.Decimal, err error) {
+	_, err = api.GetWallet(ctx, walletID)
+	if err != nil {
+		return amount, err
 	}
 
 	if api.statCollector != nil {
-		stats = append(stats, api.statCollector.GetStat())
-	} else {
-		var ts []btcount.Transaction
-		ts, err = api.tstore.Load(ctx, api.db, btcount.TimerangeQuery{
-			Since: startHour,
-			Till:  till,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("loading transactions: %w", err)
+		if stat, ok := api.statCollector.GetStat(walletID); ok {
+			return stat.Amount, nil
 		}
+	}
 
-		log.Debug("loading additional raw transactions",
-			zap.Int("len", len(ts)),
-		)
+	amount, err = api.store.Repos().Transactions.Balance(ctx, walletID, time.Now().UTC())
+	if err != nil {
+		return amount, fmt.Errorf("loading balance: %w", err)
+	}
 
-		leftStats := btcount.CollectTransactionsIntoStats(ts, initialBalance)
-		if len(leftStats) > 0 {
-			stats = append(stats, leftStats...)
-		}
+	return amount, nil
+}
+
+// GetBalanceAt implements WalletAPI interface. The balance is the amount
+// of the last stat by at plus transactions made since the end of its
+// bucket. A stat covers transactions dated before the end of its bucket,
+// so transactions are loaded in [stat datetime, at].
+func (api walletAPI) GetBalanceAt(ctx context.Context, walletID int64, at time.Time) (amount btcount.Decimal, err error) {
+	_, err = api.GetWallet(ctx, walletID)
+	if err != nil {
+		return amount, err
+	}
+
+	at = at.UTC()
+	r := api.store.Repos()
+
+	var lastStat btcount.HistoryStat
+	lastStat, err = r.History.LoadLastStat(ctx, walletID, at)
+	if err != nil && !errors.Is(err, btcount.ErrNotFound) {
+		return amount, fmt.Errorf("loading last history stat: %w", err)
+	}
 
+	var ts []btcount.Transaction
+	ts, err = r.Transactions.Load(ctx, walletID, btcount.TimerangeQuery{
+		Since:       lastStat.Datetime,
+		Till:        at,
+		IncludeTill: true,
+	})
+	if err != nil {
+		return amount, fmt.Errorf("loading transactions: %w", err)
+	}
+
+	amount = lastStat.Amount
+	for _, t := range ts {
+		amount = amount.Add(t.Amount)
 	}
-	return stats, nil
+
+	return amount, nil
 }
@@ -0,0 +1,540 @@
+package api_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ferux/btcount/internal/api"
+	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/bttest"
+)
+
+func TestCreateTransactionRepairsStats(t *testing.T) {
+	ctx := bttest.GetContext()
+	hstore := bttest.GetRepos().History
+	wapi := bttest.GetWalletAPI()
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour * 10)
+
+	var tt = []struct {
+		name     string
+		datetime time.Time
+		exp      []btcount.HistoryStat
+	}{{
+		name:     "past hour with stat",
+		datetime: hour.Add(time.Minute * 30),
+		exp: []btcount.HistoryStat{
+			{Datetime: hour.Add(time.Hour), Amount: btcount.DecimalFromFloat(3.0)},
+			{Datetime: hour.Add(time.Hour * 3), Amount: btcount.DecimalFromFloat(4.0)},
+		},
+	}, {
+		name:     "past hour without stat",
+		datetime: hour.Add(time.Hour + time.Minute*30),
+		exp: []btcount.HistoryStat{
+			{Datetime: hour.Add(time.Hour), Amount: btcount.DecimalFromFloat(1.0)},
+			{Datetime: hour.Add(time.Hour * 2), Amount: btcount.DecimalFromFloat(3.0)},
+			{Datetime: hour.Add(time.Hour * 3), Amount: btcount.DecimalFromFloat(4.0)},
+		},
+	}, {
+		name:     "hour before the first stat",
+		datetime: hour.Add(-time.Hour * 5),
+		exp: []btcount.HistoryStat{
+			{Datetime: hour.Add(-time.Hour * 4), Amount: btcount.DecimalFromFloat(2.0)},
+			{Datetime: hour.Add(time.Hour), Amount: btcount.DecimalFromFloat(3.0)},
+			{Datetime: hour.Add(time.Hour * 3), Amount: btcount.DecimalFromFloat(4.0)},
+		},
+	}, {
+		name:     "current hour",
+		datetime: time.Now(),
+		exp: []btcount.HistoryStat{
+			{Datetime: hour.Add(time.Hour), Amount: btcount.DecimalFromFloat(1.0)},
+			{Datetime: hour.Add(time.Hour * 3), Amount: btcount.DecimalFromFloat(2.0)},
+		},
+	}, {
+		name:     "within clock skew",
+		datetime: time.Now().Add(time.Second * 30),
+		exp: []btcount.HistoryStat{
+			{Datetime: hour.Add(time.Hour), Amount: btcount.DecimalFromFloat(1.0)},
+			{Datetime: hour.Add(time.Hour * 3), Amount: btcount.DecimalFromFloat(2.0)},
+		},
+	}}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			wallet, err := wapi.CreateWallet(ctx, btcount.Wallet{Name: "repair"})
+			assertNoError(t, err)
+
+			// Transactions of the passed hours are collected into stats as
+			// the worker does.
+			for _, datetime := range []time.Time{hour, hour.Add(time.Hour * 2)} {
+				_, err = wapi.CreateTransaction(ctx, wallet.ID, btcount.Transaction{
+					Amount:   btcount.DecimalFromFloat(1.0),
+					Datetime: datetime,
+				})
+				assertNoError(t, err)
+			}
+
+			err = hstore.SaveMany(ctx, []btcount.HistoryStat{
+				{WalletID: wallet.ID, Datetime: hour.Add(time.Hour), Amount: btcount.DecimalFromFloat(1.0)},
+				{WalletID: wallet.ID, Datetime: hour.Add(time.Hour * 3), Amount: btcount.DecimalFromFloat(2.0)},
+			})
+			assertNoError(t, err)
+
+			_, err = wapi.CreateTransaction(ctx, wallet.ID, btcount.Transaction{
+				Amount:   btcount.DecimalFromFloat(2.0),
+				Datetime: tc.datetime,
+			})
+			assertNoError(t, err)
+
+			got, err := hstore.Load(ctx, wallet.ID, btcount.NewTimeRangeQuery(time.Time{}, time.Now()))
+			assertNoError(t, err)
+
+			if len(got) != len(tc.exp) {
+				t.Fatalf("length not equal\nexp: %v\ngot: %v", tc.exp, got)
+			}
+
+			for i := range got {
+				if !got[i].Datetime.Equal(tc.exp[i].Datetime) || !got[i].Amount.Equal(tc.exp[i].Amount) {
+					t.Fatalf("values not equal at %d\nexp: %v\ngot: %v", i, tc.exp, got)
+				}
+			}
+
+			err = wapi.DeleteWallet(ctx, wallet.ID)
+			assertNoError(t, err)
+		})
+	}
+}
+
+func TestCreateWithdrawalBackdated(t *testing.T) {
+	ctx := bttest.GetContext()
+	wapi := bttest.GetWalletAPI()
+
+	wallet, err := wapi.CreateWallet(ctx, btcount.Wallet{Name: "backdated"})
+	assertNoError(t, err)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour * 10)
+	for _, transaction := range []btcount.Transaction{
+		{Amount: btcount.DecimalFromFloat(1.0), Datetime: hour},
+		{Amount: btcount.DecimalFromFloat(4.0), Datetime: hour.Add(time.Hour * 2)},
+	} {
+		_, err = wapi.CreateTransaction(ctx, wallet.ID, transaction)
+		assertNoError(t, err)
+	}
+
+	var tt = []struct {
+		name     string
+		amount   float64
+		datetime time.Time
+		err      error
+	}{
+		{name: "before the deposits", amount: 1.0, datetime: hour.Add(-time.Hour), err: btcount.ErrNegativeValue},
+		{name: "over the past balance", amount: 2.0, datetime: hour.Add(time.Hour), err: btcount.ErrNegativeValue},
+		{name: "within the past balance", amount: 1.0, datetime: hour.Add(time.Hour)},
+		{name: "spent in the past already", amount: 1.0, datetime: hour.Add(time.Minute * 30), err: btcount.ErrNegativeValue},
+		{name: "after the deposits", amount: 4.0, datetime: hour.Add(time.Hour * 3)},
+	}
+
+	for _, tc := range tt {
+		_, err = wapi.CreateWithdrawal(ctx, wallet.ID, btcount.Transaction{
+			Amount:   btcount.DecimalFromFloat(tc.amount),
+			Datetime: tc.datetime,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: exp error: %v, got: %v", tc.name, tc.err, err)
+		}
+	}
+
+	err = wapi.DeleteWallet(ctx, wallet.ID)
+	assertNoError(t, err)
+}
+
+func TestGetBalanceAt(t *testing.T) {
+	ctx := bttest.GetContext()
+	wapi := bttest.GetWalletAPI()
+
+	wallet, err := wapi.CreateWallet(ctx, btcount.Wallet{Name: "audit"})
+	assertNoError(t, err)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour * 10)
+	for _, transaction := range []btcount.Transaction{
+		{Amount: btcount.DecimalFromFloat(1.0), Datetime: hour.Add(-time.Minute * 30)},
+		{Amount: btcount.DecimalFromFloat(2.0), Datetime: hour},
+		{Amount: btcount.DecimalFromFloat(4.0), Datetime: hour.Add(time.Minute * 30)},
+	} {
+		_, err = wapi.CreateTransaction(ctx, wallet.ID, transaction)
+		assertNoError(t, err)
+	}
+
+	// The stat covers transactions dated before the end of its bucket.
+	err = bttest.GetRepos().History.Save(ctx, btcount.HistoryStat{
+		WalletID: wallet.ID,
+		Datetime: hour,
+		Amount:   btcount.DecimalFromFloat(1.0),
+	})
+	assertNoError(t, err)
+
+	var tt = []struct {
+		name string
+		at   time.Time
+		exp  float64
+	}{{
+		name: "before the first transaction",
+		at:   hour.Add(-time.Minute*30 - time.Nanosecond),
+		exp:  0,
+	}, {
+		name: "at the first transaction",
+		at:   hour.Add(-time.Minute * 30),
+		exp:  1.0,
+	}, {
+		name: "before the end of the bucket",
+		at:   hour.Add(-time.Nanosecond),
+		exp:  1.0,
+	}, {
+		name: "at the end of the bucket",
+		at:   hour,
+		exp:  3.0,
+	}, {
+		name: "within the partial hour",
+		at:   hour.Add(time.Minute*30 - time.Microsecond),
+		exp:  3.0,
+	}, {
+		name: "at the last transaction",
+		at:   hour.Add(time.Minute * 30).In(time.FixedZone("UTC+3", 3*60*60)),
+		exp:  7.0,
+	}}
+
+	for _, tc := range tt {
+		amount, err := wapi.GetBalanceAt(ctx, wallet.ID, tc.at)
+		assertNoError(t, err)
+
+		if !amount.Equal(btcount.DecimalFromFloat(tc.exp)) {
+			t.Errorf("%s: exp: %v, got: %s", tc.name, tc.exp, amount)
+		}
+	}
+
+	err = wapi.DeleteWallet(ctx, wallet.ID)
+	assertNoError(t, err)
+}
+
+func TestCreateTransactions(t *testing.T) {
+	ctx := bttest.GetContext()
+	wapi := bttest.GetWalletAPI()
+
+	wallet, err := wapi.CreateWallet(ctx, btcount.Wallet{Name: "import"})
+	assertNoError(t, err)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour * 10)
+	err = bttest.GetRepos().History.Save(ctx, btcount.HistoryStat{
+		WalletID: wallet.ID,
+		Datetime: hour.Add(time.Hour),
+	})
+	assertNoError(t, err)
+
+	item := func(amount float64, minutes time.Duration, key string, withdrawal bool) api.BatchItem {
+		return api.BatchItem{
+			Transaction: btcount.Transaction{
+				Amount:         btcount.DecimalFromFloat(amount),
+				Datetime:       hour.Add(time.Minute * minutes),
+				IdempotencyKey: key,
+			},
+			Withdrawal: withdrawal,
+		}
+	}
+
+	var tt = []struct {
+		name     string
+		item     api.BatchItem
+		err      error
+		replayed bool
+	}{
+		{name: "deposit", item: item(1.0, 30, "a", false)},
+		{name: "withdrawal over the balance", item: item(3.0, 40, "", true), err: btcount.ErrNegativeValue},
+		{name: "backdated deposit", item: item(2.0, 10, "b", false)},
+		{name: "replayed within the batch", item: item(1.0, 30, "a", false), replayed: true},
+		{name: "conflicting replay", item: item(5.0, 30, "a", false), err: btcount.ErrConflict},
+		{name: "zero amount", item: item(0, 30, "", false), err: btcount.ErrNegativeValue},
+		{name: "withdrawal spending the batch", item: item(2.5, 50, "", true)},
+	}
+
+	items := make([]api.BatchItem, 0, len(tt))
+	for _, tc := range tt {
+		items = append(items, tc.item)
+	}
+
+	results, err := wapi.CreateTransactions(ctx, wallet.ID, items)
+	assertNoError(t, err)
+
+	if len(results) != len(tt) {
+		t.Fatalf("exp %d results, got: %d", len(tt), len(results))
+	}
+
+	for i, tc := range tt {
+		if !errors.Is(results[i].Err, tc.err) {
+			t.Errorf("%s: exp error: %v, got: %v", tc.name, tc.err, results[i].Err)
+		}
+
+		if results[i].Replayed != tc.replayed {
+			t.Errorf("%s: exp replayed: %t, got: %t", tc.name, tc.replayed, results[i].Replayed)
+		}
+
+		if tc.err == nil && results[i].Transaction.ID == 0 {
+			t.Errorf("%s: exp saved transaction", tc.name)
+		}
+	}
+
+	if results[3].Transaction.ID != results[0].Transaction.ID {
+		t.Errorf("exp replayed transaction %d, got: %d", results[0].Transaction.ID, results[3].Transaction.ID)
+	}
+
+	// The whole batch is replayed by a repeated request.
+	replayed, err := wapi.CreateTransactions(ctx, wallet.ID, items[2:3])
+	assertNoError(t, err)
+
+	if !replayed[0].Replayed || replayed[0].Transaction.ID != results[2].Transaction.ID {
+		t.Errorf("exp replayed transaction %d, got: %+v", results[2].Transaction.ID, replayed[0])
+	}
+
+	balance, err := wapi.GetCurrentBalance(ctx, wallet.ID)
+	assertNoError(t, err)
+
+	if !balance.Equal(btcount.DecimalFromFloat(0.5)) {
+		t.Errorf("exp balance: 0.5, got: %s", balance)
+	}
+
+	stats, err := bttest.GetRepos().History.Load(ctx, wallet.ID, btcount.NewTimeRangeQuery(time.Time{}, time.Now()))
+	assertNoError(t, err)
+
+	if len(stats) != 1 || !stats[0].Amount.Equal(btcount.DecimalFromFloat(0.5)) {
+		t.Errorf("exp repaired stat with amount 0.5, got: %v", stats)
+	}
+
+	err = wapi.DeleteWallet(ctx, wallet.ID)
+	assertNoError(t, err)
+}
+
+func TestCreateTransactionsBackdated(t *testing.T) {
+	ctx := bttest.GetContext()
+	wapi := bttest.GetWalletAPI()
+
+	wallet, err := wapi.CreateWallet(ctx, btcount.Wallet{Name: "backdated import"})
+	assertNoError(t, err)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour * 10)
+	for _, transaction := range []btcount.Transaction{
+		{Amount: btcount.DecimalFromFloat(1.0), Datetime: hour},
+		{Amount: btcount.DecimalFromFloat(4.0), Datetime: hour.Add(time.Hour * 2)},
+	} {
+		_, err = wapi.CreateTransaction(ctx, wallet.ID, transaction)
+		assertNoError(t, err)
+	}
+
+	item := func(amount float64, minutes time.Duration, withdrawal bool) api.BatchItem {
+		return api.BatchItem{
+			Transaction: btcount.Transaction{
+				Amount:   btcount.DecimalFromFloat(amount),
+				Datetime: hour.Add(time.Minute * minutes),
+			},
+			Withdrawal: withdrawal,
+		}
+	}
+
+	var tt = []struct {
+		name string
+		item api.BatchItem
+		err  error
+	}{
+		{name: "over the past balance", item: item(2.0, 60, true), err: btcount.ErrNegativeValue},
+		{name: "backdated deposit", item: item(1.0, 30, false)},
+		{name: "spending the backdated deposit", item: item(2.0, 60, true)},
+		{name: "spent in the batch already", item: item(0.5, 90, true), err: btcount.ErrNegativeValue},
+		{name: "after the deposits", item: item(3.0, 180, true)},
+	}
+
+	items := make([]api.BatchItem, 0, len(tt))
+	for _, tc := range tt {
+		items = append(items, tc.item)
+	}
+
+	results, err := wapi.CreateTransactions(ctx, wallet.ID, items)
+	assertNoError(t, err)
+
+	for i, tc := range tt {
+		if !errors.Is(results[i].Err, tc.err) {
+			t.Errorf("%s: exp error: %v, got: %v", tc.name, tc.err, results[i].Err)
+		}
+	}
+
+	balance, err := wapi.GetCurrentBalance(ctx, wallet.ID)
+	assertNoError(t, err)
+
+	if !balance.Equal(btcount.DecimalFromFloat(1.0)) {
+		t.Errorf("exp balance: 1, got: %s", balance)
+	}
+
+	err = wapi.DeleteWallet(ctx, wallet.ID)
+	assertNoError(t, err)
+}
+
+func TestReconcileStats(t *testing.T) {
+	ctx := bttest.GetContext()
+	wapi := bttest.GetWalletAPI()
+
+	wallet, err := wapi.CreateWallet(ctx, btcount.Wallet{Name: "reconcile"})
+	assertNoError(t, err)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour * 10)
+
+	var ts []btcount.Transaction
+	for i, amount := range []float64{1.0, 2.0, 4.0} {
+		var created btcount.Transaction
+		created, err = wapi.CreateTransaction(ctx, wallet.ID, btcount.Transaction{
+			Amount:   btcount.DecimalFromFloat(amount),
+			Datetime: hour.Add(time.Hour*time.Duration(i*i) + time.Minute*10),
+		})
+		assertNoError(t, err)
+
+		ts = append(ts, created)
+	}
+
+	// The first stat is right, the second one drifted, the third one
+	// should not exist and the last one is missing.
+	stats := btcount.CollectTransactionsIntoStats(ts[:1], btcount.Decimal{})
+	stats = append(stats,
+		btcount.HistoryStat{WalletID: wallet.ID, Datetime: hour.Add(time.Hour * 2), Amount: btcount.DecimalFromFloat(2.9)},
+		btcount.HistoryStat{WalletID: wallet.ID, Datetime: hour.Add(time.Hour * 3), Amount: btcount.DecimalFromFloat(3.0)},
+	)
+	err = bttest.GetRepos().History.SaveMany(ctx, stats)
+	assertNoError(t, err)
+
+	report, err := wapi.ReconcileStats(ctx, wallet.ID, api.ReconcileParams{Since: hour})
+	assertNoError(t, err)
+
+	exp := []struct {
+		datetime time.Time
+		stored   bool
+		expected bool
+	}{
+		{datetime: hour.Add(time.Hour * 2), stored: true, expected: true},
+		{datetime: hour.Add(time.Hour * 3), stored: true},
+		{datetime: hour.Add(time.Hour * 5), expected: true},
+	}
+
+	if report.Checked != 4 || len(report.Discrepancies) != len(exp) || report.Rewritten {
+		t.Fatalf("exp 4 checked stats with %d discrepancies, got: %+v", len(exp), report)
+	}
+
+	for i, d := range report.Discrepancies {
+		if !d.Datetime.Equal(exp[i].datetime) || (d.Stored != nil) != exp[i].stored || (d.Expected != nil) != exp[i].expected {
+			t.Errorf("discrepancy %d: exp: %+v, got: %+v", i, exp[i], d)
+		}
+	}
+
+	if !report.Discrepancies[2].Expected.Amount.Equal(btcount.DecimalFromFloat(7.0)) {
+		t.Errorf("exp missing stat amount: 7, got: %s", report.Discrepancies[2].Expected.Amount)
+	}
+
+	report, err = wapi.ReconcileStats(ctx, wallet.ID, api.ReconcileParams{Since: hour, Rewrite: true})
+	assertNoError(t, err)
+
+	if !report.Rewritten {
+		t.Error("exp stats to be rewritten")
+	}
+
+	// The balance before the range is summed from transactions.
+	report, err = wapi.ReconcileStats(ctx, wallet.ID, api.ReconcileParams{Since: hour.Add(time.Hour), Till: time.Now().Add(time.Hour)})
+	assertNoError(t, err)
+
+	if report.Checked != 2 || len(report.Discrepancies) != 0 || report.Rewritten {
+		t.Errorf("exp 2 checked stats without discrepancies, got: %+v", report)
+	}
+
+	_, err = wapi.ReconcileStats(ctx, wallet.ID, api.ReconcileParams{Since: time.Now().Add(time.Hour)})
+	if !errors.Is(err, btcount.ErrInvalidParameter) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrInvalidParameter, err)
+	}
+
+	err = wapi.DeleteWallet(ctx, wallet.ID)
+	assertNoError(t, err)
+}
+
+func TestStreamBalanceHistory(t *testing.T) {
+	ctx := bttest.GetContext()
+	wapi := bttest.GetWalletAPI()
+
+	wallet, err := wapi.CreateWallet(ctx, btcount.Wallet{Name: "stream"})
+	assertNoError(t, err)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour * 10)
+
+	var ts []btcount.Transaction
+	for i, amount := range []float64{1.0, 2.0, 0.5} {
+		var created btcount.Transaction
+		created, err = wapi.CreateTransaction(ctx, wallet.ID, btcount.Transaction{
+			Amount:   btcount.DecimalFromFloat(amount),
+			Datetime: hour.Add(time.Hour*time.Duration(i*i) + time.Minute*10),
+		})
+		assertNoError(t, err)
+
+		ts = append(ts, created)
+	}
+
+	// Only the first hour is saved, so the rest is collected from
+	// transactions.
+	err = bttest.GetRepos().History.SaveMany(ctx, btcount.CollectTransactionsIntoStats(ts[:1], btcount.Decimal{}))
+	assertNoError(t, err)
+
+	params := api.HistoryParams{Since: hour, Till: time.Now().Add(time.Hour)}
+
+	// Sub-hourly buckets are collected from transactions one by one.
+	for _, g := range []btcount.Granularity{btcount.GranularityHour, btcount.GranularityDay, btcount.GranularityMinute} {
+		params.Granularity = g
+
+		var got []btcount.HistoryStat
+		err = wapi.StreamBalanceHistory(ctx, wallet.ID, params, func(stat btcount.HistoryStat) error {
+			got = append(got, stat)
+
+			return nil
+		})
+		assertNoError(t, err)
+
+		exp := btcount.CollectTransactionsIntoBuckets(ts, btcount.Decimal{}, g)
+		if len(got) != len(exp) {
+			t.Fatalf("%s: exp %d stats, got: %+v", g, len(exp), got)
+		}
+
+		for i := range exp {
+			if !got[i].Datetime.Equal(exp[i].Datetime) || !got[i].Amount.Equal(exp[i].Amount) || got[i].Count != exp[i].Count {
+				t.Errorf("%s: stat %d: exp: %+v, got: %+v", g, i, exp[i], got[i])
+			}
+		}
+	}
+
+	errStop := errors.New("stop")
+
+	for _, g := range []btcount.Granularity{btcount.GranularityHour, btcount.GranularityMinute} {
+		var calls int
+		params.Granularity = g
+		params.Fill = api.FillNone
+		err = wapi.StreamBalanceHistory(ctx, wallet.ID, params, func(stat btcount.HistoryStat) error {
+			calls++
+
+			return errStop
+		})
+		if !errors.Is(err, errStop) || calls != 1 {
+			t.Errorf("%s: exp error: %v after 1 call, got: %v after %d calls", g, errStop, err, calls)
+		}
+	}
+
+	err = wapi.DeleteWallet(ctx, wallet.ID)
+	assertNoError(t, err)
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,27 +1,100 @@
 package btcount
 
 import (
+	"database/sql/driver"
+	"fmt"
 	"sort"
 	"time"
 
 	"github.com/shopspring/decimal"
 )
 
+// DefaultWalletID is the identifier of the wallet created by migrations.
+// Requests which do not specify the wallet are served by it.
+const DefaultWalletID int64 = 1
+
+// Wallet is a named container of transactions.
+type Wallet struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
 // Transaction is a single transaction that stores the amount of coins
 // that has been sent and the time of it.
 type Transaction struct {
+	ID       int64     `json:"id"`
+	WalletID int64     `json:"walletId"`
 	Amount   Decimal   `json:"amount"`
 	Datetime time.Time `json:"datetime"`
+	// IdempotencyKey is an optional key provided by the client. Only one
+	// transaction with the same key is stored per wallet.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// CreatedAt is the time the transaction was saved at.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SamePayload reports whether the other transaction has the same amount
+// and datetime.
+func (t Transaction) SamePayload(other Transaction) bool {
+	return t.Amount.Equal(other.Amount) && t.Datetime.Equal(other.Datetime)
 }
 
-// Decimal is a wrapper around shopsptring/decimal value.
+// DefaultAmountScale is the amount of digits after the decimal point
+// stored for amounts (satoshi precision).
+const DefaultAmountScale int32 = 8
+
+// MaxAmountScale is the maximum amount of digits after the decimal point
+// the storage is able to keep without rounding.
+const MaxAmountScale int32 = 8
+
+// Decimal is a wrapper around shopsptring/decimal value. It is decoded
+// from JSON strings and numbers without float conversion.
 type Decimal struct{ decimal.Decimal }
 
+// DecimalFromString parses decimal from its string representation.
+func DecimalFromString(v string) (d Decimal, err error) {
+	d.Decimal, err = decimal.NewFromString(v)
+	if err != nil {
+		return d, fmt.Errorf("%w: %s", ErrInvalidParameter, err)
+	}
+
+	return d, nil
+}
+
+// Scan implements sql.Scanner interface. Values are parsed from their
+// text representation so NUMERIC columns are read without loss.
+func (d *Decimal) Scan(value interface{}) (err error) {
+	return d.Decimal.Scan(value)
+}
+
+// Value implements driver.Valuer interface. The value is sent as text
+// so it is stored to NUMERIC columns without loss.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.Decimal.String(), nil
+}
+
+// FitsScale checks whether the value has no more than scale digits after
+// the decimal point.
+func (d Decimal) FitsScale(scale int32) bool {
+	return d.Decimal.Equal(d.Decimal.Round(scale))
+}
+
 // Add adds another decimal and returns new value.
 func (d Decimal) Add(other Decimal) Decimal {
 	return Decimal{d.Decimal.Add(other.Decimal)}
 }
 
+// Sub subtracts another decimal and returns new value.
+func (d Decimal) Sub(other Decimal) Decimal {
+	return Decimal{d.Decimal.Sub(other.Decimal)}
+}
+
+// Neg returns the negated value.
+func (d Decimal) Neg() Decimal {
+	return Decimal{d.Decimal.Neg()}
+}
+
 // Equal checks whether two decimals equals or not.
 func (d Decimal) Equal(other Decimal) (equal bool) {
 	return d.Decimal.Equal(other.Decimal)
@@ -40,57 +113,138 @@ func DecimalFromFloat(v float64) Decimal {
 // CollectTransactionsIntoStats iterates over each transaction and
 // makes history stat partitioned by each hour.
 func CollectTransactionsIntoStats(origin []Transaction, initialSum Decimal) (stats []HistoryStat) {
-	if len(origin) == 0 {
-		return []HistoryStat{}
-	}
-
-	if len(origin) == 1 {
-		return []HistoryStat{{
-			Datetime: origin[0].Datetime.Truncate(time.Hour).Add(time.Hour),
-			Amount:   origin[0].Amount.Add(initialSum),
-		}}
-	}
+	return CollectTransactionsIntoBuckets(origin, initialSum, GranularityHour)
+}
 
+// CollectTransactionsIntoBuckets iterates over each transaction and
+// makes history stat partitioned by buckets of the granularity. Datetime
+// of each stat is the end of its bucket.
+func CollectTransactionsIntoBuckets(origin []Transaction, initialSum Decimal, g Granularity) (stats []HistoryStat) {
 	// Do not sort origin slice to avoid changing the origin data.
 	ts := make([]Transaction, len(origin))
 	copy(ts, origin)
 
-	sort.Slice(ts, func(i, j int) bool {
+	sort.SliceStable(ts, func(i, j int) bool {
 		return ts[i].Datetime.Before(ts[j].Datetime)
 	})
 
-	endHour := ts[0].Datetime.Truncate(time.Hour).Add(time.Hour)
-	sum := ts[0].Amount.Add(initialSum)
+	stats = make([]HistoryStat, 0)
+	collector := NewStatCollector(g, initialSum, func(stat HistoryStat) error {
+		stats = append(stats, stat)
 
-	var addLast bool
-	for i := 1; i < len(ts); i++ {
-		current := ts[i]
-		if current.Datetime.Before(endHour) {
-			sum = sum.Add(current.Amount)
-			addLast = true
+		return nil
+	})
 
-			continue
-		}
+	for _, t := range ts {
+		_ = collector.Push(t)
+	}
 
-		stat := HistoryStat{
-			Datetime: endHour,
-			Amount:   sum,
-		}
-		stats = append(stats, stat)
+	_ = collector.Flush()
 
-		sum = sum.Add(current.Amount)
-		endHour = current.Datetime.Truncate(time.Hour).Add(time.Hour)
-		addLast = false
+	return stats
+}
+
+// StatCollector collects sorted transactions pushed one by one into
+// stats the same way as CollectTransactionsIntoBuckets does and passes
+// every complete bucket to the callback, so transactions are collected
+// without keeping them all in memory.
+type StatCollector struct {
+	g    Granularity
+	next func(HistoryStat) error
+
+	stat HistoryStat
+	ok   bool
+}
+
+// NewStatCollector creates a collector passing stats to next. The first
+// stat opens with the initial sum.
+func NewStatCollector(g Granularity, initialSum Decimal, next func(HistoryStat) error) *StatCollector {
+	return &StatCollector{
+		g:    g,
+		next: next,
+		stat: HistoryStat{Amount: initialSum},
 	}
+}
 
-	if addLast {
-		stat := HistoryStat{
-			Datetime: endHour,
-			Amount:   sum,
+// Push adds the transaction to the stat of its bucket. The stat is
+// passed to the callback once the transaction of the next bucket is
+// pushed. Buckets are calculated in the location of the datetime. Errors
+// of the callback are returned as is.
+func (c *StatCollector) Push(t Transaction) (err error) {
+	if c.ok && !t.Datetime.Before(c.stat.Datetime) {
+		err = c.next(c.stat)
+		if err != nil {
+			return err
 		}
 
-		stats = append(stats, stat)
+		c.ok = false
 	}
 
-	return stats
+	if !c.ok {
+		c.stat = newHistoryStat(t.WalletID, c.g.Next(c.g.Truncate(t.Datetime)), c.stat.Amount)
+		c.ok = true
+	}
+
+	c.stat.apply(t)
+
+	return nil
+}
+
+// Flush passes the last stat to the callback.
+func (c *StatCollector) Flush() (err error) {
+	if !c.ok {
+		return nil
+	}
+
+	c.ok = false
+
+	return c.next(c.stat)
+}
+
+// newHistoryStat creates a stat of the bucket without transactions.
+func newHistoryStat(walletID int64, end time.Time, amount Decimal) HistoryStat {
+	return HistoryStat{
+		WalletID: walletID,
+		Datetime: end,
+		Amount:   amount,
+		Open:     amount,
+		High:     amount,
+		Low:      amount,
+	}
+}
+
+// apply adds the transaction to the stat.
+func (stat *HistoryStat) apply(t Transaction) {
+	stat.Amount = stat.Amount.Add(t.Amount)
+	stat.Count++
+
+	if t.Amount.IsNegative() {
+		stat.Outflow = stat.Outflow.Sub(t.Amount)
+	} else {
+		stat.Inflow = stat.Inflow.Add(t.Amount)
+	}
+
+	if stat.Amount.LessThan(stat.Low) {
+		stat.Low = stat.Amount
+	}
+
+	if stat.High.LessThan(stat.Amount) {
+		stat.High = stat.Amount
+	}
+}
+
+// merge adds the stat of the following bucket to the stat.
+func (stat *HistoryStat) merge(next HistoryStat) {
+	stat.Amount = next.Amount
+	stat.Inflow = stat.Inflow.Add(next.Inflow)
+	stat.Outflow = stat.Outflow.Add(next.Outflow)
+	stat.Count += next.Count
+
+	if next.Low.LessThan(stat.Low) {
+		stat.Low = next.Low
+	}
+
+	if stat.High.LessThan(next.High) {
+		stat.High = next.High
+	}
 }
@@ -1,6 +1,7 @@
 package btcount
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 )
@@ -61,6 +62,38 @@ func TestCollectTransactionsIntoStats(t *testing.T) {
 			Datetime: now.Truncate(time.Hour).Add(time.Hour * 3),
 			Amount:   DecimalFromFloat(17.0),
 		}},
+	}, {
+		name:       "single transaction in last hour",
+		initialSum: DecimalFromFloat(1.0),
+		in: []Transaction{
+			{Amount: DecimalFromFloat(1.0), Datetime: now},
+			{Amount: DecimalFromFloat(2.0), Datetime: now.Add(time.Hour)},
+		},
+		exp: []HistoryStat{{
+			Datetime: now.Truncate(time.Hour).Add(time.Hour),
+			Amount:   DecimalFromFloat(2.0),
+		}, {
+			Datetime: now.Truncate(time.Hour).Add(time.Hour * 2),
+			Amount:   DecimalFromFloat(4.0),
+		}},
+	}, {
+		name:       "withdrawals in hours",
+		initialSum: DecimalFromFloat(5.0),
+		in: []Transaction{
+			// Current hour. (-1.5) [3.5]
+			{Amount: DecimalFromFloat(1.0), Datetime: now},
+			{Amount: DecimalFromFloat(-2.5), Datetime: now.Add(time.Minute * 2)},
+			// Next hour. (-3.5) [0.0]
+			{Amount: DecimalFromFloat(-3.0), Datetime: now.Add(time.Hour)},
+			{Amount: DecimalFromFloat(-0.5), Datetime: now.Add(time.Hour + time.Minute)},
+		},
+		exp: []HistoryStat{{
+			Datetime: now.Truncate(time.Hour).Add(time.Hour),
+			Amount:   DecimalFromFloat(3.5),
+		}, {
+			Datetime: now.Truncate(time.Hour).Add(time.Hour * 2),
+			Amount:   DecimalFromFloat(0.0),
+		}},
 	}}
 
 	for _, tc := range tt {
@@ -85,3 +118,92 @@ func TestCollectTransactionsIntoStats(t *testing.T) {
 		})
 	}
 }
+
+func TestDecimalIsExact(t *testing.T) {
+	var ts []Transaction
+	err := json.Unmarshal([]byte(`[{"amount": 0.1}, {"amount": "0.2"}]`), &ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := DecimalFromString("0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ts[0].Amount.Add(ts[1].Amount)
+	if !got.Equal(exp) {
+		t.Errorf("exp: %s, got: %s", exp, got)
+	}
+
+	stats := CollectTransactionsIntoStats(ts, DecimalFromFloat(0))
+	if len(stats) != 1 || !stats[0].Amount.Equal(exp) {
+		t.Errorf("exp: %s, got: %v", exp, stats)
+	}
+}
+
+func TestDecimalScanValue(t *testing.T) {
+	const raw = "12345678901234567890.12345678"
+
+	var d Decimal
+	err := d.Scan(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := d.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != raw {
+		t.Errorf("exp: %s, got: %v", raw, value)
+	}
+}
+
+func TestDecimalFitsScale(t *testing.T) {
+	var tt = []struct {
+		value string
+		scale int32
+		exp   bool
+	}{
+		{value: "1", scale: 0, exp: true},
+		{value: "0.1", scale: 0, exp: false},
+		{value: "0.00000001", scale: 8, exp: true},
+		{value: "0.000000001", scale: 8, exp: false},
+		{value: "0.100000000", scale: 8, exp: true},
+	}
+
+	for _, tc := range tt {
+		d, err := DecimalFromString(tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := d.FitsScale(tc.scale); got != tc.exp {
+			t.Errorf("%s with scale %d: exp: %t, got: %t", tc.value, tc.scale, tc.exp, got)
+		}
+	}
+}
+
+func TestTransactionSamePayload(t *testing.T) {
+	now := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	saved := Transaction{Amount: DecimalFromFloat(0.1), Datetime: now, IdempotencyKey: "key"}
+
+	var tt = []struct {
+		name string
+		in   Transaction
+		exp  bool
+	}{
+		{name: "same", in: Transaction{Amount: DecimalFromFloat(0.10), Datetime: now.In(time.FixedZone("", 3600))}, exp: true},
+		{name: "another amount", in: Transaction{Amount: DecimalFromFloat(0.2), Datetime: now}},
+		{name: "withdrawal", in: Transaction{Amount: DecimalFromFloat(-0.1), Datetime: now}},
+		{name: "another datetime", in: Transaction{Amount: DecimalFromFloat(0.1), Datetime: now.Add(time.Second)}},
+	}
+
+	for _, tc := range tt {
+		if got := saved.SamePayload(tc.in); got != tc.exp {
+			t.Errorf("%s: exp: %t, got: %t", tc.name, tc.exp, got)
+		}
+	}
+}
@@ -11,16 +11,38 @@ import (
 	"time"
 )
 
+// Storage kinds.
+const (
+	// StoragePostgres keeps the data in the postgres database.
+	StoragePostgres = "postgres"
+	// StorageMemory keeps the data in memory, so it is lost on restart.
+	StorageMemory = "memory"
+	// StorageFile keeps the data in memory and persists it to a file.
+	StorageFile = "file"
+)
+
 // Config is an app-wide configuration.
 type Config struct {
 	HTTPAddr             string
 	HTTPTimeout          time.Duration
+	AdminToken           string
+	Storage              string
 	DBAddr               string
+	DBMigrate            bool
+	FilePath             string
+	FileSync             string
+	FileSyncInterval     time.Duration
 	LogLevel             string
 	LogFormat            string
 	StatWorkerRetryDelay time.Duration
 	DBMinConn            int32
 	DBMaxConn            int32
+	AmountScale          int32
+	HistoryMaxPoints     int
+	FuturePolicy         FuturePolicy
+	EventsHeartbeat      time.Duration
+	EventsBuffer         int
+	EventsHistory        int
 }
 
 func tryLoadDotenv() (err error) {
@@ -68,25 +90,50 @@ func tryLoadDotenv() (err error) {
 // ParseConfigFromEnv parses config from environment variables.
 func ParseConfigFromEnv() (cfg Config, err error) {
 	const (
-		defaultHTTPAddr               = ":8080"
-		defaultTimeout                = time.Second * 15
-		defaultLogLevel               = "info"
-		defaultLogFormat              = "json"
-		defaultWorkerRetryDelay       = time.Second * 5
-		defaultDBMinConn        int32 = 1
-		defaultDBMaxConn        int32 = 5
+		defaultHTTPAddr                = ":8080"
+		defaultStorage                 = StoragePostgres
+		defaultFilePath                = "btcount.log"
+		defaultFileSync                = "always"
+		defaultFileSyncInterval        = time.Second
+		defaultTimeout                 = time.Second * 15
+		defaultLogLevel                = "info"
+		defaultLogFormat               = "json"
+		defaultWorkerRetryDelay        = time.Second * 5
+		defaultDBMinConn         int32 = 1
+		defaultDBMaxConn         int32 = 5
+		defaultAmountScale             = DefaultAmountScale
+		defaultHistoryMaxPoints        = 10000
+		defaultFutureMode              = FutureReject
+		defaultFutureMaxSkew           = time.Minute
+		defaultFutureMaxSchedule       = time.Hour * 24 * 365
+		defaultEventsBuffer            = 64
+		defaultEventsHistory           = 1024
 	)
 
 	const (
 		prefix              = "BTCOUNT_"
 		httpAddrKey         = prefix + "HTTP_ADDR"
 		httpTimeoutKey      = prefix + "HTTP_TIMEOUT"
+		adminTokenKey       = prefix + "ADMIN_TOKEN"
+		storageKey          = prefix + "STORAGE"
 		dbAddrKey           = prefix + "DB_ADDR"
+		dbMigrateKey        = prefix + "DB_MIGRATE"
+		filePathKey         = prefix + "FILE_PATH"
+		fileSyncKey         = prefix + "FILE_SYNC"
+		fileSyncIntervalKey = prefix + "FILE_SYNC_INTERVAL"
 		logLevelKey         = prefix + "LOG_LEVEL"
 		logFormatKey        = prefix + "LOG_FORMAT"
 		workerRetryDelayKey = prefix + "STAT_WORKER_RETRY_DELAY"
 		dbMinConnKey        = prefix + "DB_MIN_CONN"
 		dbMaxConnKey        = prefix + "DB_MAX_CONN"
+		amountScaleKey      = prefix + "AMOUNT_SCALE"
+		historyMaxPointsKey = prefix + "HISTORY_MAX_POINTS"
+		futurePolicyKey     = prefix + "FUTURE_POLICY"
+		futureMaxSkewKey    = prefix + "FUTURE_MAX_SKEW"
+		futureMaxSchedKey   = prefix + "FUTURE_MAX_SCHEDULE"
+		eventsHeartbeatKey  = prefix + "EVENTS_HEARTBEAT"
+		eventsBufferKey     = prefix + "EVENTS_BUFFER"
+		eventsHistoryKey    = prefix + "EVENTS_HISTORY"
 	)
 
 	err = tryLoadDotenv()
@@ -97,16 +144,65 @@ func ParseConfigFromEnv() (cfg Config, err error) {
 	cfg = Config{
 		HTTPAddr:             defaultHTTPAddr,
 		HTTPTimeout:          defaultTimeout,
+		Storage:              defaultStorage,
+		FilePath:             defaultFilePath,
+		FileSync:             defaultFileSync,
+		FileSyncInterval:     defaultFileSyncInterval,
 		LogLevel:             defaultLogLevel,
 		LogFormat:            defaultLogFormat,
 		StatWorkerRetryDelay: defaultWorkerRetryDelay,
 		DBMinConn:            defaultDBMinConn,
 		DBMaxConn:            defaultDBMaxConn,
+		AmountScale:          defaultAmountScale,
+		HistoryMaxPoints:     defaultHistoryMaxPoints,
+		FuturePolicy: FuturePolicy{
+			Mode:        defaultFutureMode,
+			MaxSkew:     defaultFutureMaxSkew,
+			MaxSchedule: defaultFutureMaxSchedule,
+		},
+		EventsBuffer:  defaultEventsBuffer,
+		EventsHistory: defaultEventsHistory,
+	}
+
+	if storage, ok := os.LookupEnv(storageKey); ok {
+		cfg.Storage = strings.ToLower(storage)
+	}
+
+	switch cfg.Storage {
+	case StoragePostgres:
+		var ok bool
+		if cfg.DBAddr, ok = os.LookupEnv(dbAddrKey); !ok {
+			return cfg, fmt.Errorf("%w: %s", ErrParamNotFound, dbAddrKey)
+		}
+	case StorageMemory, StorageFile:
+	default:
+		return cfg, fmt.Errorf("%w: %s should be one of %s, %s, %s", ErrInvalidParameter, storageKey, StoragePostgres, StorageMemory, StorageFile)
+	}
+
+	if migrate, ok := os.LookupEnv(dbMigrateKey); ok {
+		cfg.DBMigrate, err = strconv.ParseBool(migrate)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing db migrate: %w", err)
+		}
+	}
+
+	if path, ok := os.LookupEnv(filePathKey); ok {
+		cfg.FilePath = path
 	}
 
-	var ok bool
-	if cfg.DBAddr, ok = os.LookupEnv(dbAddrKey); !ok {
-		return cfg, fmt.Errorf("%w: %s", ErrParamNotFound, dbAddrKey)
+	if sync, ok := os.LookupEnv(fileSyncKey); ok {
+		cfg.FileSync = sync
+	}
+
+	if interval, ok := os.LookupEnv(fileSyncIntervalKey); ok {
+		cfg.FileSyncInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing file sync interval: %w", err)
+		}
+
+		if cfg.FileSyncInterval <= 0 {
+			return cfg, fmt.Errorf("%w: %s should be positive", ErrInvalidParameter, fileSyncIntervalKey)
+		}
 	}
 
 	if httpTimeout, ok := os.LookupEnv(httpTimeoutKey); ok {
@@ -143,6 +239,87 @@ func ParseConfigFromEnv() (cfg Config, err error) {
 		}
 	}
 
+	if scale, ok := os.LookupEnv(amountScaleKey); ok {
+		var scaleValue int
+		scaleValue, err = strconv.Atoi(scale)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing amount scale: %w", err)
+		}
+
+		if scaleValue < 0 || scaleValue > int(MaxAmountScale) {
+			return cfg, fmt.Errorf("%w: %s should be in range [0, %d]", ErrInvalidParameter, amountScaleKey, MaxAmountScale)
+		}
+
+		cfg.AmountScale = int32(scaleValue)
+	}
+
+	if maxPoints, ok := os.LookupEnv(historyMaxPointsKey); ok {
+		cfg.HistoryMaxPoints, err = strconv.Atoi(maxPoints)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing history max points: %w", err)
+		}
+
+		if cfg.HistoryMaxPoints < 1 {
+			return cfg, fmt.Errorf("%w: %s should be positive", ErrInvalidParameter, historyMaxPointsKey)
+		}
+	}
+
+	if mode, ok := os.LookupEnv(futurePolicyKey); ok {
+		cfg.FuturePolicy.Mode, err = ParseFutureMode(mode)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing future policy: %w", err)
+		}
+	}
+
+	if skew, ok := os.LookupEnv(futureMaxSkewKey); ok {
+		cfg.FuturePolicy.MaxSkew, err = time.ParseDuration(skew)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing future max skew: %w", err)
+		}
+	}
+
+	if schedule, ok := os.LookupEnv(futureMaxSchedKey); ok {
+		cfg.FuturePolicy.MaxSchedule, err = time.ParseDuration(schedule)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing future max schedule: %w", err)
+		}
+	}
+
+	if heartbeat, ok := os.LookupEnv(eventsHeartbeatKey); ok {
+		cfg.EventsHeartbeat, err = time.ParseDuration(heartbeat)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing events heartbeat: %w", err)
+		}
+	}
+
+	if buffer, ok := os.LookupEnv(eventsBufferKey); ok {
+		cfg.EventsBuffer, err = strconv.Atoi(buffer)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing events buffer: %w", err)
+		}
+
+		// Subscribers without buffer would be dropped by the first event
+		// published while they are busy.
+		if cfg.EventsBuffer < 1 {
+			return cfg, fmt.Errorf("%w: %s should be positive", ErrInvalidParameter, eventsBufferKey)
+		}
+	}
+
+	if history, ok := os.LookupEnv(eventsHistoryKey); ok {
+		cfg.EventsHistory, err = strconv.Atoi(history)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing events history: %w", err)
+		}
+
+		if cfg.EventsHistory < 0 {
+			return cfg, fmt.Errorf("%w: %s should not be negative", ErrInvalidParameter, eventsHistoryKey)
+		}
+	}
+
+	if token, ok := os.LookupEnv(adminTokenKey); ok {
+		cfg.AdminToken = token
+	}
+
 	if httpAddr, ok := os.LookupEnv(httpAddrKey); ok {
 		cfg.HTTPAddr = httpAddr
 	}
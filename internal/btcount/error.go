@@ -14,4 +14,22 @@ const (
 	ErrInvalidParameter Error = "invalid parameter"
 	ErrNotFound         Error = "not found"
 	ErrUnexpectedType   Error = "unexpected type"
+	// ErrAlreadyExists is returned by storages when the unique entity is
+	// already saved.
+	ErrAlreadyExists Error = "already exists"
+	// ErrConflict is returned when the request conflicts with the
+	// previously saved state, e.g. the idempotency key is reused with
+	// another payload.
+	ErrConflict Error = "conflict"
+	// ErrMigrationModified is returned when the applied migration differs
+	// from the known one.
+	ErrMigrationModified Error = "migration modified after applied"
+	// ErrSchemaNewer is returned when the database has migrations applied
+	// which are not known.
+	ErrSchemaNewer Error = "schema is newer than known migrations"
+	// ErrIrreversible is returned when the migration can not be reverted.
+	ErrIrreversible Error = "migration is irreversible"
+	// ErrUnauthorized is returned when the request lacks valid
+	// credentials.
+	ErrUnauthorized Error = "unauthorized"
 )
@@ -0,0 +1,65 @@
+package btcount
+
+import "context"
+
+// ChangeFeed delivers changes committed by every instance of the service
+// sharing the store.
+type ChangeFeed interface {
+	// Follow delivers changes to h until ctx is done. Changes made while
+	// the feed is disconnected are not delivered, so h.Resync is called
+	// on every connection before any change.
+	Follow(ctx context.Context, h ChangeHandler) (err error)
+}
+
+// ChangeHandler handles changes delivered by ChangeFeed. Changes made by
+// the instance itself are delivered as well.
+type ChangeHandler interface {
+	// Resync reloads the state from the store.
+	Resync(ctx context.Context) (err error)
+	// TransactionsSaved is called after transactions are committed.
+	// Transactions delivered together, e.g. saved by a single batch, are
+	// passed at once in the order they are saved.
+	TransactionsSaved(ctx context.Context, ts []Transaction) (err error)
+	// WalletDeleted is called after the wallet is deleted.
+	WalletDeleted(ctx context.Context, walletID int64) (err error)
+}
+
+// ChangeHandlers passes changes to every handler in order. It implements
+// ChangeHandler interface.
+type ChangeHandlers []ChangeHandler
+
+// Resync implements ChangeHandler interface. Every handler is resynced
+// and the first error is returned.
+func (hs ChangeHandlers) Resync(ctx context.Context) (err error) {
+	for _, h := range hs {
+		if errh := h.Resync(ctx); errh != nil && err == nil {
+			err = errh
+		}
+	}
+
+	return err
+}
+
+// TransactionsSaved implements ChangeHandler interface. Transactions are
+// passed to every handler and the first error is returned.
+func (hs ChangeHandlers) TransactionsSaved(ctx context.Context, ts []Transaction) (err error) {
+	for _, h := range hs {
+		if errh := h.TransactionsSaved(ctx, ts); errh != nil && err == nil {
+			err = errh
+		}
+	}
+
+	return err
+}
+
+// WalletDeleted implements ChangeHandler interface. The wallet is passed
+// to every handler and the first error is returned.
+func (hs ChangeHandlers) WalletDeleted(ctx context.Context, walletID int64) (err error) {
+	for _, h := range hs {
+		if errh := h.WalletDeleted(ctx, walletID); errh != nil && err == nil {
+			err = errh
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,64 @@
+package btcount
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FutureMode defines how transactions dated in the future are handled.
+type FutureMode string
+
+const (
+	// FutureReject rejects future transactions.
+	FutureReject FutureMode = "reject"
+	// FutureClamp saves future transactions with the current datetime.
+	FutureClamp FutureMode = "clamp"
+	// FutureSchedule saves future transactions as is. They are pending and
+	// do not count toward the balance until their datetime arrives.
+	FutureSchedule FutureMode = "schedule"
+)
+
+// ParseFutureMode parses the mode from its name.
+func ParseFutureMode(v string) (mode FutureMode, err error) {
+	mode = FutureMode(strings.ToLower(v))
+	switch mode {
+	case FutureReject, FutureClamp, FutureSchedule:
+		return mode, nil
+	}
+
+	return mode, fmt.Errorf("%w: future mode %q", ErrInvalidParameter, v)
+}
+
+// FuturePolicy defines how transactions dated in the future are handled.
+type FuturePolicy struct {
+	Mode FutureMode
+	// MaxSkew is the tolerated difference between clocks of the client
+	// and the server. Transactions dated up to MaxSkew ahead are not
+	// considered as future ones.
+	MaxSkew time.Duration
+	// MaxSchedule limits how far ahead transactions may be scheduled.
+	// It is not limited if zero.
+	MaxSchedule time.Duration
+}
+
+// Apply returns the datetime the transaction dated by datetime should be
+// saved with at now.
+func (p FuturePolicy) Apply(datetime, now time.Time) (applied time.Time, err error) {
+	if !datetime.After(now.Add(p.MaxSkew)) {
+		return datetime, nil
+	}
+
+	switch p.Mode {
+	case FutureClamp:
+		return now, nil
+	case FutureSchedule:
+		if p.MaxSchedule > 0 && datetime.After(now.Add(p.MaxSchedule)) {
+			return datetime, fmt.Errorf("%w: datetime is more than %s ahead", ErrInvalidParameter, p.MaxSchedule)
+		}
+
+		return datetime, nil
+	}
+
+	return datetime, fmt.Errorf("%w: datetime is in the future", ErrInvalidParameter)
+}
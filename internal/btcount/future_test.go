@@ -0,0 +1,53 @@
+package btcount
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFuturePolicy(t *testing.T) {
+	now := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	soon := now.Add(time.Second * 30)
+	later := now.Add(time.Hour)
+	farAway := now.AddDate(1, 0, 0)
+
+	var tt = []struct {
+		name   string
+		mode   FutureMode
+		in     time.Time
+		exp    time.Time
+		experr error
+	}{
+		{name: "reject past", mode: FutureReject, in: now.Add(-time.Hour), exp: now.Add(-time.Hour)},
+		{name: "reject within skew", mode: FutureReject, in: soon, exp: soon},
+		{name: "reject future", mode: FutureReject, in: later, experr: ErrInvalidParameter},
+		{name: "clamp within skew", mode: FutureClamp, in: soon, exp: soon},
+		{name: "clamp future", mode: FutureClamp, in: later, exp: now},
+		{name: "schedule future", mode: FutureSchedule, in: later, exp: later},
+		{name: "schedule too far", mode: FutureSchedule, in: farAway, experr: ErrInvalidParameter},
+	}
+
+	for _, tc := range tt {
+		policy := FuturePolicy{
+			Mode:        tc.mode,
+			MaxSkew:     time.Minute,
+			MaxSchedule: time.Hour * 24 * 30,
+		}
+
+		got, err := policy.Apply(tc.in, now)
+		if !errors.Is(err, tc.experr) {
+			t.Errorf("%s: exp error: %v, got: %v", tc.name, tc.experr, err)
+
+			continue
+		}
+
+		if tc.experr == nil && !got.Equal(tc.exp) {
+			t.Errorf("%s: exp: %v, got: %v", tc.name, tc.exp, got)
+		}
+	}
+
+	if _, err := ParseFutureMode("later"); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("exp error: %v, got: %v", ErrInvalidParameter, err)
+	}
+}
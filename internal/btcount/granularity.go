@@ -0,0 +1,338 @@
+package btcount
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type calendarUnit uint8
+
+const (
+	calendarNone calendarUnit = iota
+	calendarDay
+	calendarWeek
+	calendarMonth
+)
+
+// Granularity defines the size of the buckets history stats are
+// partitioned by. Buckets are either fixed intervals or calendar days,
+// weeks (starting on Monday) and months. Bucket boundaries follow the
+// local time of the location of the datetime.
+type Granularity struct {
+	interval time.Duration
+	unit     calendarUnit
+}
+
+// Predefined granularities.
+var (
+	GranularityMinute = Granularity{interval: time.Minute}
+	GranularityHour   = Granularity{interval: time.Hour}
+	GranularityDay    = Granularity{unit: calendarDay}
+	GranularityWeek   = Granularity{unit: calendarWeek}
+	GranularityMonth  = Granularity{unit: calendarMonth}
+)
+
+// ParseGranularity parses granularity from one of the names (`minute`,
+// `hour`, `day`, `week`, `month`) or from the duration (`5m`, `4h`). The
+// duration should be a whole number of minutes dividing a day evenly.
+func ParseGranularity(v string) (g Granularity, err error) {
+	switch strings.ToLower(v) {
+	case "minute":
+		return GranularityMinute, nil
+	case "hour":
+		return GranularityHour, nil
+	case "day":
+		return GranularityDay, nil
+	case "week":
+		return GranularityWeek, nil
+	case "month":
+		return GranularityMonth, nil
+	}
+
+	var interval time.Duration
+	interval, err = time.ParseDuration(v)
+	if err != nil {
+		return g, fmt.Errorf("%w: granularity %q", ErrInvalidParameter, v)
+	}
+
+	const day = time.Hour * 24
+	if interval < time.Minute || interval%time.Minute != 0 || day%interval != 0 {
+		return g, fmt.Errorf("%w: granularity %q should be a whole number of minutes dividing a day", ErrInvalidParameter, v)
+	}
+
+	return Granularity{interval: interval}, nil
+}
+
+// String implements fmt.Stringer interface.
+func (g Granularity) String() string {
+	switch g.unit {
+	case calendarDay:
+		return "day"
+	case calendarWeek:
+		return "week"
+	case calendarMonth:
+		return "month"
+	}
+
+	return g.interval.String()
+}
+
+// IsZero reports whether the granularity is not set.
+func (g Granularity) IsZero() bool {
+	return g == Granularity{}
+}
+
+// IsHourly reports whether each bucket consists of whole hours, so it can
+// be rolled up from hourly stats.
+func (g Granularity) IsHourly() bool {
+	return g.unit != calendarNone || g.interval%time.Hour == 0
+}
+
+// Truncate returns the start of the bucket t belongs to. Buckets are
+// calculated in the location of t.
+func (g Granularity) Truncate(t time.Time) time.Time {
+	year, month, day := t.Date()
+
+	switch g.unit {
+	case calendarDay:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	case calendarWeek:
+		sinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-sinceMonday, 0, 0, 0, 0, t.Location())
+	case calendarMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	}
+
+	if g.interval <= time.Hour {
+		// Shift by the zone offset so buckets are aligned to the local
+		// time even for zones with offsets like +05:30 or +05:45.
+		_, offset := t.Zone()
+		shift := time.Duration(offset) * time.Second
+
+		return t.Add(shift).Truncate(g.interval).Add(-shift)
+	}
+
+	// Longer intervals are aligned to the local midnight, so buckets
+	// start at the same local time every day regardless of DST.
+	interval := int(g.interval / time.Minute)
+	elapsed := t.Hour()*60 + t.Minute()
+
+	return time.Date(year, month, day, 0, elapsed-elapsed%interval, 0, 0, t.Location())
+}
+
+// Next returns the start of the bucket following the bucket started at
+// start.
+func (g Granularity) Next(start time.Time) time.Time {
+	switch g.unit {
+	case calendarDay:
+		return start.AddDate(0, 0, 1)
+	case calendarWeek:
+		return start.AddDate(0, 0, 7)
+	case calendarMonth:
+		return start.AddDate(0, 1, 0)
+	}
+
+	if g.interval <= time.Hour {
+		return start.Add(g.interval)
+	}
+
+	year, month, day := start.Date()
+	elapsed := start.Hour()*60 + start.Minute()
+
+	return time.Date(year, month, day, 0, elapsed+int(g.interval/time.Minute), 0, 0, start.Location())
+}
+
+// Ceil returns t if it is the start of a bucket and the start of the
+// next bucket otherwise.
+func (g Granularity) Ceil(t time.Time) time.Time {
+	start := g.Truncate(t)
+	if start.Equal(t) {
+		return t
+	}
+
+	return g.Next(start)
+}
+
+// RollupStats merges sorted stats of finer granularity into the buckets
+// of provided granularity. Datetime of each stat is the end of its
+// bucket, the amount is the closing balance and the candle covers all
+// merged stats.
+func RollupStats(origin []HistoryStat, g Granularity) (stats []HistoryStat) {
+	stats = make([]HistoryStat, 0, len(origin))
+	roller := NewStatRoller(g, func(stat HistoryStat) error {
+		stats = append(stats, stat)
+
+		return nil
+	})
+
+	for _, stat := range origin {
+		_ = roller.Push(stat)
+	}
+
+	_ = roller.Flush()
+
+	return stats
+}
+
+// StatRoller merges sorted stats one by one the same way as RollupStats
+// does and passes every complete bucket to the callback, so stats are
+// rolled up without keeping them all in memory.
+type StatRoller struct {
+	g    Granularity
+	next func(HistoryStat) error
+
+	stat HistoryStat
+	ok   bool
+}
+
+// NewStatRoller creates a roller passing merged stats to next.
+func NewStatRoller(g Granularity, next func(HistoryStat) error) *StatRoller {
+	return &StatRoller{
+		g:    g,
+		next: next,
+	}
+}
+
+// Push merges the stat into the current bucket. The bucket is passed to
+// the callback once the stat of the next bucket is pushed. Errors of the
+// callback are returned as is.
+func (r *StatRoller) Push(stat HistoryStat) (err error) {
+	// Datetime of the origin stat is the end of its bucket, so the last
+	// moment of the bucket defines the new one.
+	end := r.g.Next(r.g.Truncate(stat.Datetime.Add(-time.Nanosecond)))
+
+	if r.ok && r.stat.Datetime.Equal(end) {
+		r.stat.merge(stat)
+
+		return nil
+	}
+
+	if r.ok {
+		err = r.next(r.stat)
+		if err != nil {
+			return err
+		}
+	}
+
+	stat.Datetime = end
+	r.stat, r.ok = stat, true
+
+	return nil
+}
+
+// Flush passes the last bucket to the callback.
+func (r *StatRoller) Flush() (err error) {
+	if !r.ok {
+		return nil
+	}
+
+	r.ok = false
+
+	return r.next(r.stat)
+}
+
+// CountBuckets counts buckets of the granularity in [since, till). The
+// counting stops as soon as the amount exceeds limit.
+func CountBuckets(since, till time.Time, g Granularity, limit int) (amount int) {
+	for start := g.Truncate(since); start.Before(till) && amount <= limit; start = g.Next(start) {
+		amount++
+	}
+
+	return amount
+}
+
+// FillStats returns one stat per bucket of the granularity in [since,
+// till) from sorted sparse stats. Buckets without stats carry the closing
+// balance of the previous bucket, the first ones carry the opening
+// balance.
+func FillStats(origin []HistoryStat, opening Decimal, since, till time.Time, g Granularity) (stats []HistoryStat) {
+	var walletID int64
+	if len(origin) > 0 {
+		walletID = origin[0].WalletID
+	}
+
+	stats = make([]HistoryStat, 0, len(origin))
+	filler := NewStatFiller(walletID, opening, since, till, g, func(stat HistoryStat) error {
+		stats = append(stats, stat)
+
+		return nil
+	})
+
+	for _, stat := range origin {
+		_ = filler.Push(stat)
+	}
+
+	_ = filler.Flush()
+
+	return stats
+}
+
+// StatFiller fills gaps between sorted sparse stats pushed one by one the
+// same way as FillStats does and passes every bucket to the callback, so
+// buckets are filled without keeping them all in memory.
+type StatFiller struct {
+	walletID int64
+	till     time.Time
+	g        Granularity
+	next     func(HistoryStat) error
+
+	start  time.Time
+	amount Decimal
+}
+
+// NewStatFiller creates a filler passing one stat per bucket of the
+// granularity in [since, till) to next. Filled stats belong to the
+// wallet.
+func NewStatFiller(walletID int64, opening Decimal, since, till time.Time, g Granularity, next func(HistoryStat) error) *StatFiller {
+	return &StatFiller{
+		walletID: walletID,
+		till:     till,
+		g:        g,
+		next:     next,
+		start:    g.Truncate(since),
+		amount:   opening,
+	}
+}
+
+// Push passes the stat to the callback if it ends the bucket, preceded
+// by stats of the buckets without stats. Stats within the bucket only
+// update the balance while stats after till are skipped. Errors of the
+// callback are returned as is.
+func (f *StatFiller) Push(stat HistoryStat) (err error) {
+	for f.start.Before(f.till) {
+		end := f.g.Next(f.start)
+		if stat.Datetime.Before(end) {
+			f.amount = stat.Amount
+
+			return nil
+		}
+
+		f.start = end
+		if stat.Datetime.Equal(end) {
+			f.amount = stat.Amount
+
+			return f.next(stat)
+		}
+
+		err = f.next(newHistoryStat(f.walletID, end, f.amount))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush passes stats of the remaining buckets up to till to the
+// callback.
+func (f *StatFiller) Flush() (err error) {
+	for ; f.start.Before(f.till); f.start = f.g.Next(f.start) {
+		err = f.next(newHistoryStat(f.walletID, f.g.Next(f.start), f.amount))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,365 @@
+package btcount
+
+import (
+	"errors"
+	"testing"
+	"time"
+	// Load the time zone database regardless of the host.
+	_ "time/tzdata"
+)
+
+func TestParseGranularity(t *testing.T) {
+	var tt = []struct {
+		in     string
+		exp    Granularity
+		experr error
+	}{
+		{in: "minute", exp: GranularityMinute},
+		{in: "Hour", exp: GranularityHour},
+		{in: "day", exp: GranularityDay},
+		{in: "week", exp: GranularityWeek},
+		{in: "month", exp: GranularityMonth},
+		{in: "5m", exp: Granularity{interval: time.Minute * 5}},
+		{in: "4h", exp: Granularity{interval: time.Hour * 4}},
+		{in: "7m", experr: ErrInvalidParameter},
+		{in: "30s", experr: ErrInvalidParameter},
+		{in: "48h", experr: ErrInvalidParameter},
+		{in: "fortnight", experr: ErrInvalidParameter},
+	}
+
+	for _, tc := range tt {
+		got, err := ParseGranularity(tc.in)
+		if !errors.Is(err, tc.experr) {
+			t.Errorf("%s: exp error: %v, got: %v", tc.in, tc.experr, err)
+
+			continue
+		}
+
+		if got != tc.exp {
+			t.Errorf("%s: exp: %v, got: %v", tc.in, tc.exp, got)
+		}
+	}
+}
+
+func TestGranularityBuckets(t *testing.T) {
+	now := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC) // Sunday.
+
+	var tt = []struct {
+		name      string
+		g         Granularity
+		expStart  time.Time
+		expNext   time.Time
+		expHourly bool
+	}{{
+		name:     "5 minutes",
+		g:        Granularity{interval: time.Minute * 5},
+		expStart: time.Date(2021, 3, 14, 15, 5, 0, 0, time.UTC),
+		expNext:  time.Date(2021, 3, 14, 15, 10, 0, 0, time.UTC),
+	}, {
+		name:      "hour",
+		g:         GranularityHour,
+		expStart:  time.Date(2021, 3, 14, 15, 0, 0, 0, time.UTC),
+		expNext:   time.Date(2021, 3, 14, 16, 0, 0, 0, time.UTC),
+		expHourly: true,
+	}, {
+		name:      "day",
+		g:         GranularityDay,
+		expStart:  time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC),
+		expNext:   time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC),
+		expHourly: true,
+	}, {
+		name:      "week",
+		g:         GranularityWeek,
+		expStart:  time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC),
+		expNext:   time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC),
+		expHourly: true,
+	}, {
+		name:      "month",
+		g:         GranularityMonth,
+		expStart:  time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		expNext:   time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC),
+		expHourly: true,
+	}}
+
+	for _, tc := range tt {
+		start := tc.g.Truncate(now)
+		if !start.Equal(tc.expStart) {
+			t.Errorf("%s: exp start: %v, got: %v", tc.name, tc.expStart, start)
+		}
+
+		next := tc.g.Next(start)
+		if !next.Equal(tc.expNext) {
+			t.Errorf("%s: exp next: %v, got: %v", tc.name, tc.expNext, next)
+		}
+
+		if got := tc.g.Ceil(now); !got.Equal(tc.expNext) {
+			t.Errorf("%s: exp ceil: %v, got: %v", tc.name, tc.expNext, got)
+		}
+
+		if got := tc.g.Ceil(start); !got.Equal(start) {
+			t.Errorf("%s: exp ceil of start: %v, got: %v", tc.name, start, got)
+		}
+
+		if got := tc.g.IsHourly(); got != tc.expHourly {
+			t.Errorf("%s: exp hourly: %t, got: %t", tc.name, tc.expHourly, got)
+		}
+	}
+}
+
+func TestCollectTransactionsIntoBuckets(t *testing.T) {
+	now := time.Date(2010, 1, 2, 3, 4, 5, 0, time.UTC) // 2010-01-02 03:04:05.000
+
+	in := []Transaction{
+		{Amount: DecimalFromFloat(1.0), Datetime: now},
+		{Amount: DecimalFromFloat(2.0), Datetime: now.Add(time.Minute * 3)},
+		{Amount: DecimalFromFloat(4.0), Datetime: now.Add(time.Minute * 20)},
+	}
+
+	got := CollectTransactionsIntoBuckets(in, DecimalFromFloat(10.0), Granularity{interval: time.Minute * 5})
+	exp := []HistoryStat{{
+		Datetime: time.Date(2010, 1, 2, 3, 5, 0, 0, time.UTC),
+		Amount:   DecimalFromFloat(11.0),
+	}, {
+		Datetime: time.Date(2010, 1, 2, 3, 10, 0, 0, time.UTC),
+		Amount:   DecimalFromFloat(13.0),
+	}, {
+		Datetime: time.Date(2010, 1, 2, 3, 25, 0, 0, time.UTC),
+		Amount:   DecimalFromFloat(17.0),
+	}}
+
+	assertStatsEqual(t, exp, got)
+}
+
+func TestRollupStats(t *testing.T) {
+	day := time.Date(2021, 1, 30, 0, 0, 0, 0, time.UTC)
+
+	hourly := []HistoryStat{
+		{Datetime: day.Add(time.Hour * 1), Amount: DecimalFromFloat(1.0)},
+		{Datetime: day.Add(time.Hour * 5), Amount: DecimalFromFloat(2.0)},
+		// The last hour of the day.
+		{Datetime: day.Add(time.Hour * 24), Amount: DecimalFromFloat(3.0)},
+		{Datetime: day.Add(time.Hour * 25), Amount: DecimalFromFloat(4.0)},
+		{Datetime: day.Add(time.Hour * 24 * 3), Amount: DecimalFromFloat(5.0)},
+	}
+
+	t.Run("day", func(t *testing.T) {
+		exp := []HistoryStat{
+			{Datetime: day.AddDate(0, 0, 1), Amount: DecimalFromFloat(3.0)},
+			{Datetime: day.AddDate(0, 0, 2), Amount: DecimalFromFloat(4.0)},
+			{Datetime: day.AddDate(0, 0, 3), Amount: DecimalFromFloat(5.0)},
+		}
+
+		assertStatsEqual(t, exp, RollupStats(hourly, GranularityDay))
+	})
+
+	t.Run("month", func(t *testing.T) {
+		exp := []HistoryStat{
+			{Datetime: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), Amount: DecimalFromFloat(4.0)},
+			{Datetime: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), Amount: DecimalFromFloat(5.0)},
+		}
+
+		assertStatsEqual(t, exp, RollupStats(hourly, GranularityMonth))
+	})
+}
+
+func assertStatsEqual(t *testing.T, exp, got []HistoryStat) {
+	t.Helper()
+
+	if len(got) != len(exp) {
+		t.Fatalf("length not equal\nexp: %v\ngot: %v", exp, got)
+	}
+
+	for i := range got {
+		if !got[i].Datetime.Equal(exp[i].Datetime) || !got[i].Amount.Equal(exp[i].Amount) {
+			t.Fatalf("values not equal at %d\nexp: %v\ngot: %v", i, exp, got)
+		}
+	}
+}
+
+func TestGranularityLocation(t *testing.T) {
+	mustLoad := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return loc
+	}
+
+	kolkata := mustLoad("Asia/Kolkata")
+	kathmandu := mustLoad("Asia/Kathmandu")
+	sydney := mustLoad("Australia/Sydney")
+	newYork := mustLoad("America/New_York")
+
+	var tt = []struct {
+		name     string
+		g        Granularity
+		in       time.Time
+		expStart string
+		expNext  string
+	}{{
+		name:     "hour in +05:30",
+		g:        GranularityHour,
+		in:       time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC).In(kolkata),
+		expStart: "2021-03-14T20:00:00+05:30",
+		expNext:  "2021-03-14T21:00:00+05:30",
+	}, {
+		name:     "15 minutes in +05:45",
+		g:        Granularity{interval: time.Minute * 15},
+		in:       time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC).In(kathmandu),
+		expStart: "2021-03-14T20:45:00+05:45",
+		expNext:  "2021-03-14T21:00:00+05:45",
+	}, {
+		name:     "day in sydney",
+		g:        GranularityDay,
+		in:       time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC).In(sydney),
+		expStart: "2021-03-15T00:00:00+11:00",
+		expNext:  "2021-03-16T00:00:00+11:00",
+	}, {
+		name:     "23 hours day",
+		g:        GranularityDay,
+		in:       time.Date(2021, 3, 14, 12, 0, 0, 0, newYork),
+		expStart: "2021-03-14T00:00:00-05:00",
+		expNext:  "2021-03-15T00:00:00-04:00",
+	}, {
+		name:     "25 hours day",
+		g:        GranularityDay,
+		in:       time.Date(2021, 11, 7, 12, 0, 0, 0, newYork),
+		expStart: "2021-11-07T00:00:00-04:00",
+		expNext:  "2021-11-08T00:00:00-05:00",
+	}, {
+		name:     "6 hours across dst",
+		g:        Granularity{interval: time.Hour * 6},
+		in:       time.Date(2021, 3, 14, 5, 0, 0, 0, newYork),
+		expStart: "2021-03-14T00:00:00-05:00",
+		expNext:  "2021-03-14T06:00:00-04:00",
+	}, {
+		name:     "hour after dst ends",
+		g:        GranularityHour,
+		in:       time.Date(2021, 11, 7, 6, 30, 0, 0, time.UTC).In(newYork),
+		expStart: "2021-11-07T01:00:00-05:00",
+		expNext:  "2021-11-07T02:00:00-05:00",
+	}}
+
+	for _, tc := range tt {
+		start := tc.g.Truncate(tc.in)
+		if got := start.Format(time.RFC3339); got != tc.expStart {
+			t.Errorf("%s: exp start: %s, got: %s", tc.name, tc.expStart, got)
+		}
+
+		if got := tc.g.Next(start).Format(time.RFC3339); got != tc.expNext {
+			t.Errorf("%s: exp next: %s, got: %s", tc.name, tc.expNext, got)
+		}
+	}
+
+	if got := GranularityDay.Next(time.Date(2021, 3, 14, 0, 0, 0, 0, newYork)).Sub(time.Date(2021, 3, 14, 0, 0, 0, 0, newYork)); got != time.Hour*23 {
+		t.Errorf("exp 23 hours day, got: %s", got)
+	}
+}
+
+func TestFillStats(t *testing.T) {
+	since := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	till := since.Add(time.Hour * 5)
+
+	sparse := []HistoryStat{
+		{Datetime: since.Add(time.Hour * 2), Amount: DecimalFromFloat(3.0)},
+		{Datetime: since.Add(time.Hour * 4), Amount: DecimalFromFloat(1.5)},
+	}
+
+	exp := []HistoryStat{
+		{Datetime: since.Add(time.Hour * 1), Amount: DecimalFromFloat(2.0)},
+		{Datetime: since.Add(time.Hour * 2), Amount: DecimalFromFloat(3.0)},
+		{Datetime: since.Add(time.Hour * 3), Amount: DecimalFromFloat(3.0)},
+		{Datetime: since.Add(time.Hour * 4), Amount: DecimalFromFloat(1.5)},
+		{Datetime: since.Add(time.Hour * 5), Amount: DecimalFromFloat(1.5)},
+	}
+
+	assertStatsEqual(t, exp, FillStats(sparse, DecimalFromFloat(2.0), since, till, GranularityHour))
+
+	if got := CountBuckets(since, till, GranularityHour, 10); got != 5 {
+		t.Errorf("exp 5 buckets, got: %d", got)
+	}
+
+	if got := CountBuckets(since, till, GranularityMinute, 10); got != 11 {
+		t.Errorf("exp counting to stop at 11, got: %d", got)
+	}
+}
+
+func TestCandles(t *testing.T) {
+	day := time.Date(2021, 1, 30, 0, 0, 0, 0, time.UTC)
+
+	in := []Transaction{
+		{Amount: DecimalFromFloat(5.0), Datetime: day.Add(time.Minute * 10)},
+		{Amount: DecimalFromFloat(-8.0), Datetime: day.Add(time.Minute * 20)},
+		{Amount: DecimalFromFloat(1.0), Datetime: day.Add(time.Minute * 30)},
+		{Amount: DecimalFromFloat(-1.5), Datetime: day.Add(time.Hour * 3)},
+	}
+
+	hourly := CollectTransactionsIntoStats(in, DecimalFromFloat(10.0))
+	assertCandlesEqual(t, []HistoryStat{{
+		Datetime: day.Add(time.Hour),
+		Amount:   DecimalFromFloat(8.0),
+		Open:     DecimalFromFloat(10.0),
+		High:     DecimalFromFloat(15.0),
+		Low:      DecimalFromFloat(7.0),
+		Inflow:   DecimalFromFloat(6.0),
+		Outflow:  DecimalFromFloat(8.0),
+		Count:    3,
+	}, {
+		Datetime: day.Add(time.Hour * 4),
+		Amount:   DecimalFromFloat(6.5),
+		Open:     DecimalFromFloat(8.0),
+		High:     DecimalFromFloat(8.0),
+		Low:      DecimalFromFloat(6.5),
+		Outflow:  DecimalFromFloat(1.5),
+		Count:    1,
+	}}, hourly)
+
+	t.Run("rollup", func(t *testing.T) {
+		assertCandlesEqual(t, []HistoryStat{{
+			Datetime: day.AddDate(0, 0, 1),
+			Amount:   DecimalFromFloat(6.5),
+			Open:     DecimalFromFloat(10.0),
+			High:     DecimalFromFloat(15.0),
+			Low:      DecimalFromFloat(6.5),
+			Inflow:   DecimalFromFloat(6.0),
+			Outflow:  DecimalFromFloat(9.5),
+			Count:    4,
+		}}, RollupStats(hourly, GranularityDay))
+	})
+
+	t.Run("fill", func(t *testing.T) {
+		filled := FillStats(hourly, DecimalFromFloat(10.0), day, day.Add(time.Hour*3), GranularityHour)
+		assertCandlesEqual(t, []HistoryStat{hourly[0], {
+			Datetime: day.Add(time.Hour * 2),
+			Amount:   DecimalFromFloat(8.0),
+			Open:     DecimalFromFloat(8.0),
+			High:     DecimalFromFloat(8.0),
+			Low:      DecimalFromFloat(8.0),
+		}, {
+			Datetime: day.Add(time.Hour * 3),
+			Amount:   DecimalFromFloat(8.0),
+			Open:     DecimalFromFloat(8.0),
+			High:     DecimalFromFloat(8.0),
+			Low:      DecimalFromFloat(8.0),
+		}}, filled)
+	})
+}
+
+func assertCandlesEqual(t *testing.T, exp, got []HistoryStat) {
+	t.Helper()
+
+	assertStatsEqual(t, exp, got)
+
+	for i := range got {
+		equal := got[i].Open.Equal(exp[i].Open) &&
+			got[i].High.Equal(exp[i].High) &&
+			got[i].Low.Equal(exp[i].Low) &&
+			got[i].Inflow.Equal(exp[i].Inflow) &&
+			got[i].Outflow.Equal(exp[i].Outflow) &&
+			got[i].Count == exp[i].Count
+		if !equal {
+			t.Fatalf("candles not equal at %d\nexp: %v\ngot: %v", i, exp[i], got[i])
+		}
+	}
+}
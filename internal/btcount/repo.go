@@ -5,64 +5,90 @@ import (
 	"time"
 )
 
-// Database is an interface to interacting with database.
-type Database interface {
-	Exec(ctx context.Context, query string, args ...interface{}) error
-	QueryRow(ctx context.Context, query string, args ...interface{}) DBRow
-	Query(ctx context.Context, query string, args ...interface{}) (DBRows, error)
-	SendBatch(ctx context.Context, b Batch) BatchResults
+// Store keeps wallets with their transactions and history stats.
+type Store interface {
+	// Repos returns repositories working outside of a transaction.
+	Repos() Repos
+	// WithinTx runs fn with repositories working within a single
+	// transaction. Changes are committed if fn succeeds and discarded
+	// otherwise.
+	WithinTx(ctx context.Context, fn func(r Repos) error) (err error)
 
 	Close() error
 }
 
-type Beginner interface {
-	Begin(ctx context.Context) (Database, error)
-}
-
-// Batch allows to execute multiple methods.
-type Batch interface {
-	Queue(query string, args ...interface{})
-	Len() int
-}
-
-// BatchResults is the results of executing batch.
-type BatchResults interface {
-	Exec() error
-	Query() (DBRows, error)
-	QueryRow() DBRow
-	Close() error
-}
-
-// DBRow is an abstraction over single database row.
-type DBRow interface {
-	Scan(dest ...interface{}) error
-}
-
-// DBRows is an iterator over rows.
-type DBRows interface {
-	DBRow
-
-	Next() bool
-	Err() error
-	Close() error
+// Repos groups repositories of the store sharing the same transaction.
+type Repos struct {
+	Wallets      WalletStorage
+	Transactions TransactionStorage
+	History      HistoryStatStorage
 }
 
 // TransactionStorage provides API for iteracting with transaction storage.
 type TransactionStorage interface {
-	// Save the transaction to the storage.
-	Save(ctx context.Context, db Database, transaction Transaction) (err error)
-	// Load transactions by provided query.
-	Load(ctx context.Context, db Database, query TimerangeQuery) (ts []Transaction, err error)
+	// Save the transaction to the storage and return it with the
+	// assigned id. It returns ErrAlreadyExists if the wallet has a
+	// transaction with the same idempotency key.
+	Save(ctx context.Context, transaction Transaction) (saved Transaction, err error)
+	// SaveMany saves transactions at once and returns them with assigned
+	// ids in the same order. Transactions with idempotency keys used by
+	// the wallet already, including the ones saved earlier in the same
+	// call, are skipped and returned empty.
+	SaveMany(ctx context.Context, transactions []Transaction) (saved []Transaction, err error)
+	// Get loads the transaction of the wallet by its id.
+	Get(ctx context.Context, walletID, id int64) (transaction Transaction, err error)
+	// List loads a page of transactions of the wallet by provided query.
+	List(ctx context.Context, walletID int64, query TransactionListQuery) (ts []Transaction, err error)
+	// LoadByIdempotencyKey loads the transaction of the wallet by its
+	// idempotency key.
+	LoadByIdempotencyKey(ctx context.Context, walletID int64, key string) (transaction Transaction, err error)
+	// LoadByIdempotencyKeys loads transactions of the wallet with any of
+	// the idempotency keys in no particular order.
+	LoadByIdempotencyKeys(ctx context.Context, walletID int64, keys []string) (ts []Transaction, err error)
+	// Load transactions of the wallet matched by the query, ordered by
+	// datetime in ascending order.
+	Load(ctx context.Context, walletID int64, query TimerangeQuery) (ts []Transaction, err error)
+	// Iterate passes transactions of the wallet matched by the query to
+	// fn one by one, ordered by datetime in ascending order, without
+	// loading them all at once. The iteration stops at the first error
+	// of fn, which is returned as is, or once ctx is done.
+	Iterate(ctx context.Context, walletID int64, query TimerangeQuery, fn func(t Transaction) error) (err error)
+	// Sum returns the running balance of the wallet, i.e. the sum of all
+	// its transactions. The running balance is updated together with
+	// saving transactions, so it is read without summing them.
+	Sum(ctx context.Context, walletID int64) (sum Decimal, err error)
+	// Balance calculates the balance of the wallet at ts, i.e. the
+	// running balance without transactions scheduled after ts.
+	Balance(ctx context.Context, walletID int64, ts time.Time) (sum Decimal, err error)
+	// SumBefore calculates the sum of transactions of the wallet dated
+	// before ts, i.e. the opening balance of the range starting at ts.
+	SumBefore(ctx context.Context, walletID int64, ts time.Time) (sum Decimal, err error)
+	// SumAvailable calculates the sum of transactions of the wallet made
+	// by ts and withdrawals scheduled after it. So scheduled withdrawals
+	// reserve the coins while scheduled deposits can not be spent until
+	// their datetime arrives.
+	SumAvailable(ctx context.Context, walletID int64, ts time.Time) (sum Decimal, err error)
+	// LowestBalance calculates the lowest balance the wallet has since
+	// ts, i.e. the least of its balance at ts and the balances after each
+	// transaction scheduled after ts.
+	LowestBalance(ctx context.Context, walletID int64, ts time.Time) (low Decimal, err error)
 }
 
-// TimerangeQuery filters output by provided bounds.
+// TimerangeQuery selects records by their datetime. The range is
+// half-open by default, i.e. records dated in [Since, Till) are selected,
+// so adjacent ranges never select the same record. The flags make either
+// end the other kind.
 type TimerangeQuery struct {
-	Since time.Time
-	Till  time.Time
+	Since time.Time `json:"since"`
+	Till  time.Time `json:"till"`
+	// ExcludeSince makes the range open at Since.
+	ExcludeSince bool `json:"excludeSince,omitempty"`
+	// IncludeTill makes the range closed at Till.
+	IncludeTill bool `json:"includeTill,omitempty"`
 }
 
-// NewTimeRangeQuery creates a new query for selecting records by time
-// interval.
+// NewTimeRangeQuery creates a new query for selecting records dated in
+// [since, till).
 func NewTimeRangeQuery(since time.Time, till time.Time) TimerangeQuery {
 	return TimerangeQuery{
 		Since: since,
@@ -70,21 +96,87 @@ func NewTimeRangeQuery(since time.Time, till time.Time) TimerangeQuery {
 	}
 }
 
+// NewStatRangeQuery creates a new query for selecting stats dated in
+// (since, till]. A stat is dated by the end of its bucket, so these are
+// the stats of transactions dated in [since, till) if both bounds are
+// aligned to the buckets.
+func NewStatRangeQuery(since time.Time, till time.Time) TimerangeQuery {
+	return TimerangeQuery{
+		Since:        since,
+		Till:         till,
+		ExcludeSince: true,
+		IncludeTill:  true,
+	}
+}
+
+// Contains reports whether datetime is within the range.
+func (q TimerangeQuery) Contains(datetime time.Time) bool {
+	if datetime.Before(q.Since) || q.ExcludeSince && datetime.Equal(q.Since) {
+		return false
+	}
+
+	if datetime.After(q.Till) || !q.IncludeTill && datetime.Equal(q.Till) {
+		return false
+	}
+
+	return true
+}
+
 // HistoryStatStorage provides API for interacting with storage.
 type HistoryStatStorage interface {
 	// Save a single history stat to the database.
-	Save(ctx context.Context, db Database, stat HistoryStat) (err error)
+	Save(ctx context.Context, stat HistoryStat) (err error)
 	// SaveMany saves many history stats to the database.
-	SaveMany(ctx context.Context, db Database, stats []HistoryStat) (err error)
-	// Load history stats from the database, ordered by datetime in
-	// ascending order.
-	Load(ctx context.Context, db Database, query TimerangeQuery) (hss []HistoryStat, err error)
-	// LoadLastStat loads last saved stat prior to provided ts.
-	LoadLastStat(ctx context.Context, db Database, ts time.Time) (h HistoryStat, err error)
+	SaveMany(ctx context.Context, stats []HistoryStat) (err error)
+	// Load history stats of the wallet matched by the query from the
+	// database, ordered by datetime in ascending order.
+	Load(ctx context.Context, walletID int64, query TimerangeQuery) (hss []HistoryStat, err error)
+	// Iterate passes history stats of the wallet matched by the query to
+	// fn one by one, ordered by datetime in ascending order, without
+	// loading them all at once. The iteration stops at the first error
+	// of fn, which is returned as is, or once ctx is done.
+	Iterate(ctx context.Context, walletID int64, query TimerangeQuery, fn func(stat HistoryStat) error) (err error)
+	// LoadLastStat loads last saved stat of the wallet prior to provided
+	// ts. Returns ErrNotFound if there is no such stat.
+	LoadLastStat(ctx context.Context, walletID int64, ts time.Time) (h HistoryStat, err error)
+	// Delete removes history stats of the wallet matched by the query.
+	Delete(ctx context.Context, walletID int64, query TimerangeQuery) (err error)
+}
+
+// WalletStorage provides API for interacting with wallets storage.
+type WalletStorage interface {
+	// Create saves a new wallet and returns it with the assigned id.
+	Create(ctx context.Context, wallet Wallet) (created Wallet, err error)
+	// Get loads the wallet by its id. Returns ErrNotFound if there is
+	// no such wallet.
+	Get(ctx context.Context, id int64) (wallet Wallet, err error)
+	// Lock loads the wallet and locks it until the end of the database
+	// transaction. Returns ErrNotFound if there is no such wallet.
+	Lock(ctx context.Context, id int64) (wallet Wallet, err error)
+	// List loads all wallets ordered by id.
+	List(ctx context.Context) (wallets []Wallet, err error)
+	// Delete removes the wallet with all its transactions and stats.
+	// Returns ErrNotFound if there is no such wallet.
+	Delete(ctx context.Context, id int64) (err error)
 }
 
-// HistoryStat stores amount
+// HistoryStat stores amount of the wallet at the end of the bucket
+// together with the candle of balance changes within the bucket.
 type HistoryStat struct {
+	WalletID int64 `json:"-"`
+	// Datetime is the end of the bucket.
 	Datetime time.Time
-	Amount   Decimal
+	// Amount is the closing balance.
+	Amount Decimal
+	// Open is the balance before the first transaction of the bucket.
+	Open Decimal
+	// High and Low are the extreme balances within the bucket.
+	High Decimal
+	Low  Decimal
+	// Inflow and Outflow are the total amounts of deposits and
+	// withdrawals, both positive.
+	Inflow  Decimal
+	Outflow Decimal
+	// Count is the amount of transactions.
+	Count int64
 }
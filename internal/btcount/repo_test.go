@@ -0,0 +1,72 @@
+package btcount
+
+import (
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestTimerangeQueryContains(t *testing.T) {
+	hour := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	var tt = []struct {
+		name  string
+		query TimerangeQuery
+		in    time.Time
+		exp   bool
+	}{
+		{name: "since of half-open", query: NewTimeRangeQuery(hour, hour.Add(time.Hour)), in: hour, exp: true},
+		{name: "till of half-open", query: NewTimeRangeQuery(hour, hour.Add(time.Hour)), in: hour.Add(time.Hour), exp: false},
+		{name: "before since", query: NewTimeRangeQuery(hour, hour.Add(time.Hour)), in: hour.Add(-time.Nanosecond), exp: false},
+		{name: "before till", query: NewTimeRangeQuery(hour, hour.Add(time.Hour)), in: hour.Add(time.Hour - time.Nanosecond), exp: true},
+		{name: "since of stat range", query: NewStatRangeQuery(hour, hour.Add(time.Hour)), in: hour, exp: false},
+		{name: "till of stat range", query: NewStatRangeQuery(hour, hour.Add(time.Hour)), in: hour.Add(time.Hour), exp: true},
+		{name: "after till of stat range", query: NewStatRangeQuery(hour, hour.Add(time.Hour)), in: hour.Add(time.Hour + time.Nanosecond), exp: false},
+		{name: "closed point", query: TimerangeQuery{Since: hour, Till: hour, IncludeTill: true}, in: hour, exp: true},
+		{name: "empty", query: NewTimeRangeQuery(hour, hour), in: hour, exp: false},
+		{name: "other location", query: NewTimeRangeQuery(hour, hour.Add(time.Hour)), in: hour.In(time.FixedZone("UTC+3", 3*60*60)), exp: true},
+	}
+
+	for _, tc := range tt {
+		if got := tc.query.Contains(tc.in); got != tc.exp {
+			t.Errorf("%s: exp: %t, got: %t", tc.name, tc.exp, got)
+		}
+	}
+}
+
+func TestTimerangeQueryPartition(t *testing.T) {
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes uint8) time.Time {
+		return base.Add(time.Minute * time.Duration(minutes))
+	}
+
+	// Adjacent half-open ranges contain every datetime of their union
+	// exactly once, so are stat ranges.
+	partition := func(a, b, c, x uint8) bool {
+		if a > b || b > c {
+			return true
+		}
+
+		for _, ranges := range [][3]TimerangeQuery{{
+			NewTimeRangeQuery(at(a), at(b)),
+			NewTimeRangeQuery(at(b), at(c)),
+			NewTimeRangeQuery(at(a), at(c)),
+		}, {
+			NewStatRangeQuery(at(a), at(b)),
+			NewStatRangeQuery(at(b), at(c)),
+			NewStatRangeQuery(at(a), at(c)),
+		}} {
+			left, right, union := ranges[0].Contains(at(x)), ranges[1].Contains(at(x)), ranges[2].Contains(at(x))
+			if left && right || (left || right) != union {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	err := quick.Check(partition, &quick.Config{MaxCount: 10000})
+	if err != nil {
+		t.Error(err)
+	}
+}
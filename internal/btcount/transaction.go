@@ -0,0 +1,98 @@
+package btcount
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the amount of transactions in the page.
+const (
+	DefaultTransactionsLimit = 100
+	MaxTransactionsLimit     = 1000
+)
+
+// TransactionListQuery filters and orders transactions of the wallet.
+// Empty fields do not filter transactions.
+type TransactionListQuery struct {
+	// Since and Till define the range [Since, Till) of the datetime.
+	Since time.Time
+	Till  time.Time
+	// MinAmount and MaxAmount define the range [MinAmount, MaxAmount] of
+	// the amount. Withdrawals have negative amounts.
+	MinAmount *Decimal
+	MaxAmount *Decimal
+	// Descending orders transactions from the latest to the earliest.
+	Descending bool
+	// Limit is the maximum amount of transactions in the page.
+	Limit int
+	// After continues listing after the last transaction of the previous
+	// page.
+	After *TransactionCursor
+}
+
+// TransactionCursor points to the transaction the listing continues
+// after. Transactions are ordered by the datetime and the id.
+type TransactionCursor struct {
+	Datetime   time.Time
+	ID         int64
+	Descending bool
+}
+
+// NewTransactionCursor creates a cursor pointing to the transaction.
+func NewTransactionCursor(t Transaction, descending bool) TransactionCursor {
+	return TransactionCursor{
+		Datetime:   t.Datetime,
+		ID:         t.ID,
+		Descending: descending,
+	}
+}
+
+// String encodes the cursor into the opaque string.
+func (c TransactionCursor) String() string {
+	order := "asc"
+	if c.Descending {
+		order = "desc"
+	}
+
+	raw := strconv.FormatInt(c.Datetime.UnixNano(), 10) + "." + strconv.FormatInt(c.ID, 10) + "." + order
+
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseTransactionCursor decodes the cursor encoded by String.
+func ParseTransactionCursor(v string) (c TransactionCursor, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return c, fmt.Errorf("%w: cursor", ErrInvalidParameter)
+	}
+
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 3 {
+		return c, fmt.Errorf("%w: cursor", ErrInvalidParameter)
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return c, fmt.Errorf("%w: cursor", ErrInvalidParameter)
+	}
+
+	c.ID, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return c, fmt.Errorf("%w: cursor", ErrInvalidParameter)
+	}
+
+	switch parts[2] {
+	case "asc":
+	case "desc":
+		c.Descending = true
+	default:
+		return c, fmt.Errorf("%w: cursor", ErrInvalidParameter)
+	}
+
+	c.Datetime = time.Unix(0, nanos).UTC()
+
+	return c, nil
+}
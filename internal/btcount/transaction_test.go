@@ -0,0 +1,29 @@
+package btcount
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransactionCursor(t *testing.T) {
+	in := NewTransactionCursor(Transaction{
+		ID:       42,
+		Datetime: time.Date(2021, 1, 1, 10, 0, 0, 123456000, time.UTC),
+	}, true)
+
+	got, err := ParseTransactionCursor(in.String())
+	if err != nil {
+		t.Fatalf("parsing cursor: %v", err)
+	}
+
+	if got.ID != in.ID || !got.Datetime.Equal(in.Datetime) || got.Descending != in.Descending {
+		t.Errorf("exp: %v, got: %v", in, got)
+	}
+
+	for _, bad := range []string{"", "not base64!", "MTIz", "YS5iLmFzYw", "MS4yLnNpZGV3YXlz"} {
+		if _, err = ParseTransactionCursor(bad); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%q: exp error: %v, got: %v", bad, ErrInvalidParameter, err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package bthttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ferux/btcount/internal/api"
+	"github.com/ferux/btcount/internal/btcount"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// maxBatchLineSize limits the size of a single line of NDJSON batch.
+const maxBatchLineSize = 64 * 1024
+
+// maxBatchBodySize limits the size of the batch request, i.e. the largest
+// batch of the longest lines. It limits the JSON array as well.
+const maxBatchBodySize = int64(api.MaxBatchSize) * maxBatchLineSize
+
+// errBatchTooLarge is returned once the batch request exceeds the limit.
+const errBatchTooLarge btcount.Error = "batch request is too large"
+
+// limitedBody fails reads beyond the limit with errBatchTooLarge. The
+// body is limited by http.MaxBytesReader, so the server does not read the
+// rest of it either.
+type limitedBody struct {
+	r    io.Reader
+	left int64
+}
+
+func limitBatchBody(w http.ResponseWriter, body io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{
+		r:    http.MaxBytesReader(w, body, limit),
+		left: limit,
+	}
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err error) {
+	n, err = b.r.Read(p)
+	b.left -= int64(n)
+	if err != nil && b.left <= 0 && !errors.Is(err, io.EOF) {
+		return n, errBatchTooLarge
+	}
+
+	return n, err
+}
+
+// batchRequestRow is a transaction of the batch request. Err is set if
+// the row can not be decoded.
+type batchRequestRow struct {
+	req transactionRequest
+	err error
+}
+
+// readBatchRequest reads transactions of the batch from the JSON array
+// or from NDJSON, i.e. one JSON object per line. Rows which can not be
+// decoded are returned with errors, while malformed JSON arrays fail
+// entirely.
+func readBatchRequest(body io.Reader) (rows []batchRequestRow, err error) {
+	reader := bufio.NewReader(body)
+
+	first, err := peekNonSpace(reader)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+
+	appendRow := func(raw []byte) error {
+		if len(rows) >= api.MaxBatchSize {
+			return fmt.Errorf("%w: batch should have at most %d transactions", btcount.ErrInvalidParameter, api.MaxBatchSize)
+		}
+
+		var row batchRequestRow
+		row.err = json.Unmarshal(raw, &row.req)
+		rows = append(rows, row)
+
+		return nil
+	}
+
+	if first == '[' {
+		dec := json.NewDecoder(reader)
+		_, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		for dec.More() {
+			var raw json.RawMessage
+			err = dec.Decode(&raw)
+			if err != nil {
+				return nil, err
+			}
+
+			err = appendRow(raw)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		return rows, nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 4096), maxBatchLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		err = appendRow(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading line: %w", err)
+	}
+
+	return rows, nil
+}
+
+// peekNonSpace skips leading whitespaces and returns the next byte
+// without reading it.
+func peekNonSpace(reader *bufio.Reader) (b byte, err error) {
+	for {
+		var peeked []byte
+		peeked, err = reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+
+		switch peeked[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = reader.ReadByte()
+		default:
+			return peeked[0], nil
+		}
+	}
+}
+
+func saveTransactions(wapi api.WalletAPI) (h http.Handler) {
+	validator := newValidator()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		rows, err := readBatchRequest(limitBatchBody(w, r.Body, maxBatchBodySize))
+		if errors.Is(err, errBatchTooLarge) {
+			asJSON(ctx, w, messageResponse{
+				Message: err.Error(),
+			}, http.StatusRequestEntityTooLarge)
+
+			return
+		}
+		if errors.Is(err, btcount.ErrInvalidParameter) {
+			respondError(ctx, w, err)
+
+			return
+		}
+		if err != nil {
+			asJSON(ctx, w, messageResponse{
+				Message: err.Error(),
+			}, http.StatusBadRequest)
+
+			return
+		}
+
+		// Only valid rows are passed to the api, so their indexes are
+		// kept to match the results.
+		items := make([]api.BatchItem, 0, len(rows))
+		indexes := make([]int, 0, len(rows))
+		for i := range rows {
+			if rows[i].err == nil {
+				rows[i].err = validator.StructCtx(ctx, &rows[i].req)
+			}
+
+			if rows[i].err != nil {
+				continue
+			}
+
+			items = append(items, api.BatchItem{
+				Transaction: rows[i].req.ToTransaction(),
+				Withdrawal:  rows[i].req.Type == transactionTypeWithdrawal,
+			})
+			indexes = append(indexes, i)
+		}
+
+		results, err := wapi.CreateTransactions(ctx, walletID, items)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		resp := batchResponse{
+			Results: make([]batchResultResponse, len(rows)),
+		}
+
+		for i := range rows {
+			resp.Results[i] = batchResultResponse{Index: i}
+			if rows[i].err != nil {
+				resp.Results[i].fail(rows[i].err)
+			}
+		}
+
+		for j, result := range results {
+			row := &resp.Results[indexes[j]]
+			switch {
+			case result.Err != nil:
+				row.fail(result.Err)
+			case result.Replayed:
+				row.Status = batchStatusReplayed
+			default:
+				row.Status = batchStatusCreated
+			}
+
+			if result.Err == nil {
+				transaction := result.Transaction
+				row.Transaction = &transaction
+			}
+		}
+
+		for _, row := range resp.Results {
+			switch row.Status {
+			case batchStatusCreated:
+				resp.Created++
+			case batchStatusReplayed:
+				resp.Replayed++
+			default:
+				resp.Failed++
+			}
+		}
+
+		asJSON(ctx, w, resp, http.StatusOK)
+	})
+}
+
+// fail sets the error of the row the same way as respondError does for a
+// single transaction.
+func (row *batchResultResponse) fail(err error) {
+	row.Status = batchStatusFailed
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		row.Error = err.Error()
+
+		return
+	}
+
+	row.Error = "validation failed"
+	for _, verr := range verrs {
+		var ve validationError
+		ve.fromValidationError(verr)
+		row.Meta = append(row.Meta, ve)
+	}
+}
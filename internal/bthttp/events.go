@@ -0,0 +1,258 @@
+package bthttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ferux/btcount/internal/api"
+	"github.com/ferux/btcount/internal/btcontext"
+	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/notify"
+
+	"go.uber.org/zap"
+)
+
+const (
+	contentEventStream = "text/event-stream"
+	lastEventIDHeader  = "Last-Event-ID"
+)
+
+// eventBalance is the name of the event carrying the current balance. It
+// is sent first unless the stream is resumed.
+const eventBalance = "balance"
+
+// eventRetry is the reconnection delay suggested to clients. Streams end
+// regularly, so clients should reconnect soon.
+const eventRetry = time.Second
+
+type walletEventResponse struct {
+	WalletID    int64                `json:"walletId"`
+	Transaction *btcount.Transaction `json:"transaction,omitempty"`
+	Balance     *btcount.Decimal     `json:"balance,omitempty"`
+	Candle      *candleResponse      `json:"candle,omitempty"`
+}
+
+func toWalletEventResponse(e notify.Event) walletEventResponse {
+	resp := walletEventResponse{
+		WalletID:    e.WalletID,
+		Transaction: e.Transaction,
+	}
+
+	switch e.Kind {
+	case notify.KindTransaction:
+		resp.Balance = &e.Balance
+	case notify.KindStat:
+		candle := toCandleResponse(*e.Stat)
+		resp.Candle = &candle
+	}
+
+	return resp
+}
+
+// streamEvents streams events of the wallet as server-sent events. The
+// stream is resumed from the Last-Event-ID header if the events are still
+// kept, otherwise it starts with the current balance. Every write should
+// complete within writeTimeout, if it is set. The stream ends once the
+// server is closing, or once lifetime passes if the deadlines of the
+// connection can not be changed.
+func streamEvents(wapi api.WalletAPI, broker *notify.Broker, cfg EventsConfig, writeTimeout, lifetime time.Duration, closing <-chan struct{}) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := btcontext.Logger(ctx)
+
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		_, err = wapi.GetWallet(ctx, walletID)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		// The subscription starts before the balance is loaded, so no
+		// event is missed in between.
+		sub, missed, resumed := broker.Subscribe(walletID, r.Header.Get(lastEventIDHeader), cfg.Buffer)
+		defer broker.Unsubscribe(sub)
+
+		var balance btcount.Decimal
+		if !resumed {
+			balance, err = wapi.GetCurrentBalance(ctx, walletID)
+			if err != nil {
+				respondError(ctx, w, err)
+
+				return
+			}
+		}
+
+		stream := eventStream{w: w, timeout: writeTimeout}
+
+		var expired <-chan time.Time
+		if conn, ok := connFromContext(ctx); ok {
+			// The stream outlives the timeouts of the server, so the read
+			// deadline is removed while writes get their own deadlines.
+			// The server sets both for the next request.
+			err = conn.SetReadDeadline(time.Time{})
+			if err != nil {
+				respondError(ctx, w, fmt.Errorf("removing read deadline: %w", err))
+
+				return
+			}
+
+			stream.conn = conn
+		} else if lifetime > 0 {
+			timer := time.NewTimer(lifetime)
+			defer timer.Stop()
+
+			expired = timer.C
+		}
+
+		err = stream.start()
+		if !resumed && err == nil {
+			err = stream.send("", eventBalance, walletEventResponse{
+				WalletID: walletID,
+				Balance:  &balance,
+			})
+		}
+
+		for i := 0; i < len(missed) && err == nil; i++ {
+			err = stream.send(missed[i].ID, string(missed[i].Kind), toWalletEventResponse(missed[i]))
+		}
+
+		heartbeat := time.NewTicker(cfg.Heartbeat)
+		defer heartbeat.Stop()
+
+		for err == nil {
+			err = stream.flush()
+			if err != nil {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-closing:
+				return
+			case <-expired:
+				return
+			case <-heartbeat.C:
+				err = stream.comment("heartbeat")
+			case e, ok := <-sub.Events():
+				if !ok {
+					log.Debug("client fell behind the events", zap.Int64("wallet_id", walletID))
+
+					return
+				}
+
+				err = stream.send(e.ID, string(e.Kind), toWalletEventResponse(e))
+			}
+		}
+
+		log.Debug("unable to stream events", zap.Error(err))
+	})
+}
+
+// eventStream writes server-sent events to the response.
+type eventStream struct {
+	w http.ResponseWriter
+	// conn is set if its write deadline is extended by timeout before
+	// every write.
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// start sends the status and the headers of the stream together with the
+// reconnection delay.
+func (s eventStream) start() (err error) {
+	s.w.Header().Set(contentType, contentEventStream)
+	s.w.Header().Set("Cache-Control", "no-cache")
+	// Disable buffering by nginx, so events are not delayed.
+	s.w.Header().Set("X-Accel-Buffering", "no")
+	s.w.WriteHeader(http.StatusOK)
+
+	err = s.write([]byte(fmt.Sprintf("retry: %d\n\n", eventRetry.Milliseconds())))
+	if err != nil {
+		return fmt.Errorf("writing retry: %w", err)
+	}
+
+	return nil
+}
+
+// send writes the event with data encoded as JSON. The event without id
+// does not change the id the client resumes from.
+func (s eventStream) send(id, name string, data interface{}) (err error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	fmt.Fprintf(&buf, "event: %s\ndata: %s\n\n", name, payload)
+
+	err = s.write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("writing event: %w", err)
+	}
+
+	return nil
+}
+
+// comment writes the comment ignored by clients.
+func (s eventStream) comment(text string) (err error) {
+	err = s.write([]byte(": " + text + "\n\n"))
+	if err != nil {
+		return fmt.Errorf("writing comment: %w", err)
+	}
+
+	return nil
+}
+
+// flush sends the written events to the client.
+func (s eventStream) flush() (err error) {
+	err = s.extendDeadline()
+	if err != nil {
+		return err
+	}
+
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+func (s eventStream) write(p []byte) (err error) {
+	err = s.extendDeadline()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.w.Write(p)
+
+	return err
+}
+
+// extendDeadline gives the following write its own deadline.
+func (s eventStream) extendDeadline() (err error) {
+	if s.conn == nil || s.timeout <= 0 {
+		return nil
+	}
+
+	err = s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if err != nil {
+		return fmt.Errorf("setting write deadline: %w", err)
+	}
+
+	return nil
+}
@@ -1,32 +1,62 @@
 package bthttp
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/ferux/btcount/internal/api"
 	"github.com/ferux/btcount/internal/btcontext"
 	"github.com/ferux/btcount/internal/btcount"
-
-	"github.com/go-playground/validator/v10"
 	"go.uber.org/zap"
 )
 
+const (
+	transactionTypeDeposit    = "deposit"
+	transactionTypeWithdrawal = "withdrawal"
+)
+
+// idempotencyKeyHeader is an alternative to the externalId field of the
+// transaction request.
+const idempotencyKeyHeader = "Idempotency-Key"
+
 type transactionRequest struct {
-	Amount   float64   `json:"amount" validate:"required"`
-	Datetime time.Time `json:"datetime" validate:"required"`
+	Amount     btcount.Decimal `json:"amount" validate:"required"`
+	Datetime   time.Time       `json:"datetime" validate:"required"`
+	Type       string          `json:"type" validate:"omitempty,oneof=deposit withdrawal"`
+	ExternalID string          `json:"externalId" validate:"max=256"`
 }
 
 func (req transactionRequest) ToTransaction() btcount.Transaction {
 	return btcount.Transaction{
-		Amount:   btcount.DecimalFromFloat(req.Amount),
-		Datetime: req.Datetime,
+		Amount:         req.Amount,
+		Datetime:       req.Datetime,
+		IdempotencyKey: req.ExternalID,
 	}
 
 }
 
+// readIdempotencyKey fills the external id of the request from the
+// header. Both values should be equal if provided.
+func (req *transactionRequest) readIdempotencyKey(r *http.Request) (err error) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		return nil
+	}
+
+	if req.ExternalID != "" && req.ExternalID != key {
+		return fmt.Errorf("%w: %s header differs from externalId", btcount.ErrInvalidParameter, idempotencyKeyHeader)
+	}
+
+	req.ExternalID = key
+
+	return nil
+}
+
 func saveTransaction(wapi api.WalletAPI) (h http.Handler) {
-	validator := validator.New()
+	validator := newValidator()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -36,31 +66,256 @@ func saveTransaction(wapi api.WalletAPI) (h http.Handler) {
 			return
 		}
 
-		err := validator.StructCtx(ctx, &req)
+		walletID, err := walletIDFromRequest(r)
 		if err != nil {
 			respondError(ctx, w, err)
 
 			return
 		}
 
-		err = wapi.CreateTransaction(ctx, req.ToTransaction())
+		err = req.readIdempotencyKey(r)
 		if err != nil {
 			respondError(ctx, w, err)
 
 			return
 		}
 
-		asJSON(ctx, w, messageResponse{Message: "success"}, http.StatusCreated)
+		err = validator.StructCtx(ctx, &req)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		var created btcount.Transaction
+		if req.Type == transactionTypeWithdrawal {
+			created, err = wapi.CreateWithdrawal(ctx, walletID, req.ToTransaction())
+		} else {
+			created, err = wapi.CreateTransaction(ctx, walletID, req.ToTransaction())
+		}
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		asJSON(ctx, w, transactionResponse{
+			Message:     "success",
+			Transaction: created,
+		}, http.StatusCreated)
+	})
+}
+
+// transactionListRequest is read from the query parameters.
+type transactionListRequest struct {
+	Since     string
+	Till      string
+	MinAmount string
+	MaxAmount string
+	Order     string
+	Limit     string
+	Cursor    string
+}
+
+func readTransactionListRequest(r *http.Request) transactionListRequest {
+	values := r.URL.Query()
+
+	return transactionListRequest{
+		Since:     values.Get("since"),
+		Till:      values.Get("till"),
+		MinAmount: values.Get("minAmount"),
+		MaxAmount: values.Get("maxAmount"),
+		Order:     values.Get("order"),
+		Limit:     values.Get("limit"),
+		Cursor:    values.Get("cursor"),
+	}
+}
+
+func (req transactionListRequest) ToQuery() (query btcount.TransactionListQuery, err error) {
+	if req.Since != "" {
+		query.Since, err = time.Parse(time.RFC3339Nano, req.Since)
+		if err != nil {
+			return query, fmt.Errorf("%w: since", btcount.ErrInvalidParameter)
+		}
+	}
+
+	if req.Till != "" {
+		query.Till, err = time.Parse(time.RFC3339Nano, req.Till)
+		if err != nil {
+			return query, fmt.Errorf("%w: till", btcount.ErrInvalidParameter)
+		}
+	}
+
+	if req.MinAmount != "" {
+		var amount btcount.Decimal
+		amount, err = btcount.DecimalFromString(req.MinAmount)
+		if err != nil {
+			return query, err
+		}
+
+		query.MinAmount = &amount
+	}
+
+	if req.MaxAmount != "" {
+		var amount btcount.Decimal
+		amount, err = btcount.DecimalFromString(req.MaxAmount)
+		if err != nil {
+			return query, err
+		}
+
+		query.MaxAmount = &amount
+	}
+
+	switch req.Order {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("%w: order should be either asc or desc", btcount.ErrInvalidParameter)
+	}
+
+	if req.Limit != "" {
+		query.Limit, err = strconv.Atoi(req.Limit)
+		if err != nil {
+			return query, fmt.Errorf("%w: limit", btcount.ErrInvalidParameter)
+		}
+	}
+
+	if req.Cursor != "" {
+		var cursor btcount.TransactionCursor
+		cursor, err = btcount.ParseTransactionCursor(req.Cursor)
+		if err != nil {
+			return query, err
+		}
+
+		query.After = &cursor
+	}
+
+	return query, nil
+}
+
+func listTransactions(wapi api.WalletAPI) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		query, err := readTransactionListRequest(r).ToQuery()
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		page, err := wapi.ListTransactions(ctx, walletID, query)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		resp := transactionListResponse{
+			Transactions: page.Transactions,
+		}
+
+		if resp.Transactions == nil {
+			resp.Transactions = []btcount.Transaction{}
+		}
+
+		if page.Next != nil {
+			resp.NextCursor = page.Next.String()
+		}
+
+		asJSON(ctx, w, resp, http.StatusOK)
+	})
+}
+
+func getTransaction(wapi api.WalletAPI) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		transactionID, err := transactionIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		transaction, err := wapi.GetTransaction(ctx, walletID, transactionID)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		asJSON(ctx, w, transaction, http.StatusOK)
 	})
 }
 
 type historyRequest struct {
 	StartDatetime time.Time `json:"startDatetime"`
 	EndDatetime   time.Time `json:"endDatetime" validate:"required,gtefield=StartDatetime"`
+	Granularity   string    `json:"granularity"`
+	Timezone      string    `json:"timezone"`
+	Fill          string    `json:"fill" validate:"omitempty,oneof=none previous"`
+}
+
+func (req historyRequest) ToHistoryParams() (params api.HistoryParams, err error) {
+	params = api.HistoryParams{
+		Since:       req.StartDatetime,
+		Till:        req.EndDatetime,
+		Granularity: btcount.GranularityHour,
+		Fill:        api.FillMode(req.Fill),
+	}
+
+	if req.Granularity != "" {
+		params.Granularity, err = btcount.ParseGranularity(req.Granularity)
+		if err != nil {
+			return params, err
+		}
+	}
+
+	if req.Timezone != "" {
+		params.Location, err = time.LoadLocation(req.Timezone)
+		if err != nil {
+			return params, fmt.Errorf("%w: timezone %q", btcount.ErrInvalidParameter, req.Timezone)
+		}
+	}
+
+	return params, nil
 }
 
 func getHistory(wapi api.WalletAPI) (h http.Handler) {
-	validator := validator.New()
+	return fetchHistory(wapi, func(stat btcount.HistoryStat) interface{} {
+		return historyStatResponse{
+			Datetime: stat.Datetime,
+			Amount:   stat.Amount,
+		}
+	})
+}
+
+func getCandles(wapi api.WalletAPI) (h http.Handler) {
+	return fetchHistory(wapi, func(stat btcount.HistoryStat) interface{} {
+		return toCandleResponse(stat)
+	})
+}
+
+// fetchHistory handles history request and responds with stats converted
+// by toResponse. Stats are streamed as NDJSON if the client accepts it.
+func fetchHistory(wapi api.WalletAPI, toResponse func(btcount.HistoryStat) interface{}) (h http.Handler) {
+	validator := newValidator()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -72,32 +327,107 @@ func getHistory(wapi api.WalletAPI) (h http.Handler) {
 
 		btcontext.Logger(ctx).Debug("request body", zap.Any("payload", req))
 
-		err := validator.StructCtx(ctx, &req)
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		err = validator.StructCtx(ctx, &req)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		params, err := req.ToHistoryParams()
 		if err != nil {
 			respondError(ctx, w, err)
 
 			return
 		}
 
+		if acceptsNDJSON(r) {
+			streamHistory(ctx, w, wapi, walletID, params, toResponse)
+
+			return
+		}
+
 		var ts []btcount.HistoryStat
-		ts, err = wapi.FetchBalanceByHour(ctx, req.StartDatetime, req.EndDatetime)
+		ts, err = wapi.FetchBalanceHistory(ctx, walletID, params)
 		if err != nil {
 			respondError(ctx, w, err)
+
+			return
 		}
 
-		if ts == nil {
-			ts = []btcount.HistoryStat{}
+		resp := make([]interface{}, 0, len(ts))
+		for _, stat := range ts {
+			resp = append(resp, toResponse(stat))
 		}
 
-		asJSON(ctx, w, ts, http.StatusOK)
+		asJSON(ctx, w, resp, http.StatusOK)
 	})
 }
 
+// streamHistory writes stats to the response as soon as they are read
+// from the storage. Errors before the first stat are responded as usual,
+// while later ones abort the connection, so the client does not take the
+// truncated response for the complete one.
+func streamHistory(ctx context.Context, w http.ResponseWriter, wapi api.WalletAPI, walletID int64, params api.HistoryParams, toResponse func(btcount.HistoryStat) interface{}) {
+	stream := newNDJSONStream(w)
+	err := wapi.StreamBalanceHistory(ctx, walletID, params, func(stat btcount.HistoryStat) error {
+		return stream.Encode(toResponse(stat))
+	})
+	if err != nil && !stream.Started() {
+		respondError(ctx, w, err)
+
+		return
+	}
+
+	if err != nil {
+		btcontext.Logger(ctx).Warn("unable to stream history",
+			zap.Int("rows", stream.Rows()),
+			zap.Error(err),
+		)
+
+		panic(http.ErrAbortHandler)
+	}
+
+	stream.Close()
+}
+
 func getBalance(wapi api.WalletAPI) (h http.Handler) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		amount, err := wapi.GetCurrentBalance(ctx)
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		var at *time.Time
+		if v := r.URL.Query().Get("at"); v != "" {
+			var parsed time.Time
+			parsed, err = time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				respondError(ctx, w, fmt.Errorf("%w: at", btcount.ErrInvalidParameter))
+
+				return
+			}
+
+			at = &parsed
+		}
+
+		var amount btcount.Decimal
+		if at != nil {
+			amount, err = wapi.GetBalanceAt(ctx, walletID, *at)
+		} else {
+			amount, err = wapi.GetCurrentBalance(ctx, walletID)
+		}
 		if err != nil {
 			respondError(ctx, w, err)
 
@@ -106,12 +436,181 @@ func getBalance(wapi api.WalletAPI) (h http.Handler) {
 
 		resp := balanceResponse{
 			Balance: amount,
+			At:      at,
 		}
 
 		asJSON(ctx, w, resp, http.StatusOK)
 	})
 }
 
+type walletRequest struct {
+	Name string `json:"name" validate:"required,max=256"`
+}
+
+func (req walletRequest) ToWallet() btcount.Wallet {
+	return btcount.Wallet{
+		Name: req.Name,
+	}
+}
+
+func createWallet(wapi api.WalletAPI) (h http.Handler) {
+	validator := newValidator()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var req walletRequest
+		if !readRequestAsJSON(ctx, w, r, &req) {
+			return
+		}
+
+		err := validator.StructCtx(ctx, &req)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		wallet, err := wapi.CreateWallet(ctx, req.ToWallet())
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		asJSON(ctx, w, wallet, http.StatusCreated)
+	})
+}
+
+func listWallets(wapi api.WalletAPI) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		wallets, err := wapi.ListWallets(ctx)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		if wallets == nil {
+			wallets = []btcount.Wallet{}
+		}
+
+		asJSON(ctx, w, wallets, http.StatusOK)
+	})
+}
+
+func getWallet(wapi api.WalletAPI) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		wallet, err := wapi.GetWallet(ctx, walletID)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		asJSON(ctx, w, wallet, http.StatusOK)
+	})
+}
+
+func deleteWallet(wapi api.WalletAPI) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		err = wapi.DeleteWallet(ctx, walletID)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		asJSON(ctx, w, messageResponse{Message: "success"}, http.StatusOK)
+	})
+}
+
+type reconcileRequest struct {
+	Since   time.Time `json:"since"`
+	Till    time.Time `json:"till"`
+	Rewrite bool      `json:"rewrite"`
+}
+
+func reconcileStats(wapi api.WalletAPI) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var req reconcileRequest
+		if !readRequestAsJSON(ctx, w, r, &req) {
+			return
+		}
+
+		walletID, err := walletIDFromRequest(r)
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		report, err := wapi.ReconcileStats(ctx, walletID, api.ReconcileParams{
+			Since:   req.Since,
+			Till:    req.Till,
+			Rewrite: req.Rewrite,
+		})
+		if err != nil {
+			respondError(ctx, w, err)
+
+			return
+		}
+
+		resp := reconcileResponse{
+			Since:         report.Since,
+			Till:          report.Till,
+			Checked:       report.Checked,
+			Rewritten:     report.Rewritten,
+			Discrepancies: make([]statDiscrepancyResponse, 0, len(report.Discrepancies)),
+		}
+
+		for _, d := range report.Discrepancies {
+			discrepancy := statDiscrepancyResponse{Datetime: d.Datetime}
+			if d.Stored != nil {
+				stored := toCandleResponse(*d.Stored)
+				discrepancy.Stored = &stored
+			}
+
+			if d.Expected != nil {
+				expected := toCandleResponse(*d.Expected)
+				discrepancy.Expected = &expected
+			}
+
+			resp.Discrepancies = append(resp.Discrepancies, discrepancy)
+		}
+
+		asJSON(ctx, w, resp, http.StatusOK)
+	})
+}
+
+func getStatus(status Status) (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asJSON(r.Context(), w, status, http.StatusOK)
+	})
+}
+
 func rootHandler() (h http.Handler) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -1,16 +1,23 @@
 package bthttp
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/ferux/btcount/internal/api"
+	"github.com/ferux/btcount/internal/btcount"
 	"github.com/ferux/btcount/internal/bttest"
+	"github.com/ferux/btcount/internal/notify"
 	"go.uber.org/zap"
 )
 
@@ -38,13 +45,16 @@ func TestHistoryAPI(t *testing.T) {
 			assertNoError(t, errrun)
 		}
 	}()
+	waitListening(t, listenAddr)
 
 	var tt = []struct {
 		name    string
 		reqdata string
 		path    string
 		method  string
+		header  http.Header
 		expcode int
+		exptype string
 	}{{
 		name:    "empty request",
 		reqdata: `{}`,
@@ -75,6 +85,102 @@ func TestHistoryAPI(t *testing.T) {
 		path:    "/api/v1/wallet/history",
 		method:  http.MethodPost,
 		expcode: http.StatusOK,
+	}, {
+		name:    "daily granularity",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","granularity":"day"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusOK,
+	}, {
+		name:    "5 minutes granularity",
+		reqdata: `{"startDateTime":"2020-10-10T10:00:00+00:00","endDateTime":"2020-10-10T11:00:00+00:00","granularity":"5m"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusOK,
+	}, {
+		name:    "half-hour offset timezone",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+05:30","endDateTime":"2020-10-10T00:00:00+05:30","granularity":"day","timezone":"Asia/Kolkata"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusOK,
+	}, {
+		name:    "unknown timezone",
+		reqdata: `{"startDateTime":"2020-10-10T10:00:00+00:00","endDateTime":"2020-10-10T11:00:00+00:00","timezone":"Mars/Olympus_Mons"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "filled history",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","fill":"previous"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusOK,
+	}, {
+		name:    "filled history with too many points",
+		reqdata: `{"startDateTime":"2010-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","fill":"previous"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "unknown fill",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","fill":"linear"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "candles",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","granularity":"day"}`,
+		path:    "/api/v1/wallet/candles",
+		method:  http.MethodPost,
+		expcode: http.StatusOK,
+	}, {
+		name:    "candles of unknown wallet",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00"}`,
+		path:    "/api/v1/wallets/999999999/candles",
+		method:  http.MethodPost,
+		expcode: http.StatusNotFound,
+	}, {
+		name:    "empty candles request",
+		reqdata: `{}`,
+		path:    "/api/v1/wallet/candles",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "unknown granularity",
+		reqdata: `{"startDateTime":"2020-10-10T10:00:00+00:00","endDateTime":"2020-10-10T11:00:00+00:00","granularity":"fortnight"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "streamed history",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","fill":"previous"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		header:  http.Header{"Accept": {"application/x-ndjson"}},
+		expcode: http.StatusOK,
+		exptype: contentNDJSON,
+	}, {
+		name:    "streamed candles",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","granularity":"day"}`,
+		path:    "/api/v1/wallet/candles",
+		method:  http.MethodPost,
+		header:  http.Header{"Accept": {"application/json;q=0.5, application/x-ndjson"}},
+		expcode: http.StatusOK,
+		exptype: contentNDJSON,
+	}, {
+		name:    "streamed history with too many points",
+		reqdata: `{"startDateTime":"2010-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00","fill":"previous"}`,
+		path:    "/api/v1/wallet/history",
+		method:  http.MethodPost,
+		header:  http.Header{"Accept": {"application/x-ndjson"}},
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "streamed candles of unknown wallet",
+		reqdata: `{"startDateTime":"2020-10-01T00:00:00+00:00","endDateTime":"2020-10-10T00:00:00+00:00"}`,
+		path:    "/api/v1/wallets/999999999/candles",
+		method:  http.MethodPost,
+		header:  http.Header{"Accept": {"application/x-ndjson"}},
+		expcode: http.StatusNotFound,
 	}}
 
 	for _, tc := range tt {
@@ -86,6 +192,10 @@ func TestHistoryAPI(t *testing.T) {
 			req, err := http.NewRequestWithContext(ctx, tc.method, url, reqbody)
 			assertNoError(t, err)
 
+			for name, values := range tc.header {
+				req.Header[name] = values
+			}
+
 			resp, err := http.DefaultClient.Do(req)
 			assertNoError(t, err)
 
@@ -95,12 +205,19 @@ func TestHistoryAPI(t *testing.T) {
 			if resp.StatusCode != tc.expcode {
 				t.Errorf("exp code: %d, got code: %d", tc.expcode, resp.StatusCode)
 			}
+
+			if got := resp.Header.Get(contentType); tc.exptype != "" && got != tc.exptype {
+				t.Errorf("exp content type: %s, got: %s", tc.exptype, got)
+			}
 		})
 	}
 
 	errshutdown := srv.Shutdown(ctx)
 	assertNoError(t, errshutdown)
 	wg.Wait()
+
+	// Keep-alive connections to the stopped server are not reusable.
+	http.DefaultClient.CloseIdleConnections()
 }
 
 func TestTransactionAPI(t *testing.T) {
@@ -127,12 +244,18 @@ func TestTransactionAPI(t *testing.T) {
 			assertNoError(t, errrun)
 		}
 	}()
+	waitListening(t, listenAddr)
+
+	// The database is not cleaned between runs, so the key is unique
+	// per run.
+	key := fmt.Sprintf("test-%d", time.Now().UnixNano())
 
 	var tt = []struct {
 		name    string
 		reqdata string
 		path    string
 		method  string
+		header  http.Header
 		expcode int
 	}{{
 		name:    "empty request",
@@ -164,6 +287,119 @@ func TestTransactionAPI(t *testing.T) {
 		path:    "/api/v1/wallet/transaction",
 		method:  http.MethodPost,
 		expcode: http.StatusCreated,
+	}, {
+		name:    "unknown type",
+		reqdata: `{"amount": 0.1,"datetime": "2019-10-05T15:12:00+00:00","type":"refund"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "negative withdrawal",
+		reqdata: `{"amount": -0.1,"datetime": "2019-10-05T15:12:00+00:00","type":"withdrawal"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "withdrawal exceeds balance",
+		reqdata: `{"amount": 1000000000000,"datetime": "2019-10-05T15:13:00+00:00","type":"withdrawal"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "good withdrawal",
+		reqdata: `{"amount": 0.1,"datetime": "2019-10-05T15:14:00+00:00","type":"withdrawal"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusCreated,
+	}, {
+		name:    "idempotent transaction",
+		reqdata: `{"amount": 0.1,"datetime": "2019-10-05T15:15:00+00:00"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		header:  http.Header{idempotencyKeyHeader: {key}},
+		expcode: http.StatusCreated,
+	}, {
+		name:    "replayed transaction",
+		reqdata: `{"amount": "0.10","datetime": "2019-10-05T15:15:00+00:00","externalId":"` + key + `"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusCreated,
+	}, {
+		name:    "idempotency key with another payload",
+		reqdata: `{"amount": 0.2,"datetime": "2019-10-05T15:15:00+00:00"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		header:  http.Header{idempotencyKeyHeader: {key}},
+		expcode: http.StatusConflict,
+	}, {
+		name:    "idempotency key of deposit for withdrawal",
+		reqdata: `{"amount": 0.1,"datetime": "2019-10-05T15:15:00+00:00","type":"withdrawal"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		header:  http.Header{idempotencyKeyHeader: {key}},
+		expcode: http.StatusConflict,
+	}, {
+		name:    "header differs from external id",
+		reqdata: `{"amount": 0.1,"datetime": "2019-10-05T15:15:00+00:00","externalId":"other"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		header:  http.Header{idempotencyKeyHeader: {key}},
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "future transaction",
+		reqdata: `{"amount": 0.1,"datetime": "2999-10-05T15:12:00+00:00"}`,
+		path:    "/api/v1/wallet/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "batch",
+		reqdata: `[{"amount": 0.1,"datetime": "2019-10-05T16:00:00+00:00"},{"amount": 0,"datetime": "2019-10-05T16:00:00+00:00"}]`,
+		path:    "/api/v1/wallet/transactions:batch",
+		method:  http.MethodPost,
+		expcode: http.StatusOK,
+	}, {
+		name:    "batch of ndjson",
+		reqdata: "{\"amount\": 0.1,\"datetime\": \"2019-10-05T16:00:00+00:00\"}\n{\"amount\": \n",
+		path:    "/api/v1/wallet/transactions:batch",
+		method:  http.MethodPost,
+		expcode: http.StatusOK,
+	}, {
+		name:    "malformed batch",
+		reqdata: `[{"amount": 0.1,"datetime": "2019-10-05T16:00:00+00:00"}`,
+		path:    "/api/v1/wallet/transactions:batch",
+		method:  http.MethodPost,
+		expcode: http.StatusBadRequest,
+	}, {
+		name:    "batch to unknown wallet",
+		reqdata: `[]`,
+		path:    "/api/v1/wallets/9223372036854775807/transactions:batch",
+		method:  http.MethodPost,
+		expcode: http.StatusNotFound,
+	}, {
+		name:    "list transactions",
+		path:    "/api/v1/wallet/transactions?since=2019-10-05T00:00:00Z&till=2019-10-06T00:00:00Z&minAmount=-1&maxAmount=1&order=desc&limit=2",
+		method:  http.MethodGet,
+		expcode: http.StatusOK,
+	}, {
+		name:    "list transactions with unknown order",
+		path:    "/api/v1/wallet/transactions?order=random",
+		method:  http.MethodGet,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "list transactions with bad cursor",
+		path:    "/api/v1/wallet/transactions?cursor=bad",
+		method:  http.MethodGet,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "list transactions with too big limit",
+		path:    "/api/v1/wallet/transactions?limit=100000",
+		method:  http.MethodGet,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "unknown transaction",
+		path:    "/api/v1/wallet/transactions/999999999",
+		method:  http.MethodGet,
+		expcode: http.StatusNotFound,
 	}}
 
 	for _, tc := range tt {
@@ -175,6 +411,10 @@ func TestTransactionAPI(t *testing.T) {
 			req, err := http.NewRequestWithContext(ctx, tc.method, url, reqbody)
 			assertNoError(t, err)
 
+			for name, values := range tc.header {
+				req.Header[name] = values
+			}
+
 			resp, err := http.DefaultClient.Do(req)
 			assertNoError(t, err)
 
@@ -190,6 +430,457 @@ func TestTransactionAPI(t *testing.T) {
 	errshutdown := srv.Shutdown(ctx)
 	assertNoError(t, errshutdown)
 	wg.Wait()
+
+	// Keep-alive connections to the stopped server are not reusable.
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func TestWalletAPI(t *testing.T) {
+	const timeout = time.Second * 10
+	const listenAddr = "localhost:34343"
+
+	log := zap.NewNop()
+
+	srv := NewServer(Config{
+		WriteTimeout: timeout,
+		ReadTimeout:  timeout,
+		IdleTimeout:  timeout,
+	}, log)
+
+	ctx := bttest.GetContext()
+	wapi := bttest.GetWalletAPI()
+	srv.MountWalletAPI(wapi)
+	srv.MountStatus(Status{Revision: "test", Storage: "memory"})
+	srv.MountAdmin(wapi, "secret")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errrun := srv.Run(ctx, listenAddr)
+		if !errors.Is(errrun, http.ErrServerClosed) {
+			assertNoError(t, errrun)
+		}
+	}()
+	waitListening(t, listenAddr)
+
+	var tt = []struct {
+		name    string
+		reqdata string
+		path    string
+		method  string
+		header  http.Header
+		expcode int
+	}{{
+		name:    "empty name",
+		reqdata: `{}`,
+		path:    "/api/v1/wallets",
+		method:  http.MethodPost,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "bad json",
+		reqdata: `{"name: "test"}`,
+		path:    "/api/v1/wallets",
+		method:  http.MethodPost,
+		expcode: http.StatusBadRequest,
+	}, {
+		name:    "good data",
+		reqdata: `{"name": "savings"}`,
+		path:    "/api/v1/wallets",
+		method:  http.MethodPost,
+		expcode: http.StatusCreated,
+	}, {
+		name:    "status",
+		path:    "/status",
+		method:  http.MethodGet,
+		expcode: http.StatusOK,
+	}, {
+		name:    "list wallets",
+		path:    "/api/v1/wallets",
+		method:  http.MethodGet,
+		expcode: http.StatusOK,
+	}, {
+		name:    "default wallet",
+		path:    "/api/v1/wallets/1",
+		method:  http.MethodGet,
+		expcode: http.StatusOK,
+	}, {
+		name:    "unknown wallet",
+		path:    "/api/v1/wallets/9223372036854775807",
+		method:  http.MethodGet,
+		expcode: http.StatusNotFound,
+	}, {
+		name:    "delete default wallet",
+		path:    "/api/v1/wallets/1",
+		method:  http.MethodDelete,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "delete unknown wallet",
+		path:    "/api/v1/wallets/9223372036854775807",
+		method:  http.MethodDelete,
+		expcode: http.StatusNotFound,
+	}, {
+		name:    "transaction to unknown wallet",
+		reqdata: `{"amount": 0.1,"datetime": "2019-10-05T15:12:00+00:00"}`,
+		path:    "/api/v1/wallets/9223372036854775807/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusNotFound,
+	}, {
+		name:    "transaction to default wallet",
+		reqdata: `{"amount": 0.1,"datetime": "2019-10-05T15:12:00+00:00"}`,
+		path:    "/api/v1/wallets/1/transaction",
+		method:  http.MethodPost,
+		expcode: http.StatusCreated,
+	}, {
+		name:    "balance of default wallet",
+		path:    "/api/v1/wallets/1/balance",
+		method:  http.MethodGet,
+		expcode: http.StatusOK,
+	}, {
+		name:    "balance at the moment",
+		path:    "/api/v1/wallets/1/balance?at=2019-10-05T15:12:00Z",
+		method:  http.MethodGet,
+		expcode: http.StatusOK,
+	}, {
+		name:    "balance at bad moment",
+		path:    "/api/v1/wallets/1/balance?at=yesterday",
+		method:  http.MethodGet,
+		expcode: http.StatusUnprocessableEntity,
+	}, {
+		name:    "reconcile without token",
+		reqdata: `{"since": "2019-10-05T00:00:00Z"}`,
+		path:    "/admin/v1/wallets/1/stats:reconcile",
+		method:  http.MethodPost,
+		expcode: http.StatusUnauthorized,
+	}, {
+		name:    "reconcile with bad token",
+		reqdata: `{"since": "2019-10-05T00:00:00Z"}`,
+		path:    "/admin/v1/wallets/1/stats:reconcile",
+		method:  http.MethodPost,
+		header:  http.Header{"Authorization": {"Bearer secre"}},
+		expcode: http.StatusUnauthorized,
+	}, {
+		name:    "reconcile with token without scheme",
+		reqdata: `{"since": "2019-10-05T00:00:00Z"}`,
+		path:    "/admin/v1/wallets/1/stats:reconcile",
+		method:  http.MethodPost,
+		header:  http.Header{"Authorization": {"secret"}},
+		expcode: http.StatusUnauthorized,
+	}, {
+		name:    "reconcile with lowercase scheme",
+		reqdata: `{"since": "2019-10-05T00:00:00Z"}`,
+		path:    "/admin/v1/wallets/1/stats:reconcile",
+		method:  http.MethodPost,
+		header:  http.Header{"Authorization": {"bearer secret"}},
+		expcode: http.StatusOK,
+	}, {
+		name:    "reconcile",
+		reqdata: `{"since": "2019-10-05T00:00:00Z", "rewrite": true}`,
+		path:    "/admin/v1/wallets/1/stats:reconcile",
+		method:  http.MethodPost,
+		header:  http.Header{"Authorization": {"Bearer secret"}},
+		expcode: http.StatusOK,
+	}, {
+		name:    "reconcile unknown wallet",
+		reqdata: `{"since": "2019-10-05T00:00:00Z"}`,
+		path:    "/admin/v1/wallets/9223372036854775807/stats:reconcile",
+		method:  http.MethodPost,
+		header:  http.Header{"Authorization": {"Bearer secret"}},
+		expcode: http.StatusNotFound,
+	}, {
+		name:    "reconcile since after till",
+		reqdata: `{"since": "2019-10-06T00:00:00Z", "till": "2019-10-05T00:00:00Z"}`,
+		path:    "/admin/v1/wallets/1/stats:reconcile",
+		method:  http.MethodPost,
+		header:  http.Header{"Authorization": {"Bearer secret"}},
+		expcode: http.StatusUnprocessableEntity,
+	}}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reqbody := bytes.NewReader([]byte(tc.reqdata))
+			url := fmt.Sprintf("http://%s%s", listenAddr, tc.path)
+
+			req, err := http.NewRequestWithContext(ctx, tc.method, url, reqbody)
+			assertNoError(t, err)
+
+			for name, values := range tc.header {
+				req.Header[name] = values
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			assertNoError(t, err)
+
+			_, err = io.Copy(io.Discard, resp.Body)
+			assertNoError(t, err)
+
+			if resp.StatusCode != tc.expcode {
+				t.Errorf("exp code: %d, got code: %d", tc.expcode, resp.StatusCode)
+			}
+		})
+	}
+
+	errshutdown := srv.Shutdown(ctx)
+	assertNoError(t, errshutdown)
+	wg.Wait()
+
+	// Keep-alive connections to the stopped server are not reusable.
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func TestReadBatchRequest(t *testing.T) {
+	var tt = []struct {
+		name    string
+		body    string
+		expRows int
+		expErrs int
+		err     bool
+	}{
+		{name: "empty", body: " \n"},
+		{name: "empty array", body: `[]`},
+		{name: "array", body: ` [{"amount": 1, "datetime": "2021-01-01T00:00:00Z"}, {"amount": "x"}]`, expRows: 2, expErrs: 1},
+		{name: "malformed array", body: `[{"amount": 1}`, err: true},
+		{name: "ndjson", body: "{\"amount\": 1}\n\n{\"amount\":\n{\"amount\": 2}", expRows: 3, expErrs: 1},
+	}
+
+	for _, tc := range tt {
+		rows, err := readBatchRequest(bytes.NewReader([]byte(tc.body)))
+		if (err != nil) != tc.err {
+			t.Errorf("%s: exp error: %t, got: %v", tc.name, tc.err, err)
+
+			continue
+		}
+
+		var errs int
+		for _, row := range rows {
+			if row.err != nil {
+				errs++
+			}
+		}
+
+		if len(rows) != tc.expRows || errs != tc.expErrs {
+			t.Errorf("%s: exp rows: %d with errors: %d, got: %d with errors: %d", tc.name, tc.expRows, tc.expErrs, len(rows), errs)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	// Streams outlive the timeouts of the server.
+	const timeout = time.Millisecond * 300
+	const listenAddr = "localhost:34343"
+
+	log := zap.NewNop()
+
+	srv := NewServer(Config{
+		WriteTimeout: timeout,
+		ReadTimeout:  timeout,
+		IdleTimeout:  timeout,
+	}, log)
+
+	ctx := bttest.GetContext()
+	broker := notify.NewBroker(16)
+	wapi := api.NewWalletAPI(api.WalletAPIParams{
+		Store:            bttest.GetStore(),
+		AmountScale:      btcount.DefaultAmountScale,
+		HistoryMaxPoints: 1000,
+		Events:           broker,
+	})
+
+	invalid := []EventsConfig{
+		{Heartbeat: time.Millisecond * 50},
+		{Heartbeat: -time.Millisecond, Buffer: 4},
+		{Heartbeat: timeout, Buffer: 4},
+	}
+	for _, cfg := range invalid {
+		err := srv.MountEvents(wapi, broker, cfg)
+		if !errors.Is(err, btcount.ErrInvalidParameter) {
+			t.Errorf("config %+v: exp error: %v, got: %v", cfg, btcount.ErrInvalidParameter, err)
+		}
+	}
+
+	err := srv.MountEvents(wapi, broker, EventsConfig{
+		Heartbeat: time.Millisecond * 50,
+		Buffer:    4,
+	})
+	assertNoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errrun := srv.Run(ctx, listenAddr)
+		if !errors.Is(errrun, http.ErrServerClosed) {
+			assertNoError(t, errrun)
+		}
+	}()
+	waitListening(t, listenAddr)
+
+	subscribe := func(path, lastEventID string) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+listenAddr+path, nil)
+		assertNoError(t, err)
+
+		if lastEventID != "" {
+			req.Header.Set(lastEventIDHeader, lastEventID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assertNoError(t, err)
+
+		return resp
+	}
+
+	createTransaction := func() {
+		_, err := wapi.CreateTransaction(ctx, btcount.DefaultWalletID, btcount.Transaction{
+			Amount:   btcount.DecimalFromFloat(0.5),
+			Datetime: time.Now().Add(-time.Minute),
+		})
+		assertNoError(t, err)
+	}
+
+	resp := subscribe("/api/v1/wallets/999999999/events", "")
+	assertNoError(t, resp.Body.Close())
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("exp code: %d, got code: %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	resp = subscribe("/api/v1/wallet/events", "")
+	if got := resp.Header.Get(contentType); got != contentEventStream {
+		t.Fatalf("exp content type: %s, got: %s", contentEventStream, got)
+	}
+
+	events := bufio.NewReader(resp.Body)
+	if _, name, _ := readEvent(t, events); name != eventBalance {
+		t.Fatalf("exp the first event: %s, got: %s", eventBalance, name)
+	}
+
+	time.Sleep(timeout * 2)
+	createTransaction()
+
+	id, name, data := readEvent(t, events)
+	if id == "" || name != string(notify.KindTransaction) || !strings.Contains(data, `"balance"`) {
+		t.Fatalf("exp transaction event with id and balance, got: %s %s %s", id, name, data)
+	}
+
+	assertNoError(t, resp.Body.Close())
+
+	// The transaction made while disconnected is resumed instead of
+	// sending the balance. Another subscriber keeps it from being skipped.
+	other, _, _ := broker.Subscribe(btcount.DefaultWalletID, "", 16)
+	defer broker.Unsubscribe(other)
+
+	createTransaction()
+
+	resp = subscribe("/api/v1/wallet/events", id)
+	events = bufio.NewReader(resp.Body)
+	if resumedID, name, _ := readEvent(t, events); resumedID == id || name != string(notify.KindTransaction) {
+		t.Fatalf("exp the missed transaction event, got: %s %s", resumedID, name)
+	}
+
+	// The open stream ends on shutdown.
+	errshutdown := srv.Shutdown(ctx)
+	assertNoError(t, errshutdown)
+	wg.Wait()
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	assertNoError(t, err)
+	assertNoError(t, resp.Body.Close())
+
+	// Keep-alive connections to the stopped server are not reusable.
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func TestReadBatchRequestTooLarge(t *testing.T) {
+	const limit = 32
+
+	var tt = []struct {
+		name string
+		body string
+		err  error
+	}{
+		{name: "within the limit", body: `[{"amount": 1, "datetime": ""}]`},
+		{name: "large array element", body: `[{"amount": 1, "datetime": "2021-01-01T00:00:00Z"}]`, err: errBatchTooLarge},
+		{name: "large ndjson", body: "{\"amount\": 1}\n{\"amount\": 2}\n{\"amount\": 3}\n", err: errBatchTooLarge},
+	}
+
+	for _, tc := range tt {
+		body := io.NopCloser(strings.NewReader(tc.body))
+		_, err := readBatchRequest(limitBatchBody(httptest.NewRecorder(), body, limit))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: exp error: %v, got: %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestRespondNotFound(t *testing.T) {
+	ctx := bttest.GetContext()
+	err := fmt.Errorf("loading wallet: %w", btcount.ErrNotFound)
+
+	var tt = []struct {
+		name    string
+		byPath  bool
+		expcode int
+	}{
+		{name: "route without ids", expcode: http.StatusUnprocessableEntity},
+		{name: "route with ids", byPath: true, expcode: http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		reqctx := ctx
+		if tc.byPath {
+			reqctx = withPathIDs(ctx)
+		}
+
+		w := httptest.NewRecorder()
+		respondError(reqctx, w, err)
+
+		if w.Code != tc.expcode {
+			t.Errorf("%s: exp code: %d, got code: %d", tc.name, tc.expcode, w.Code)
+		}
+	}
+}
+
+// readEvent reads the next named event skipping comments and fields
+// without events.
+func readEvent(t *testing.T, r *bufio.Reader) (id, name, data string) {
+	t.Helper()
+
+	for {
+		line, err := r.ReadString('\n')
+		assertNoError(t, err)
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return id, name, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// waitListening waits until the server starts accepting connections.
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			assertNoError(t, conn.Close())
+
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
 }
 
 func assertNoError(t *testing.T, err error) {
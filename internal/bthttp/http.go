@@ -5,12 +5,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ferux/btcount/internal/btcontext"
 	"github.com/ferux/btcount/internal/btcount"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
@@ -20,8 +26,14 @@ const (
 )
 
 const (
-	contentJSON = "application/json"
-	serverName  = "btcount-http-server/1.0"
+	walletIDVar      = "walletID"
+	transactionIDVar = "transactionID"
+)
+
+const (
+	contentJSON   = "application/json"
+	contentNDJSON = "application/x-ndjson"
+	serverName    = "btcount-http-server/1.0"
 )
 
 // messageResponse is a model of any response.
@@ -31,6 +43,83 @@ type messageResponse struct {
 
 type balanceResponse struct {
 	Balance btcount.Decimal `json:"balance"`
+	// At is set if the balance is requested at the moment.
+	At *time.Time `json:"at,omitempty"`
+}
+
+type transactionResponse struct {
+	Message     string              `json:"message"`
+	Transaction btcount.Transaction `json:"transaction"`
+}
+
+// Statuses of transactions of the batch.
+const (
+	batchStatusCreated  = "created"
+	batchStatusReplayed = "replayed"
+	batchStatusFailed   = "failed"
+)
+
+type batchResultResponse struct {
+	Index       int                  `json:"index"`
+	Status      string               `json:"status"`
+	Transaction *btcount.Transaction `json:"transaction,omitempty"`
+	Error       string               `json:"error,omitempty"`
+	Meta        []validationError    `json:"meta,omitempty"`
+}
+
+type batchResponse struct {
+	Created  int                   `json:"created"`
+	Replayed int                   `json:"replayed"`
+	Failed   int                   `json:"failed"`
+	Results  []batchResultResponse `json:"results"`
+}
+
+type transactionListResponse struct {
+	Transactions []btcount.Transaction `json:"transactions"`
+	NextCursor   string                `json:"nextCursor,omitempty"`
+}
+
+type historyStatResponse struct {
+	Datetime time.Time       `json:"Datetime"`
+	Amount   btcount.Decimal `json:"Amount"`
+}
+
+type candleResponse struct {
+	Datetime time.Time       `json:"datetime"`
+	Open     btcount.Decimal `json:"open"`
+	High     btcount.Decimal `json:"high"`
+	Low      btcount.Decimal `json:"low"`
+	Close    btcount.Decimal `json:"close"`
+	Inflow   btcount.Decimal `json:"inflow"`
+	Outflow  btcount.Decimal `json:"outflow"`
+	Count    int64           `json:"count"`
+}
+
+func toCandleResponse(stat btcount.HistoryStat) candleResponse {
+	return candleResponse{
+		Datetime: stat.Datetime,
+		Open:     stat.Open,
+		High:     stat.High,
+		Low:      stat.Low,
+		Close:    stat.Amount,
+		Inflow:   stat.Inflow,
+		Outflow:  stat.Outflow,
+		Count:    stat.Count,
+	}
+}
+
+type statDiscrepancyResponse struct {
+	Datetime time.Time       `json:"datetime"`
+	Stored   *candleResponse `json:"stored"`
+	Expected *candleResponse `json:"expected"`
+}
+
+type reconcileResponse struct {
+	Since         time.Time                 `json:"since"`
+	Till          time.Time                 `json:"till"`
+	Checked       int                       `json:"checked"`
+	Rewritten     bool                      `json:"rewritten"`
+	Discrepancies []statDiscrepancyResponse `json:"discrepancies"`
 }
 
 // asJSON marshals data into JSON, setups proper headers and responds.
@@ -46,6 +135,91 @@ func asJSON(ctx context.Context, w http.ResponseWriter, data interface{}, code i
 
 }
 
+// streamFlushRows is the amount of rows of the stream sent to the client
+// at once.
+const streamFlushRows = 1000
+
+// ndjsonStream writes values to the response as NDJSON, i.e. one JSON
+// value per line, flushing them every streamFlushRows rows. The status
+// and the headers are sent with the first row.
+type ndjsonStream struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	started bool
+	rows    int
+}
+
+func newNDJSONStream(w http.ResponseWriter) *ndjsonStream {
+	return &ndjsonStream{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+// Encode writes the value as a line of the stream.
+func (s *ndjsonStream) Encode(v interface{}) (err error) {
+	s.start()
+
+	err = s.enc.Encode(v)
+	if err != nil {
+		return fmt.Errorf("writing row: %w", err)
+	}
+
+	s.rows++
+	if s.rows%streamFlushRows == 0 {
+		s.flush()
+	}
+
+	return nil
+}
+
+// Started reports whether the status is sent already.
+func (s *ndjsonStream) Started() bool {
+	return s.started
+}
+
+// Rows returns the amount of written rows.
+func (s *ndjsonStream) Rows() int {
+	return s.rows
+}
+
+// Close sends the status if the stream is empty and flushes the rest of
+// rows.
+func (s *ndjsonStream) Close() {
+	s.start()
+	s.flush()
+}
+
+func (s *ndjsonStream) start() {
+	if s.started {
+		return
+	}
+
+	s.started = true
+	s.w.Header().Set(contentType, contentNDJSON)
+	s.w.WriteHeader(http.StatusOK)
+}
+
+func (s *ndjsonStream) flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// acceptsNDJSON reports whether the client accepts NDJSON response.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(value, ",") {
+			parsed, _, err := mime.ParseMediaType(mediaType)
+			if err == nil && parsed == contentNDJSON {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 type validatonErrorMessage struct {
 	Message string            `json:"message"`
 	Meta    []validationError `json:"meta"`
@@ -78,6 +252,67 @@ func readRequestAsJSON(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	return true
 }
 
+// newValidator creates a validator aware of domain types. Decimals are
+// validated by their string representation and treated as empty when
+// equal to zero.
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		d, ok := field.Interface().(btcount.Decimal)
+		if !ok || d.IsZero() {
+			return nil
+		}
+
+		return d.String()
+	}, btcount.Decimal{})
+
+	return v
+}
+
+// walletIDFromRequest extracts the wallet id from the path. Routes
+// without the wallet id are served by the default wallet.
+func walletIDFromRequest(r *http.Request) (walletID int64, err error) {
+	raw, ok := mux.Vars(r)[walletIDVar]
+	if !ok {
+		return btcount.DefaultWalletID, nil
+	}
+
+	walletID, err = strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", btcount.ErrInvalidParameter, "wallet id")
+	}
+
+	return walletID, nil
+}
+
+// transactionIDFromRequest extracts the transaction id from the path.
+func transactionIDFromRequest(r *http.Request) (transactionID int64, err error) {
+	transactionID, err = strconv.ParseInt(mux.Vars(r)[transactionIDVar], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", btcount.ErrInvalidParameter, "transaction id")
+	}
+
+	return transactionID, nil
+}
+
+type pathIDsKeyCtx struct{}
+
+// withPathIDs marks the request addressing resources by ids in the path.
+func withPathIDs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pathIDsKeyCtx{}, true)
+}
+
+// notFoundCode returns the status of the missing resource. Resources
+// addressed by ids in the path are not found, while the other routes keep
+// responding with 422 as they always did.
+func notFoundCode(ctx context.Context) int {
+	if byPath, _ := ctx.Value(pathIDsKeyCtx{}).(bool); byPath {
+		return http.StatusNotFound
+	}
+
+	return http.StatusUnprocessableEntity
+}
+
 func respondError(ctx context.Context, w http.ResponseWriter, err error) {
 	var verrs validator.ValidationErrors
 	if errors.As(err, &verrs) {
@@ -93,7 +328,12 @@ func respondError(ctx context.Context, w http.ResponseWriter, err error) {
 		errors.Is(err, btcount.ErrNegativeValue):
 		code = http.StatusUnprocessableEntity
 	case errors.Is(err, btcount.ErrNotFound):
-		code = http.StatusUnprocessableEntity
+		code = notFoundCode(ctx)
+	case errors.Is(err, btcount.ErrUnauthorized):
+		code = http.StatusUnauthorized
+	case errors.Is(err, btcount.ErrConflict),
+		errors.Is(err, btcount.ErrAlreadyExists):
+		code = http.StatusConflict
 	default:
 		code = http.StatusInternalServerError
 	}
@@ -1,11 +1,16 @@
 package bthttp
 
 import (
+	"crypto/subtle"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/ferux/btcount/internal/btcontext"
+	"github.com/ferux/btcount/internal/btcount"
 
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
@@ -25,6 +30,21 @@ func middlewareRequestID(next http.Handler) http.Handler {
 	})
 }
 
+// middlewarePathIDs marks requests addressing wallets or transactions by
+// ids in the path, so missing ones are responded with 404.
+func middlewarePathIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		_, byWallet := vars[walletIDVar]
+		_, byTransaction := vars[transactionIDVar]
+		if byWallet || byTransaction {
+			r = r.WithContext(withPathIDs(r.Context()))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func middlewareLogging(log *zap.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -69,6 +89,14 @@ func (w *wrappedWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Flush implements http.Flusher if the wrapped writer does, so streamed
+// responses are not buffered.
+func (w *wrappedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func middlewareServer(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(w, r)
@@ -76,3 +104,32 @@ func middlewareServer(next http.Handler) http.Handler {
 		w.Header().Set(serverHeader, serverName)
 	})
 }
+
+// middlewareAdmin authorizes requests by the bearer token.
+func middlewareAdmin(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := bearerToken(r.Header.Get("Authorization"))
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				respondError(r.Context(), w, fmt.Errorf("%w: admin token is required", btcount.ErrUnauthorized))
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bearerScheme is the authorization scheme of admin tokens.
+const bearerScheme = "Bearer "
+
+// bearerToken extracts the token of the bearer authorization. The scheme
+// is case-insensitive.
+func bearerToken(authorization string) (token string, ok bool) {
+	if len(authorization) <= len(bearerScheme) || !strings.EqualFold(authorization[:len(bearerScheme)], bearerScheme) {
+		return "", false
+	}
+
+	return authorization[len(bearerScheme):], true
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"expvar"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"sync"
 	"time"
 
 	"github.com/ferux/btcount/internal/api"
 	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/notify"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
@@ -21,9 +24,22 @@ type Config struct {
 	IdleTimeout  time.Duration
 }
 
+// Status describes the running app.
+type Status struct {
+	Revision string `json:"revision"`
+	Storage  string `json:"storage"`
+	// SchemaVersion is the version of the database schema checked on
+	// startup. It is omitted for storages without the schema.
+	SchemaVersion int64 `json:"schemaVersion,omitempty"`
+}
+
 type Server struct {
 	mux        *mux.Router
 	httpserver *http.Server
+
+	// closing is closed on shutdown, so long-lived responses end and
+	// their connections become idle.
+	closing chan struct{}
 }
 
 // NewServer creates a new server.
@@ -33,6 +49,7 @@ func NewServer(cfg Config, log *zap.Logger) *Server {
 		middlewareRequestID,
 		middlewareServer,
 		middlewareLogging(log),
+		middlewarePathIDs,
 	)
 
 	mux.NotFoundHandler = rootHandler()
@@ -41,29 +58,165 @@ func NewServer(cfg Config, log *zap.Logger) *Server {
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
 		IdleTimeout:  cfg.IdleTimeout,
+		ConnContext:  contextWithConn,
 	}
 
 	srv := &Server{
 		mux:        mux,
 		httpserver: httpserver,
+		closing:    make(chan struct{}),
 	}
 
+	var once sync.Once
+	httpserver.RegisterOnShutdown(func() {
+		once.Do(func() { close(srv.closing) })
+	})
+
 	return srv
 }
 
 // MountWalletAPI mounts wallet API for handling requests related to
-// the wallet.
+// the wallet. Routes under /wallet are served by the default wallet
+// while routes under /wallets/{id} are served by the requested one.
 func (srv *Server) MountWalletAPI(wapi api.WalletAPI) {
 	v1 := srv.mux.PathPrefix("/api/v1").Subrouter()
 
-	v1.Handle("/wallet/transaction", saveTransaction(wapi)).
+	v1.Handle("/wallets", createWallet(wapi)).
 		Methods(http.MethodPost)
 
-	v1.Handle("/wallet/history", getHistory(wapi)).
+	v1.Handle("/wallets", listWallets(wapi)).
+		Methods(http.MethodGet)
+
+	v1.Handle("/wallets/{"+walletIDVar+":[0-9]+}", getWallet(wapi)).
+		Methods(http.MethodGet)
+
+	v1.Handle("/wallets/{"+walletIDVar+":[0-9]+}", deleteWallet(wapi)).
+		Methods(http.MethodDelete)
+
+	mountWalletRoutes(v1.PathPrefix("/wallet").Subrouter(), wapi)
+	mountWalletRoutes(v1.PathPrefix("/wallets/{"+walletIDVar+":[0-9]+}").Subrouter(), wapi)
+}
+
+func mountWalletRoutes(router *mux.Router, wapi api.WalletAPI) {
+	router.Handle("/transaction", saveTransaction(wapi)).
 		Methods(http.MethodPost)
 
-	v1.Handle("/wallet/balance", getBalance(wapi)).
+	router.Handle("/transactions:batch", saveTransactions(wapi)).
+		Methods(http.MethodPost)
+
+	router.Handle("/transactions", listTransactions(wapi)).
+		Methods(http.MethodGet)
+
+	router.Handle("/transactions/{"+transactionIDVar+":[0-9]+}", getTransaction(wapi)).
 		Methods(http.MethodGet)
+
+	router.Handle("/history", getHistory(wapi)).
+		Methods(http.MethodPost)
+
+	router.Handle("/candles", getCandles(wapi)).
+		Methods(http.MethodPost)
+
+	router.Handle("/balance", getBalance(wapi)).
+		Methods(http.MethodGet)
+}
+
+// EventsConfig defines streams of events.
+type EventsConfig struct {
+	// Heartbeat is the interval of comments sent to idle streams, so
+	// proxies do not close them. It is derived from the timeouts of the
+	// server if it is not set.
+	Heartbeat time.Duration
+	// Buffer is the amount of events kept for a slow client. The stream
+	// is closed once the client falls behind by more, so it reconnects
+	// and resumes.
+	Buffer int
+}
+
+// defaultHeartbeat is the heartbeat of streams if the server has no
+// timeouts.
+const defaultHeartbeat = time.Second * 15
+
+// MountEvents mounts streams of events of wallets published to the
+// broker. Streams are not limited by the timeouts of the server: the read
+// deadline is removed and every write gets the write timeout on its own.
+// If the deadlines of the connection can not be changed, streams end
+// before the timeouts, so clients reconnect and resume instead of being
+// cut off.
+func (srv *Server) MountEvents(wapi api.WalletAPI, broker *notify.Broker, cfg EventsConfig) (err error) {
+	if cfg.Buffer < 1 {
+		return fmt.Errorf("%w: events buffer should be positive", btcount.ErrInvalidParameter)
+	}
+
+	writeTimeout := srv.httpserver.WriteTimeout
+	lifetime := minTimeout(srv.httpserver.ReadTimeout, writeTimeout) * 9 / 10
+
+	switch {
+	case cfg.Heartbeat < 0:
+		return fmt.Errorf("%w: events heartbeat should not be negative", btcount.ErrInvalidParameter)
+	case cfg.Heartbeat == 0 && lifetime > 0:
+		cfg.Heartbeat = minTimeout(defaultHeartbeat, lifetime/3)
+	case cfg.Heartbeat == 0:
+		cfg.Heartbeat = defaultHeartbeat
+	case lifetime > 0 && cfg.Heartbeat >= lifetime:
+		return fmt.Errorf("%w: events heartbeat %s should be shorter than %s limited by the server timeouts",
+			btcount.ErrInvalidParameter, cfg.Heartbeat, lifetime)
+	}
+
+	handler := streamEvents(wapi, broker, cfg, writeTimeout, lifetime, srv.closing)
+
+	v1 := srv.mux.PathPrefix("/api/v1").Subrouter()
+
+	v1.Handle("/wallet/events", handler).
+		Methods(http.MethodGet)
+
+	v1.Handle("/wallets/{"+walletIDVar+":[0-9]+}/events", handler).
+		Methods(http.MethodGet)
+
+	return nil
+}
+
+// minTimeout returns the shortest of the set timeouts or zero if none is
+// set.
+func minTimeout(a, b time.Duration) time.Duration {
+	if a <= 0 || b > 0 && b < a {
+		return b
+	}
+
+	return a
+}
+
+type connKeyCtx struct{}
+
+// contextWithConn keeps the connection in the context of its requests, so
+// long-lived responses manage deadlines of the connection.
+func contextWithConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKeyCtx{}, conn)
+}
+
+// connFromContext returns the connection of the request.
+func connFromContext(ctx context.Context) (conn net.Conn, ok bool) {
+	conn, ok = ctx.Value(connKeyCtx{}).(net.Conn)
+
+	return conn, ok
+}
+
+// MountAdmin mounts admin handlers authorized by the bearer token.
+// Nothing is mounted if the token is empty.
+func (srv *Server) MountAdmin(wapi api.WalletAPI, token string) {
+	if token == "" {
+		return
+	}
+
+	admin := srv.mux.PathPrefix("/admin/v1").Subrouter()
+	admin.Use(middlewareAdmin(token))
+
+	admin.Handle("/wallets/{"+walletIDVar+":[0-9]+}/stats:reconcile", reconcileStats(wapi)).
+		Methods(http.MethodPost)
+}
+
+// MountStatus mounts the handler describing the running app.
+func (srv *Server) MountStatus(status Status) {
+	srv.mux.Handle("/status", getStatus(status)).Methods(http.MethodGet)
 }
 
 // MountDebug mounts debug related handlers.
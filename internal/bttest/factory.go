@@ -10,6 +10,7 @@ import (
 
 func NewTransaction() btcount.Transaction {
 	return btcount.Transaction{
+		WalletID: btcount.DefaultWalletID,
 		Amount:   btcount.DecimalFromFloat(rand.Float64()),
 		Datetime: time.Now(),
 	}
@@ -17,18 +18,14 @@ func NewTransaction() btcount.Transaction {
 
 func MustInsertTransaction(t *testing.T, transaction btcount.Transaction) {
 	ctx := GetContext()
-	db := GetDB()
-	store := GetTStore()
 
-	err := store.Save(ctx, db, transaction)
+	_, err := GetRepos().Transactions.Save(ctx, transaction)
 	must(t, err)
 }
 
 func MustInsertHistoryStat(t *testing.T, stat btcount.HistoryStat) {
 	ctx := GetContext()
-	db := GetDB()
-	store := GetHStore()
 
-	err := store.Save(ctx, db, stat)
+	err := GetRepos().History.Save(ctx, stat)
 	must(t, err)
 }
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -10,60 +11,297 @@ import (
 	"go.uber.org/zap"
 )
 
+// seenWindow is the minimum time ids of collected transactions are
+// remembered for. The same transaction is collected twice at most: once
+// by the instance which saved it and once from the change feed, both
+// within seconds.
+const seenWindow = time.Minute * 10
+
+// CurrentHourStatCollector keeps the latest stat of every tracked
+// wallet. Transactions scheduled in the future are kept pending until
+// their datetime arrives.
 type CurrentHourStatCollector struct {
-	lastStat btcount.HistoryStat
-	mu       sync.RWMutex
+	lastStats map[int64]btcount.HistoryStat
+	pending   map[int64][]btcount.Transaction
+	seen      map[int64]*seenIDs
+	// reloading records transactions collected while the stats of the
+	// wallets are loaded from the store.
+	reloading map[int64][]btcount.Transaction
+	mu        sync.RWMutex
+}
+
+// seenIDs remembers ids of collected transactions of a wallet. Ids are
+// kept in two generations, the older one is dropped on rotation.
+type seenIDs struct {
+	current   map[int64]struct{}
+	previous  map[int64]struct{}
+	rotatedAt time.Time
+}
+
+func newSeenIDs(ids []int64, now time.Time) *seenIDs {
+	s := &seenIDs{
+		current:   make(map[int64]struct{}, len(ids)),
+		rotatedAt: now,
+	}
+
+	for _, id := range ids {
+		s.current[id] = struct{}{}
+	}
+
+	return s
+}
+
+// add remembers the id and reports whether it was not seen before.
+func (s *seenIDs) add(id int64, now time.Time) (added bool) {
+	if now.Sub(s.rotatedAt) > seenWindow {
+		s.previous, s.current = s.current, make(map[int64]struct{})
+		s.rotatedAt = now
+	}
+
+	if _, ok := s.current[id]; ok {
+		return false
+	}
+	if _, ok := s.previous[id]; ok {
+		return false
+	}
+
+	s.current[id] = struct{}{}
+
+	return true
 }
 
-// Collect appends new transaction to the history stat.
+// Collect appends new transaction to the history stat of its wallet.
+// Transactions of untracked wallets and transactions collected already
+// are ignored.
 func (c *CurrentHourStatCollector) Collect(t btcount.Transaction) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.lastStat.Amount = c.lastStat.Amount.Add(t.Amount)
-	c.lastStat.Datetime = t.Datetime
+	c.collect(t, time.Now())
+}
+
+// CollectMany collects transactions holding the lock once.
+func (c *CurrentHourStatCollector) CollectMany(ts []btcount.Transaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range ts {
+		c.collect(t, now)
+	}
+}
+
+// collect adds the transaction to the stat of its wallet or postpones it
+// until its datetime. The caller should hold the lock.
+func (c *CurrentHourStatCollector) collect(t btcount.Transaction, now time.Time) {
+	if recorded, ok := c.reloading[t.WalletID]; ok {
+		c.reloading[t.WalletID] = append(recorded, t)
+	}
+
+	if _, ok := c.lastStats[t.WalletID]; !ok {
+		return
+	}
+
+	if t.ID > 0 && !c.seen[t.WalletID].add(t.ID, now) {
+		return
+	}
+
+	if t.Datetime.After(now) {
+		c.pending[t.WalletID] = append(c.pending[t.WalletID], t)
+
+		return
+	}
+
+	c.apply(t)
+}
+
+// apply adds the transaction to the stat of its wallet. The caller
+// should hold the lock.
+func (c *CurrentHourStatCollector) apply(t btcount.Transaction) {
+	stat := c.lastStats[t.WalletID]
+	stat.Amount = stat.Amount.Add(t.Amount)
+	if t.Datetime.After(stat.Datetime) {
+		stat.Datetime = t.Datetime
+	}
+
+	c.lastStats[t.WalletID] = stat
 }
 
-// Adjust changes the value of the amount.
-func (c *CurrentHourStatCollector) Adjust(amount btcount.Decimal) {
-	c.lastStat.Amount = amount
-	c.lastStat.Datetime = time.Now()
+// applyDue applies pending transactions of the wallet which datetime
+// arrived. The caller should hold the lock.
+func (c *CurrentHourStatCollector) applyDue(walletID int64, now time.Time) {
+	pending := c.pending[walletID]
+	if len(pending) == 0 {
+		return
+	}
+
+	left := pending[:0]
+	for _, t := range pending {
+		if t.Datetime.After(now) {
+			left = append(left, t)
+
+			continue
+		}
+
+		c.apply(t)
+	}
+
+	c.pending[walletID] = left
 }
 
-// GetStat returns the currently collected stat.
-func (c *CurrentHourStatCollector) GetStat() btcount.HistoryStat {
+// Track starts collecting stats of the wallet.
+func (c *CurrentHourStatCollector) Track(stat btcount.HistoryStat) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reset(stat, nil, nil)
+}
+
+// loadFunc loads the stat of the wallet, its pending transactions and ids
+// of the transactions they are loaded from.
+type loadFunc func() (stat btcount.HistoryStat, pending []btcount.Transaction, ids []int64, err error)
+
+// reload replaces the stat of the wallet with the one loaded by load.
+// Transactions collected while it is loading may be missed by it, so they
+// are recorded and collected again unless they are loaded. Reloads of the
+// same wallet should not overlap.
+func (c *CurrentHourStatCollector) reload(walletID int64, load loadFunc) (err error) {
+	c.mu.Lock()
+	c.reloading[walletID] = nil
+	c.mu.Unlock()
+
+	stat, pending, ids, err := load()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	recorded := c.reloading[walletID]
+	delete(c.reloading, walletID)
+
+	if err != nil {
+		return err
+	}
+
+	c.reset(stat, pending, ids)
+
+	now := time.Now()
+	for _, t := range recorded {
+		c.collect(t, now)
+	}
+
+	return nil
+}
+
+// reset replaces the stat of the wallet with the loaded one. Ids are of
+// the transactions the stat and pending transactions are loaded from, so
+// they are not collected again. The caller should hold the lock.
+func (c *CurrentHourStatCollector) reset(stat btcount.HistoryStat, pending []btcount.Transaction, ids []int64) {
+	c.lastStats[stat.WalletID] = stat
+	c.pending[stat.WalletID] = pending
+	c.seen[stat.WalletID] = newSeenIDs(ids, time.Now())
+}
+
+// Forget stops collecting stats of the wallet.
+func (c *CurrentHourStatCollector) Forget(walletID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.lastStats, walletID)
+	delete(c.pending, walletID)
+	delete(c.seen, walletID)
+}
+
+// tracked returns ids of tracked wallets.
+func (c *CurrentHourStatCollector) tracked() (walletIDs []int64) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return c.lastStat
+	walletIDs = make([]int64, 0, len(c.lastStats))
+	for walletID := range c.lastStats {
+		walletIDs = append(walletIDs, walletID)
+	}
+
+	return walletIDs
 }
 
-type HistoryStatParams struct {
-	HStore btcount.HistoryStatStorage
-	TStore btcount.TransactionStorage
+// GetStat returns the currently collected stat of the wallet including
+// pending transactions which datetime arrived. It reports false if the
+// wallet is not tracked.
+func (c *CurrentHourStatCollector) GetStat(walletID int64) (stat btcount.HistoryStat, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok = c.lastStats[walletID]; !ok {
+		return stat, false
+	}
+
+	c.applyDue(walletID, time.Now())
+
+	return c.lastStats[walletID], true
+}
 
-	DB btcount.Database
+type HistoryStatParams struct {
+	Store btcount.Store
 }
 
 func InitHistoryStatCollector(ctx context.Context, params HistoryStatParams, log *zap.Logger) (c *CurrentHourStatCollector, err error) {
-	hourStart := time.Now()
-	lastStat, err := params.HStore.LoadLastStat(ctx, params.DB, hourStart)
+	c = NewCurrentHourStatCollector()
+
+	err = NewFollower(c, params.Store, log).Resync(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("loading last stat: %w", err)
+		return nil, err
 	}
 
+	return c, nil
+}
+
+// NewCurrentHourStatCollector creates a collector without tracked
+// wallets.
+func NewCurrentHourStatCollector() *CurrentHourStatCollector {
+	return &CurrentHourStatCollector{
+		lastStats: make(map[int64]btcount.HistoryStat),
+		pending:   make(map[int64][]btcount.Transaction),
+		seen:      make(map[int64]*seenIDs),
+		reloading: make(map[int64][]btcount.Transaction),
+	}
+}
+
+// farFuture bounds the range of scheduled transactions.
+var farFuture = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// loadCurrentStat loads the current stat of the wallet and transactions
+// scheduled after now. Ids of loaded transactions are returned as well.
+func loadCurrentStat(ctx context.Context, repos btcount.Repos, walletID int64) (stat btcount.HistoryStat, pending []btcount.Transaction, ids []int64, err error) {
+	now := time.Now().UTC()
+	lastStat, err := repos.History.LoadLastStat(ctx, walletID, now)
+	if err != nil && !errors.Is(err, btcount.ErrNotFound) {
+		return stat, nil, nil, fmt.Errorf("loading last stat: %w", err)
+	}
+
+	lastStat.WalletID = walletID
+
 	var ts []btcount.Transaction
-	ts, err = params.TStore.Load(ctx, params.DB, btcount.TimerangeQuery{Since: lastStat.Datetime, Till: time.Now()})
+	// The stat covers transactions dated before its datetime.
+	ts, err = repos.Transactions.Load(ctx, walletID, btcount.NewTimeRangeQuery(lastStat.Datetime, farFuture))
 	if err != nil {
-		return nil, fmt.Errorf("loading transactions: %w", err)
+		return stat, nil, nil, fmt.Errorf("loading transactions: %w", err)
+	}
+
+	ids = make([]int64, 0, len(ts))
+	due := ts[:0]
+	for _, t := range ts {
+		ids = append(ids, t.ID)
+		if t.Datetime.After(now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
 	}
 
-	stats := btcount.CollectTransactionsIntoStats(ts, lastStat.Amount)
+	stats := btcount.CollectTransactionsIntoStats(due, lastStat.Amount)
 	if len(stats) == 0 {
-		return &CurrentHourStatCollector{lastStat: btcount.HistoryStat{}}, nil
+		return lastStat, pending, ids, nil
 	}
 
-	stat := stats[len(stats)-1]
-	log.Debug("created cache", zap.Any("stat", stat))
-	return &CurrentHourStatCollector{lastStat: stat}, nil
+	return stats[len(stats)-1], pending, ids, nil
 }
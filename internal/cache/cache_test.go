@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/memory"
+
+	"go.uber.org/zap"
+)
+
+func TestCollectorPending(t *testing.T) {
+	const walletID int64 = 7
+
+	c := NewCurrentHourStatCollector()
+	c.Track(btcount.HistoryStat{WalletID: walletID, Amount: btcount.DecimalFromFloat(1.0)})
+
+	now := time.Now()
+	c.Collect(btcount.Transaction{WalletID: walletID, Amount: btcount.DecimalFromFloat(2.0), Datetime: now.Add(-time.Hour)})
+	c.Collect(btcount.Transaction{WalletID: walletID, Amount: btcount.DecimalFromFloat(4.0), Datetime: now.Add(time.Hour)})
+	c.Collect(btcount.Transaction{WalletID: walletID + 1, Amount: btcount.DecimalFromFloat(8.0), Datetime: now})
+
+	stat, ok := c.GetStat(walletID)
+	if !ok {
+		t.Fatal("exp wallet to be tracked")
+	}
+
+	if !stat.Amount.Equal(btcount.DecimalFromFloat(3.0)) {
+		t.Errorf("exp amount without scheduled transaction: 3, got: %s", stat.Amount)
+	}
+
+	if stat.Datetime.After(now) {
+		t.Errorf("exp datetime not in the future, got: %v", stat.Datetime)
+	}
+
+	c.mu.Lock()
+	c.applyDue(walletID, now.Add(time.Hour*2))
+	c.mu.Unlock()
+
+	stat, _ = c.GetStat(walletID)
+	if !stat.Amount.Equal(btcount.DecimalFromFloat(7.0)) {
+		t.Errorf("exp amount with due transaction: 7, got: %s", stat.Amount)
+	}
+
+	if _, ok = c.GetStat(walletID + 1); ok {
+		t.Error("exp untracked wallet to be ignored")
+	}
+}
+
+func TestFollower(t *testing.T) {
+	ctx := context.Background()
+	store := memory.Open()
+	repos := store.Repos()
+
+	c := NewCurrentHourStatCollector()
+	follower := NewFollower(c, store, zap.NewNop())
+
+	saved, err := repos.Transactions.Save(ctx, btcount.Transaction{
+		WalletID: btcount.DefaultWalletID,
+		Amount:   btcount.DecimalFromFloat(1.0),
+		Datetime: time.Now().Add(-time.Minute),
+	})
+	assertNoError(t, err)
+
+	c.Track(btcount.HistoryStat{WalletID: 42})
+	assertNoError(t, follower.Resync(ctx))
+
+	// Wallets deleted while disconnected are forgotten on resync.
+	if _, ok := c.GetStat(42); ok {
+		t.Error("exp missing wallet to be forgotten")
+	}
+
+	// The transaction is loaded on resync, so it is not collected again
+	// neither locally nor from the feed.
+	c.Collect(saved)
+	assertNoError(t, follower.TransactionsSaved(ctx, []btcount.Transaction{saved}))
+	assertAmount(t, c, btcount.DefaultWalletID, 1.0)
+
+	// Wallets created by other instances are loaded on the first
+	// transaction.
+	wallet, err := repos.Wallets.Create(ctx, btcount.Wallet{Name: "other"})
+	assertNoError(t, err)
+
+	saved, err = repos.Transactions.Save(ctx, btcount.Transaction{
+		WalletID: wallet.ID,
+		Amount:   btcount.DecimalFromFloat(2.0),
+		Datetime: time.Now().Add(-time.Minute),
+	})
+	assertNoError(t, err)
+
+	assertNoError(t, follower.TransactionsSaved(ctx, []btcount.Transaction{saved}))
+	assertNoError(t, follower.TransactionsSaved(ctx, []btcount.Transaction{saved}))
+	assertAmount(t, c, wallet.ID, 2.0)
+
+	assertNoError(t, follower.WalletDeleted(ctx, wallet.ID))
+	if _, ok := c.GetStat(wallet.ID); ok {
+		t.Error("exp deleted wallet to be forgotten")
+	}
+}
+
+func TestCollectorReload(t *testing.T) {
+	const walletID int64 = 7
+
+	c := NewCurrentHourStatCollector()
+
+	loaded := btcount.Transaction{ID: 1, WalletID: walletID, Amount: btcount.DecimalFromFloat(1.0), Datetime: time.Now()}
+	missed := btcount.Transaction{ID: 2, WalletID: walletID, Amount: btcount.DecimalFromFloat(2.0), Datetime: time.Now()}
+
+	// Transactions collected while the wallet is loaded are not lost
+	// whether they are loaded or not, and the wallet is tracked since.
+	err := c.reload(walletID, func() (stat btcount.HistoryStat, pending []btcount.Transaction, ids []int64, err error) {
+		c.Collect(loaded)
+		c.Collect(missed)
+
+		return btcount.HistoryStat{WalletID: walletID, Amount: loaded.Amount}, nil, []int64{loaded.ID}, nil
+	})
+	assertNoError(t, err)
+	assertAmount(t, c, walletID, 3.0)
+
+	c.Collect(missed)
+	assertAmount(t, c, walletID, 3.0)
+}
+
+func assertAmount(t *testing.T, c *CurrentHourStatCollector, walletID int64, exp float64) {
+	t.Helper()
+
+	stat, ok := c.GetStat(walletID)
+	if !ok {
+		t.Fatalf("exp wallet %d to be tracked", walletID)
+	}
+
+	if !stat.Amount.Equal(btcount.DecimalFromFloat(exp)) {
+		t.Errorf("exp amount of wallet %d: %v, got: %s", walletID, exp, stat.Amount)
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
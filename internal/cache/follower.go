@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ferux/btcount/internal/btcount"
+
+	"go.uber.org/zap"
+)
+
+// Follower keeps the collector consistent with changes made by every
+// instance of the service. It implements btcount.ChangeHandler
+// interface.
+type Follower struct {
+	c     *CurrentHourStatCollector
+	store btcount.Store
+	log   *zap.Logger
+}
+
+// NewFollower creates a follower updating the collector.
+func NewFollower(c *CurrentHourStatCollector, store btcount.Store, log *zap.Logger) *Follower {
+	return &Follower{
+		c:     c,
+		store: store,
+		log:   log,
+	}
+}
+
+// Resync implements btcount.ChangeHandler interface. Stats of all wallets
+// are reloaded and deleted wallets are forgotten.
+func (f *Follower) Resync(ctx context.Context) (err error) {
+	repos := f.store.Repos()
+
+	wallets, err := repos.Wallets.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing wallets: %w", err)
+	}
+
+	exists := make(map[int64]struct{}, len(wallets))
+	for _, wallet := range wallets {
+		exists[wallet.ID] = struct{}{}
+
+		err = f.load(ctx, repos, wallet.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, walletID := range f.c.tracked() {
+		if _, ok := exists[walletID]; !ok {
+			f.c.Forget(walletID)
+		}
+	}
+
+	return nil
+}
+
+// TransactionsSaved implements btcount.ChangeHandler interface. Wallets
+// created by other instances are loaded on their first transaction.
+func (f *Follower) TransactionsSaved(ctx context.Context, ts []btcount.Transaction) (err error) {
+	for _, t := range ts {
+		err = f.transactionSaved(ctx, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *Follower) transactionSaved(ctx context.Context, t btcount.Transaction) (err error) {
+	if _, ok := f.c.GetStat(t.WalletID); ok {
+		f.c.Collect(t)
+
+		return nil
+	}
+
+	repos := f.store.Repos()
+
+	_, err = repos.Wallets.Get(ctx, t.WalletID)
+	if errors.Is(err, btcount.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading wallet %d: %w", t.WalletID, err)
+	}
+
+	return f.load(ctx, repos, t.WalletID)
+}
+
+// WalletDeleted implements btcount.ChangeHandler interface.
+func (f *Follower) WalletDeleted(ctx context.Context, walletID int64) (err error) {
+	f.c.Forget(walletID)
+
+	return nil
+}
+
+func (f *Follower) load(ctx context.Context, repos btcount.Repos, walletID int64) (err error) {
+	err = f.c.reload(walletID, func() (stat btcount.HistoryStat, pending []btcount.Transaction, ids []int64, err error) {
+		stat, pending, ids, err = loadCurrentStat(ctx, repos, walletID)
+		if err != nil {
+			return stat, nil, nil, err
+		}
+
+		f.log.Debug("loaded cache",
+			zap.Int64("wallet_id", walletID),
+			zap.Any("stat", stat),
+			zap.Int("pending", len(pending)),
+		)
+
+		return stat, pending, ids, nil
+	})
+	if err != nil {
+		return fmt.Errorf("loading stat of wallet %d: %w", walletID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,527 @@
+// Package disk implements the storage persisted to a single file. The
+// data is kept in the memory database, and every committed change is
+// appended to the log file. The log is replayed on startup.
+//
+// The log starts with the header followed by records. Every record holds
+// changes of a single transaction:
+//
+//	length (uint32) | crc32c of payload (uint32) | payload (JSON)
+//
+// A record torn by a crash is cut short, ends the file or is filled with
+// zeros. It is detected by the length or the checksum and dropped on
+// recovery. Any other bad record means the log is corrupted, so it is
+// left intact and the recovery fails instead of dropping the records
+// after it.
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/memory"
+
+	"go.uber.org/zap"
+)
+
+// SyncPolicy defines when appended records are flushed to the disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes every record before the commit returns. No
+	// committed transaction is lost on a crash.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval flushes records periodically. Transactions committed
+	// within the last interval may be lost on a crash of the machine.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// ParseSyncPolicy parses the policy from its name.
+func ParseSyncPolicy(v string) (policy SyncPolicy, err error) {
+	policy = SyncPolicy(strings.ToLower(v))
+	switch policy {
+	case SyncAlways, SyncInterval, SyncNever:
+		return policy, nil
+	}
+
+	return policy, fmt.Errorf("%w: sync policy %q", btcount.ErrInvalidParameter, v)
+}
+
+// Config of the log.
+type Config struct {
+	Sync SyncPolicy
+	// SyncInterval is used with SyncInterval policy.
+	SyncInterval time.Duration
+}
+
+const (
+	header = "BTCOUNT LOG 1\n"
+	// maxRecordSize protects from allocating memory for garbage length.
+	maxRecordSize = 64 << 20
+	// snapshotChunk is the amount of changes in a record of compacted
+	// log.
+	snapshotChunk = 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupted is returned by Open if the log has a bad record which is
+// not the torn tail.
+const ErrCorrupted btcount.Error = "log is corrupted"
+
+// Change is a change of the database kept in the log.
+type Change = memory.Change
+
+// Open opens the database persisted to the file at path, creating it if
+// it does not exist. The log is compacted to the current state on open.
+func Open(path string, cfg Config, log *zap.Logger) (db *memory.DB, err error) {
+	if cfg.Sync == SyncInterval && cfg.SyncInterval <= 0 {
+		return nil, fmt.Errorf("%w: sync interval %s should be positive", btcount.ErrInvalidParameter, cfg.SyncInterval)
+	}
+
+	db = memory.Open()
+
+	changes, err := readLog(path, log)
+	if err != nil {
+		return nil, fmt.Errorf("reading log: %w", err)
+	}
+
+	db.Restore(changes)
+
+	err = compact(path, db.Snapshot())
+	if err != nil {
+		return nil, fmt.Errorf("compacting log: %w", err)
+	}
+
+	var l *Log
+	l, err = openLog(path, cfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("opening log: %w", err)
+	}
+
+	db.SetJournal(l)
+
+	return db, nil
+}
+
+// readLog reads changes from the log. The valid part of the log is
+// returned if its tail is torn. ErrCorrupted is returned if any other
+// record is bad.
+func readLog(path string, log *zap.Logger) (changes []Change, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	defer func() {
+		// May omit error checking here because file opens for read only.
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("reading file info: %w", err)
+	}
+
+	r := bufio.NewReader(f)
+
+	head := make([]byte, len(header))
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	if string(head) != header {
+		return nil, fmt.Errorf("%w: %s is not a log file", btcount.ErrUnexpectedType, path)
+	}
+
+	offset := int64(len(header))
+	for {
+		var record []Change
+		var size int64
+		record, size, err = readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return changes, nil
+		}
+		if err != nil {
+			cause := err
+
+			var torn bool
+			torn, err = isTornTail(f, info.Size(), offset, size, cause)
+			if err != nil {
+				return nil, fmt.Errorf("checking tail: %w", err)
+			}
+
+			if !torn {
+				return nil, fmt.Errorf("%w: bad record at offset %d of %s: %v", ErrCorrupted, offset, path, cause)
+			}
+
+			log.Warn("dropping torn tail of the log",
+				zap.String("path", path),
+				zap.Int64("offset", offset),
+				zap.Error(cause),
+			)
+
+			return changes, nil
+		}
+
+		changes = append(changes, record...)
+		offset += size
+	}
+}
+
+// readRecord reads the record. The size of the record is returned once
+// its length is read, even if the record is bad.
+func readRecord(r io.Reader) (changes []Change, size int64, err error) {
+	var prefix [8]byte
+	_, err = io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(prefix[:4])
+	checksum := binary.LittleEndian.Uint32(prefix[4:])
+	size = int64(len(prefix)) + int64(length)
+	if length > maxRecordSize {
+		return nil, size, fmt.Errorf("record length %d exceeds the limit", length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, size, fmt.Errorf("reading payload: %w", io.ErrUnexpectedEOF)
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, size, errors.New("checksum mismatch")
+	}
+
+	err = json.Unmarshal(payload, &changes)
+	if err != nil {
+		return nil, size, fmt.Errorf("decoding payload: %w", err)
+	}
+
+	return changes, size, nil
+}
+
+// isTornTail reports whether the bad record of size at offset is the
+// last append torn by a crash, i.e. it is cut short by the end of the
+// file, ends the file or the rest of the file is filled with zeros.
+func isTornTail(f *os.File, fsize, offset, size int64, cause error) (torn bool, err error) {
+	if errors.Is(cause, io.ErrUnexpectedEOF) || offset+size == fsize {
+		return true, nil
+	}
+
+	r := io.NewSectionReader(f, offset, fsize-offset)
+	buf := make([]byte, 32<<10)
+	for {
+		var n int
+		n, err = r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading file: %w", err)
+		}
+	}
+}
+
+// encodeRecord encodes changes into a record.
+func encodeRecord(changes []Change) (record []byte, err error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+
+	err = json.NewEncoder(&buf).Encode(changes)
+	if err != nil {
+		return nil, fmt.Errorf("encoding changes: %w", err)
+	}
+
+	record = buf.Bytes()
+	payload := record[8:]
+	binary.LittleEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+
+	return record, nil
+}
+
+// compact replaces the log with the one holding only changes. The new log
+// is written aside and renamed over the old one, so one of them survives
+// a crash.
+func compact(path string, changes []Change) (err error) {
+	tmppath := path + ".tmp"
+	f, err := os.OpenFile(tmppath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmppath)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	_, err = w.WriteString(header)
+	if err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	for len(changes) > 0 {
+		chunk := changes
+		if len(chunk) > snapshotChunk {
+			chunk = chunk[:snapshotChunk]
+		}
+
+		changes = changes[len(chunk):]
+
+		var record []byte
+		record, err = encodeRecord(chunk)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(record)
+		if err != nil {
+			return fmt.Errorf("writing record: %w", err)
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("flushing: %w", err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("syncing file: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+
+	err = os.Rename(tmppath, path)
+	if err != nil {
+		return fmt.Errorf("renaming file: %w", err)
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory entries, so the renamed file survives a
+// crash.
+func syncDir(path string) (err error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening directory: %w", err)
+	}
+	defer func() {
+		// May omit error checking here because directory opens for read
+		// only.
+		_ = dir.Close()
+	}()
+
+	err = dir.Sync()
+	if err != nil {
+		return fmt.Errorf("syncing directory: %w", err)
+	}
+
+	return nil
+}
+
+// Log appends changes to the log file. It implements memory.Journal
+// interface.
+type Log struct {
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	policy SyncPolicy
+	dirty  bool
+	// broken is set if the file is left in unknown state, so nothing can
+	// be appended safely.
+	broken error
+
+	stop chan struct{}
+	done chan struct{}
+	log  *zap.Logger
+}
+
+func openLog(path string, cfg Config, log *zap.Logger) (l *Log, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = f.Close()
+
+		return nil, fmt.Errorf("seeking to the end: %w", err)
+	}
+
+	l = &Log{
+		f:      f,
+		size:   size,
+		policy: cfg.Sync,
+		log:    log,
+	}
+
+	if cfg.Sync == SyncInterval {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+
+		go l.syncEvery(cfg.SyncInterval)
+	}
+
+	return l, nil
+}
+
+// Append implements memory.Journal interface.
+func (l *Log) Append(changes []Change) (err error) {
+	record, err := encodeRecord(changes)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.broken != nil {
+		return fmt.Errorf("log is broken: %w", l.broken)
+	}
+
+	_, err = l.f.Write(record)
+	if err != nil {
+		// The torn record is cut off, otherwise records appended after it
+		// would be dropped on recovery.
+		errtrunc := l.truncate()
+		if errtrunc != nil {
+			l.broken = errtrunc
+		}
+
+		return fmt.Errorf("writing record: %w", err)
+	}
+
+	l.size += int64(len(record))
+
+	if l.policy != SyncAlways {
+		l.dirty = true
+
+		return nil
+	}
+
+	err = l.f.Sync()
+	if err != nil {
+		// It is unknown what reached the disk, so nothing may be
+		// appended anymore.
+		l.broken = err
+
+		return fmt.Errorf("syncing file: %w", err)
+	}
+
+	return nil
+}
+
+func (l *Log) truncate() (err error) {
+	err = l.f.Truncate(l.size)
+	if err != nil {
+		return fmt.Errorf("truncating file: %w", err)
+	}
+
+	_, err = l.f.Seek(l.size, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("seeking: %w", err)
+	}
+
+	return nil
+}
+
+func (l *Log) syncEvery(interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+
+		err := l.sync()
+		if err != nil {
+			l.log.Error("unable to sync log", zap.Error(err))
+		}
+	}
+}
+
+func (l *Log) sync() (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.dirty || l.broken != nil {
+		return nil
+	}
+
+	err = l.f.Sync()
+	if err != nil {
+		l.broken = err
+
+		return fmt.Errorf("syncing file: %w", err)
+	}
+
+	l.dirty = false
+
+	return nil
+}
+
+// Close implements memory.Journal interface. Appended records are flushed
+// before closing.
+func (l *Log) Close() (err error) {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+
+	err = l.sync()
+	if err != nil {
+		_ = l.f.Close()
+
+		return err
+	}
+
+	err = l.f.Close()
+	if err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+
+	return nil
+}
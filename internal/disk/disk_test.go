@@ -0,0 +1,207 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+
+	"go.uber.org/zap"
+)
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "btcount.log")
+	datetime := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	db, err := Open(path, Config{Sync: SyncAlways}, zap.NewNop())
+	assertNoError(t, err)
+
+	wallet, err := db.Repos().Wallets.Create(ctx, btcount.Wallet{Name: "edge"})
+	assertNoError(t, err)
+
+	err = db.WithinTx(ctx, func(tx btcount.Repos) (err error) {
+		_, err = tx.Transactions.Save(ctx, btcount.Transaction{
+			WalletID: wallet.ID,
+			Amount:   btcount.DecimalFromFloat(1.5),
+			Datetime: datetime,
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.History.Save(ctx, btcount.HistoryStat{
+			WalletID: wallet.ID,
+			Datetime: datetime.Add(time.Hour),
+			Amount:   btcount.DecimalFromFloat(1.5),
+		})
+	})
+	assertNoError(t, err)
+
+	// Rolled back changes are not persisted.
+	errRollback := errors.New("rollback")
+	err = db.WithinTx(ctx, func(tx btcount.Repos) (err error) {
+		_, err = tx.Transactions.Save(ctx, btcount.Transaction{
+			WalletID: wallet.ID,
+			Amount:   btcount.DecimalFromFloat(100),
+			Datetime: datetime,
+		})
+		assertNoError(t, err)
+
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("exp error: %v, got: %v", errRollback, err)
+	}
+
+	assertNoError(t, db.Close())
+
+	// A record torn by a crash is dropped.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	assertNoError(t, err)
+	_, err = f.Write([]byte{42, 0, 0, 0, 1, 2, 3})
+	assertNoError(t, err)
+	assertNoError(t, f.Close())
+
+	db, err = Open(path, Config{Sync: SyncInterval, SyncInterval: time.Millisecond}, zap.NewNop())
+	assertNoError(t, err)
+
+	sum, err := db.Repos().Transactions.Sum(ctx, wallet.ID)
+	assertNoError(t, err)
+	if !sum.Equal(btcount.DecimalFromFloat(1.5)) {
+		t.Errorf("exp sum: 1.5, got: %v", sum)
+	}
+
+	stat, err := db.Repos().History.LoadLastStat(ctx, wallet.ID, datetime.Add(time.Hour))
+	assertNoError(t, err)
+	if !stat.Amount.Equal(btcount.DecimalFromFloat(1.5)) {
+		t.Errorf("exp stat amount: 1.5, got: %v", stat.Amount)
+	}
+
+	// Ids are not reused after deleting.
+	assertNoError(t, db.Repos().Wallets.Delete(ctx, wallet.ID))
+	assertNoError(t, db.Close())
+
+	db, err = Open(path, Config{Sync: SyncNever}, zap.NewNop())
+	assertNoError(t, err)
+
+	_, err = db.Repos().Wallets.Get(ctx, wallet.ID)
+	if !errors.Is(err, btcount.ErrNotFound) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrNotFound, err)
+	}
+
+	created, err := db.Repos().Wallets.Create(ctx, btcount.Wallet{Name: "next"})
+	assertNoError(t, err)
+	if created.ID <= wallet.ID {
+		t.Errorf("exp id greater than %d, got: %d", wallet.ID, created.ID)
+	}
+
+	assertNoError(t, db.Close())
+}
+
+func TestCorruption(t *testing.T) {
+	ctx := context.Background()
+
+	var tt = []struct {
+		name    string
+		corrupt func(t *testing.T, path string)
+		err     error
+	}{{
+		name: "tail filled with zeros",
+		corrupt: func(t *testing.T, path string) {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			assertNoError(t, err)
+			_, err = f.Write(make([]byte, 4096))
+			assertNoError(t, err)
+			assertNoError(t, f.Close())
+		},
+	}, {
+		name: "bad record in the middle",
+		corrupt: func(t *testing.T, path string) {
+			f, err := os.OpenFile(path, os.O_WRONLY, 0)
+			assertNoError(t, err)
+			_, err = f.WriteAt([]byte{'#'}, int64(len(header))+16)
+			assertNoError(t, err)
+			assertNoError(t, f.Close())
+		},
+		err: ErrCorrupted,
+	}}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "btcount.log")
+
+			db, err := Open(path, Config{Sync: SyncAlways}, zap.NewNop())
+			assertNoError(t, err)
+
+			_, err = db.Repos().Transactions.Save(ctx, btcount.Transaction{
+				WalletID: btcount.DefaultWalletID,
+				Amount:   btcount.DecimalFromFloat(1.5),
+				Datetime: time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC),
+			})
+			assertNoError(t, err)
+			assertNoError(t, db.Close())
+
+			tc.corrupt(t, path)
+
+			before, err := os.ReadFile(path)
+			assertNoError(t, err)
+
+			db, err = Open(path, Config{Sync: SyncAlways}, zap.NewNop())
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("exp error: %v, got: %v", tc.err, err)
+			}
+
+			if err != nil {
+				// The corrupted log is left intact.
+				after, err := os.ReadFile(path)
+				assertNoError(t, err)
+				if string(after) != string(before) {
+					t.Error("exp the log left intact")
+				}
+
+				return
+			}
+
+			sum, err := db.Repos().Transactions.Sum(ctx, btcount.DefaultWalletID)
+			assertNoError(t, err)
+			if !sum.Equal(btcount.DecimalFromFloat(1.5)) {
+				t.Errorf("exp sum: 1.5, got: %v", sum)
+			}
+
+			assertNoError(t, db.Close())
+		})
+	}
+}
+
+func TestInvalidSyncInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btcount.log")
+
+	_, err := Open(path, Config{Sync: SyncInterval}, zap.NewNop())
+	if !errors.Is(err, btcount.ErrInvalidParameter) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrInvalidParameter, err)
+	}
+}
+
+func TestForeignFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btcount.log")
+	assertNoError(t, os.WriteFile(path, []byte("definitely not a log file"), 0o600))
+
+	_, err := Open(path, Config{Sync: SyncAlways}, zap.NewNop())
+	if !errors.Is(err, btcount.ErrUnexpectedType) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrUnexpectedType, err)
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
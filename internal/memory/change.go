@@ -0,0 +1,237 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// ChangeKind defines what is changed in the database.
+type ChangeKind string
+
+const (
+	// ChangeCreateWallet adds Wallet.
+	ChangeCreateWallet ChangeKind = "create_wallet"
+	// ChangeDeleteWallet removes the wallet WalletID with its data.
+	ChangeDeleteWallet ChangeKind = "delete_wallet"
+	// ChangeSaveTransaction adds Transaction to the wallet WalletID.
+	ChangeSaveTransaction ChangeKind = "save_transaction"
+	// ChangeSaveStat adds Stat to the wallet WalletID.
+	ChangeSaveStat ChangeKind = "save_stat"
+	// ChangeDeleteStats removes stats of the wallet WalletID matched by
+	// Range. Changes journaled before Range was introduced carry Since
+	// and Till matching stats dated in (Since, Till].
+	ChangeDeleteStats ChangeKind = "delete_stats"
+	// ChangeSequences advances the sequences of ids to WalletSeq and
+	// TransactionSeq.
+	ChangeSequences ChangeKind = "sequences"
+)
+
+// Change is a single change of the database. Changes carry all the
+// assigned values, so applying them again restores the same state.
+type Change struct {
+	Kind     ChangeKind `json:"kind"`
+	WalletID int64      `json:"walletId,omitempty"`
+
+	Wallet      *btcount.Wallet      `json:"wallet,omitempty"`
+	Transaction *btcount.Transaction `json:"transaction,omitempty"`
+	Stat        *btcount.HistoryStat `json:"stat,omitempty"`
+
+	Range *btcount.TimerangeQuery `json:"range,omitempty"`
+	Since time.Time               `json:"since,omitempty"`
+	Till  time.Time               `json:"till,omitempty"`
+
+	WalletSeq      int64 `json:"walletSeq,omitempty"`
+	TransactionSeq int64 `json:"transactionSeq,omitempty"`
+}
+
+// Journal persists changes of the database.
+type Journal interface {
+	// Append persists changes made by a single transaction. Either all
+	// of them are persisted or none.
+	Append(changes []Change) error
+	Close() error
+}
+
+// SetJournal makes the database pass committed changes to j. Changes are
+// applied only if j persists them.
+func (db *DB) SetJournal(j Journal) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.journal = j
+}
+
+// Restore applies previously journaled changes.
+func (db *DB) Restore(changes []Change) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, c := range changes {
+		db.apply(c)
+	}
+}
+
+// Snapshot returns changes which restore the current state of the
+// database when applied to an empty one.
+func (db *DB) Snapshot() (changes []Change) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	changes = append(changes, Change{
+		Kind:           ChangeSequences,
+		WalletSeq:      db.walletSeq,
+		TransactionSeq: db.transactionSeq,
+	})
+
+	wallets := make([]btcount.Wallet, 0, len(db.wallets))
+	for _, wallet := range db.wallets {
+		wallets = append(wallets, wallet)
+	}
+
+	sortWallets(wallets)
+
+	for i := range wallets {
+		walletID := wallets[i].ID
+		changes = append(changes, Change{
+			Kind:     ChangeCreateWallet,
+			WalletID: walletID,
+			Wallet:   &wallets[i],
+		})
+
+		for _, t := range db.transactions[walletID] {
+			t := t
+			changes = append(changes, Change{
+				Kind:        ChangeSaveTransaction,
+				WalletID:    walletID,
+				Transaction: &t,
+			})
+		}
+
+		for _, stat := range db.stats[walletID] {
+			stat := stat
+			changes = append(changes, Change{
+				Kind:     ChangeSaveStat,
+				WalletID: walletID,
+				Stat:     &stat,
+			})
+		}
+	}
+
+	return changes
+}
+
+// apply applies the change and returns the function reverting it. The
+// database mutex should be held. Changes of deleted wallets are ignored.
+func (db *DB) apply(c Change) (undo func()) {
+	walletID := c.WalletID
+	_, exists := db.wallets[walletID]
+
+	switch c.Kind {
+	case ChangeCreateWallet:
+		wallet := *c.Wallet
+		db.wallets[walletID] = wallet
+		if db.walletSeq < walletID {
+			db.walletSeq = walletID
+		}
+
+		return func() { delete(db.wallets, walletID) }
+	case ChangeDeleteWallet:
+		if !exists {
+			return func() {}
+		}
+
+		wallet := db.wallets[walletID]
+		transactions, stats := db.transactions[walletID], db.stats[walletID]
+		keys, balance := db.keys[walletID], db.balances[walletID]
+		delete(db.wallets, walletID)
+		delete(db.transactions, walletID)
+		delete(db.keys, walletID)
+		delete(db.stats, walletID)
+		delete(db.balances, walletID)
+
+		return func() {
+			db.wallets[walletID] = wallet
+			db.transactions[walletID] = transactions
+			db.keys[walletID] = keys
+			db.stats[walletID] = stats
+			db.balances[walletID] = balance
+		}
+	case ChangeSaveTransaction:
+		if !exists {
+			return func() {}
+		}
+
+		t := *c.Transaction
+		t.WalletID = walletID
+		db.transactions[walletID] = insertTransaction(db.transactions[walletID], t)
+		db.balances[walletID] = db.balances[walletID].Add(t.Amount)
+		if db.transactionSeq < t.ID {
+			db.transactionSeq = t.ID
+		}
+
+		if t.IdempotencyKey != "" {
+			if db.keys[walletID] == nil {
+				db.keys[walletID] = make(map[string]int64)
+			}
+
+			db.keys[walletID][t.IdempotencyKey] = t.ID
+		}
+
+		return func() {
+			db.transactions[walletID] = removeTransaction(db.transactions[walletID], t.ID)
+			db.balances[walletID] = db.balances[walletID].Sub(t.Amount)
+			if t.IdempotencyKey != "" {
+				delete(db.keys[walletID], t.IdempotencyKey)
+			}
+		}
+	case ChangeSaveStat:
+		if !exists {
+			return func() {}
+		}
+
+		stat := *c.Stat
+		stat.WalletID = walletID
+		db.stats[walletID] = insertStat(db.stats[walletID], stat)
+
+		return func() {
+			db.stats[walletID] = removeStat(db.stats[walletID], stat)
+		}
+	case ChangeDeleteStats:
+		query := btcount.NewStatRangeQuery(c.Since, c.Till)
+		if c.Range != nil {
+			query = *c.Range
+		}
+
+		var kept, deleted []btcount.HistoryStat
+		for _, stat := range db.stats[walletID] {
+			if query.Contains(stat.Datetime) {
+				deleted = append(deleted, stat)
+			} else {
+				kept = append(kept, stat)
+			}
+		}
+
+		if len(deleted) == 0 {
+			return func() {}
+		}
+
+		db.stats[walletID] = kept
+
+		return func() {
+			for _, stat := range deleted {
+				db.stats[walletID] = insertStat(db.stats[walletID], stat)
+			}
+		}
+	case ChangeSequences:
+		if db.walletSeq < c.WalletSeq {
+			db.walletSeq = c.WalletSeq
+		}
+
+		if db.transactionSeq < c.TransactionSeq {
+			db.transactionSeq = c.TransactionSeq
+		}
+	}
+
+	return func() {}
+}
@@ -0,0 +1,199 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// HistoryStore implements btcount.HistoryStorage interface for the memory
+// database. Stats of every wallet are kept ordered by datetime.
+type HistoryStore struct {
+	s scope
+}
+
+// Save implements btcount.HistoryStorage interface.
+func (hs HistoryStore) Save(ctx context.Context, stat btcount.HistoryStat) (err error) {
+	return hs.SaveMany(ctx, []btcount.HistoryStat{stat})
+}
+
+// SaveMany implements btcount.HistoryStorage interface.
+func (hs HistoryStore) SaveMany(ctx context.Context, stats []btcount.HistoryStat) (err error) {
+	mdb, change, err := hs.s.open()
+	if err != nil {
+		return err
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	for i := range stats {
+		if _, ok := mdb.wallets[stats[i].WalletID]; !ok {
+			return fmt.Errorf("inserting %v: %w: wallet %d", stats[i], btcount.ErrNotFound, stats[i].WalletID)
+		}
+	}
+
+	for i := range stats {
+		stat := stats[i]
+		stat.Datetime = timestamp(stat.Datetime)
+		stat.Amount = numeric(stat.Amount)
+		stat.Open = numeric(stat.Open)
+		stat.High = numeric(stat.High)
+		stat.Low = numeric(stat.Low)
+		stat.Inflow = numeric(stat.Inflow)
+		stat.Outflow = numeric(stat.Outflow)
+
+		err = change(Change{
+			Kind:     ChangeSaveStat,
+			WalletID: stat.WalletID,
+			Stat:     &stat,
+		})
+		if err != nil {
+			return fmt.Errorf("inserting %v: %w", stats[i], err)
+		}
+	}
+
+	return nil
+}
+
+// Load implements btcount.HistoryStorage interface.
+func (hs HistoryStore) Load(ctx context.Context, walletID int64, query btcount.TimerangeQuery) (stats []btcount.HistoryStat, err error) {
+	return filterStats(hs.s, walletID, func(stat btcount.HistoryStat) bool {
+		return query.Contains(stat.Datetime)
+	})
+}
+
+// Iterate implements btcount.HistoryStorage interface. Stats are iterated
+// over the snapshot taken at the call, so fn does not hold the lock.
+func (hs HistoryStore) Iterate(ctx context.Context, walletID int64, query btcount.TimerangeQuery, fn func(stat btcount.HistoryStat) error) (err error) {
+	mdb, _, err := hs.s.open()
+	if err != nil {
+		return err
+	}
+
+	// Changes replace the slice of stats, so the snapshot is left intact.
+	mdb.mu.RLock()
+	stats := mdb.stats[walletID]
+	mdb.mu.RUnlock()
+
+	for _, stat := range stats {
+		if !query.Contains(stat.Datetime) {
+			continue
+		}
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		err = fn(stat)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadLastStat implements btcount.HistoryStorage interface.
+func (hs HistoryStore) LoadLastStat(ctx context.Context, walletID int64, ts time.Time) (h btcount.HistoryStat, err error) {
+	var stats []btcount.HistoryStat
+	stats, err = filterStats(hs.s, walletID, func(stat btcount.HistoryStat) bool {
+		return !stat.Datetime.After(ts)
+	})
+	if err != nil {
+		return h, err
+	}
+
+	if len(stats) == 0 {
+		return h, fmt.Errorf("looking up stat: %w", btcount.ErrNotFound)
+	}
+
+	return stats[len(stats)-1], nil
+}
+
+// Delete implements btcount.HistoryStorage interface.
+func (hs HistoryStore) Delete(ctx context.Context, walletID int64, query btcount.TimerangeQuery) (err error) {
+	mdb, change, err := hs.s.open()
+	if err != nil {
+		return err
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	return change(Change{
+		Kind:     ChangeDeleteStats,
+		WalletID: walletID,
+		Range:    &query,
+	})
+}
+
+// filterStats returns a copy of stats of the wallet matched by match in
+// ascending order.
+func filterStats(s scope, walletID int64, match func(btcount.HistoryStat) bool) (stats []btcount.HistoryStat, err error) {
+	mdb, _, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	for _, stat := range mdb.stats[walletID] {
+		if match(stat) {
+			stats = append(stats, stat)
+		}
+	}
+
+	return stats, nil
+}
+
+// insertStat returns a new slice with stat inserted into hs after stats
+// with the same datetime, so slices returned earlier are left intact.
+func insertStat(hs []btcount.HistoryStat, stat btcount.HistoryStat) []btcount.HistoryStat {
+	i := sort.Search(len(hs), func(i int) bool {
+		return hs[i].Datetime.After(stat.Datetime)
+	})
+
+	inserted := make([]btcount.HistoryStat, 0, len(hs)+1)
+	inserted = append(inserted, hs[:i]...)
+	inserted = append(inserted, stat)
+	inserted = append(inserted, hs[i:]...)
+
+	return inserted
+}
+
+// removeStat returns a new slice without the last stat equal to stat.
+// Equal stats are indistinguishable, so it does not matter which one is
+// removed.
+func removeStat(hs []btcount.HistoryStat, stat btcount.HistoryStat) []btcount.HistoryStat {
+	for i := len(hs) - 1; i >= 0; i-- {
+		if !sameStat(hs[i], stat) {
+			continue
+		}
+
+		removed := make([]btcount.HistoryStat, 0, len(hs)-1)
+		removed = append(removed, hs[:i]...)
+		removed = append(removed, hs[i+1:]...)
+
+		return removed
+	}
+
+	return hs
+}
+
+func sameStat(a, b btcount.HistoryStat) bool {
+	return a.WalletID == b.WalletID &&
+		a.Datetime.Equal(b.Datetime) &&
+		a.Count == b.Count &&
+		a.Amount.Equal(b.Amount) &&
+		a.Open.Equal(b.Open) &&
+		a.High.Equal(b.High) &&
+		a.Low.Equal(b.Low) &&
+		a.Inflow.Equal(b.Inflow) &&
+		a.Outflow.Equal(b.Outflow)
+}
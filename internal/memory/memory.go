@@ -0,0 +1,254 @@
+// Package memory implements storages keeping all the data in memory. It
+// mirrors the behaviour of the postgres storages, so it is suitable for
+// running the service without the database and for tests.
+//
+// Changes made within a transaction are applied right away and reverted
+// on rollback. Transactions are isolated only by the wallet locks, the
+// same way the service uses them with postgres. The database may persist
+// changes via a journal.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// Open creates an empty database with the default wallet. Changes made
+// within WithinTx are visible to all readers before the commit, so reads
+// are consistent only for wallets locked by the transaction.
+func Open() *DB {
+	db := &DB{
+		wallets:      make(map[int64]btcount.Wallet),
+		transactions: make(map[int64][]btcount.Transaction),
+		keys:         make(map[int64]map[string]int64),
+		stats:        make(map[int64][]btcount.HistoryStat),
+		balances:     make(map[int64]btcount.Decimal),
+		locks:        make(map[int64]chan struct{}),
+	}
+
+	db.wallets[btcount.DefaultWalletID] = btcount.Wallet{
+		ID:        btcount.DefaultWalletID,
+		Name:      "default",
+		CreatedAt: timestamp(time.Now()),
+	}
+	db.walletSeq = btcount.DefaultWalletID
+
+	return db
+}
+
+// DB keeps wallets with their transactions and history stats. It
+// implements btcount.Store interface.
+type DB struct {
+	mu sync.RWMutex
+
+	wallets      map[int64]btcount.Wallet
+	transactions map[int64][]btcount.Transaction
+	// keys map idempotency keys of the wallets to ids of transactions.
+	keys  map[int64]map[string]int64
+	stats map[int64][]btcount.HistoryStat
+	// balances are the running sums of transactions of the wallets.
+	balances map[int64]btcount.Decimal
+
+	walletSeq      int64
+	transactionSeq int64
+
+	journal Journal
+
+	// locks are held by transactions locked the wallet.
+	locksMu sync.Mutex
+	locks   map[int64]chan struct{}
+}
+
+// Repos implements btcount.Store interface.
+func (db *DB) Repos() btcount.Repos {
+	return newRepos(scope{db: db})
+}
+
+// WithinTx implements btcount.Store interface.
+func (db *DB) WithinTx(ctx context.Context, fn func(r btcount.Repos) error) (err error) {
+	t := &tx{db: db, locked: make(map[int64]struct{})}
+
+	defer func() {
+		if err == nil {
+			err = t.commit()
+
+			return
+		}
+
+		t.rollback()
+	}()
+
+	return fn(newRepos(scope{db: db, tx: t}))
+}
+
+// Close implements btcount.Store interface. It closes the journal if
+// any.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.journal == nil {
+		return nil
+	}
+
+	return db.journal.Close()
+}
+
+func newRepos(s scope) btcount.Repos {
+	return btcount.Repos{
+		Wallets:      WalletStore{s: s},
+		Transactions: TransactionStore{s: s},
+		History:      HistoryStore{s: s},
+	}
+}
+
+// lockWallet blocks until the wallet lock is acquired or the context is
+// done.
+func (db *DB) lockWallet(ctx context.Context, walletID int64) (err error) {
+	db.locksMu.Lock()
+	lock, ok := db.locks[walletID]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		db.locks[walletID] = lock
+	}
+	db.locksMu.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *DB) unlockWallet(walletID int64) {
+	db.locksMu.Lock()
+	lock := db.locks[walletID]
+	db.locksMu.Unlock()
+
+	<-lock
+}
+
+// tx is a transaction of the memory database. It records how to revert
+// applied changes and holds wallet locks until it is finished.
+type tx struct {
+	db *DB
+
+	changes []Change
+	undo    []func()
+	locked  map[int64]struct{}
+	done    bool
+}
+
+// commit passes the changes to the journal. They are reverted if the
+// journal fails to persist them.
+func (t *tx) commit() (err error) {
+	defer t.finish()
+
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+
+	if t.db.journal == nil || len(t.changes) == 0 {
+		return nil
+	}
+
+	err = t.db.journal.Append(t.changes)
+	if err != nil {
+		t.revert()
+
+		return fmt.Errorf("appending to journal: %w", err)
+	}
+
+	return nil
+}
+
+func (t *tx) rollback() {
+	t.db.mu.Lock()
+	t.revert()
+	t.db.mu.Unlock()
+
+	t.finish()
+}
+
+// revert reverts changes made by the transaction. The database mutex
+// should be held.
+func (t *tx) revert() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+}
+
+func (t *tx) finish() {
+	t.done = true
+	t.changes = nil
+	t.undo = nil
+
+	for walletID := range t.locked {
+		t.db.unlockWallet(walletID)
+	}
+
+	t.locked = nil
+}
+
+// scope is the database or a transaction of it the stores work within.
+type scope struct {
+	db *DB
+	// tx is nil outside of a transaction.
+	tx *tx
+}
+
+// open returns the database and the function applying changes to it.
+// Changes made outside of a transaction are passed to the journal right
+// away, otherwise they are recorded to be passed on commit or reverted on
+// rollback. The database mutex should be held while calling the
+// function.
+func (s scope) open() (db *DB, change func(c Change) error, err error) {
+	db = s.db
+	if s.tx == nil {
+		return db, func(c Change) (err error) {
+			undo := db.apply(c)
+			if db.journal == nil {
+				return nil
+			}
+
+			err = db.journal.Append([]Change{c})
+			if err != nil {
+				undo()
+
+				return fmt.Errorf("appending to journal: %w", err)
+			}
+
+			return nil
+		}, nil
+	}
+
+	t := s.tx
+	if t.done {
+		return nil, nil, errTxDone
+	}
+
+	return db, func(c Change) error {
+		t.undo = append(t.undo, db.apply(c))
+		t.changes = append(t.changes, c)
+
+		return nil
+	}, nil
+}
+
+// timestamp rounds t the way postgres stores TIMESTAMP values.
+func timestamp(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// numeric rounds d the way postgres stores NUMERIC(28, 8) values.
+func numeric(d btcount.Decimal) btcount.Decimal {
+	return btcount.Decimal{Decimal: d.Round(btcount.MaxAmountScale)}
+}
+
+// errTxDone is returned if the repositories are used after the
+// transaction is finished.
+const errTxDone btcount.Error = "transaction is already finished"
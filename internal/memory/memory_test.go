@@ -0,0 +1,499 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+func TestTimerangeBounds(t *testing.T) {
+	ctx := context.Background()
+	db := Open()
+	r := db.Repos()
+	tstore, hstore := r.Transactions, r.History
+
+	hour := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		_, err := tstore.Save(ctx, btcount.Transaction{
+			WalletID: btcount.DefaultWalletID,
+			Amount:   btcount.DecimalFromFloat(1),
+			Datetime: hour.Add(time.Hour * time.Duration(i)),
+		})
+		assertNoError(t, err)
+
+		err = hstore.Save(ctx, btcount.HistoryStat{
+			WalletID: btcount.DefaultWalletID,
+			Datetime: hour.Add(time.Hour * time.Duration(i)),
+			Amount:   btcount.DecimalFromFloat(float64(i)),
+		})
+		assertNoError(t, err)
+	}
+
+	// Transactions exclude the upper bound.
+	ts, err := tstore.Load(ctx, btcount.DefaultWalletID, btcount.NewTimeRangeQuery(hour, hour.Add(time.Hour*2)))
+	assertNoError(t, err)
+	if len(ts) != 2 || !ts[0].Datetime.Equal(hour) {
+		t.Errorf("exp 2 transactions since %v, got: %v", hour, ts)
+	}
+
+	// Stats exclude the lower bound.
+	query := btcount.NewStatRangeQuery(hour, hour.Add(time.Hour*2))
+	hs, err := hstore.Load(ctx, btcount.DefaultWalletID, query)
+	assertNoError(t, err)
+	if len(hs) != 2 || !hs[0].Datetime.Equal(hour.Add(time.Hour)) {
+		t.Errorf("exp 2 stats since %v, got: %v", hour.Add(time.Hour), hs)
+	}
+
+	// Iteration selects the same stats and stops once ctx is done.
+	var iterated []btcount.HistoryStat
+	cctx, cancel := context.WithCancel(ctx)
+	err = hstore.Iterate(cctx, btcount.DefaultWalletID, query, func(stat btcount.HistoryStat) error {
+		iterated = append(iterated, stat)
+		cancel()
+
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || len(iterated) != 1 || !iterated[0].Datetime.Equal(hs[0].Datetime) {
+		t.Errorf("exp error: %v after the stat at %v, got: %v after %v", context.Canceled, hs[0].Datetime, err, iterated)
+	}
+
+	var iteratedTs []btcount.Transaction
+	cctx, cancel = context.WithCancel(ctx)
+	err = tstore.Iterate(cctx, btcount.DefaultWalletID, btcount.NewTimeRangeQuery(hour, hour.Add(time.Hour*2)), func(t btcount.Transaction) error {
+		iteratedTs = append(iteratedTs, t)
+		cancel()
+
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || len(iteratedTs) != 1 || iteratedTs[0].ID != ts[0].ID {
+		t.Errorf("exp error: %v after the transaction %v, got: %v after %v", context.Canceled, ts[0], err, iteratedTs)
+	}
+
+	last, err := hstore.LoadLastStat(ctx, btcount.DefaultWalletID, hour.Add(time.Hour))
+	assertNoError(t, err)
+	if !last.Datetime.Equal(hour.Add(time.Hour)) {
+		t.Errorf("exp last stat at %v, got: %v", hour.Add(time.Hour), last)
+	}
+
+	_, err = hstore.LoadLastStat(ctx, btcount.DefaultWalletID, hour.Add(-time.Nanosecond))
+	if !errors.Is(err, btcount.ErrNotFound) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrNotFound, err)
+	}
+
+	err = hstore.Delete(ctx, btcount.DefaultWalletID, query)
+	assertNoError(t, err)
+
+	hs, err = hstore.Load(ctx, btcount.DefaultWalletID, btcount.NewTimeRangeQuery(time.Time{}, hour.Add(time.Hour*3)))
+	assertNoError(t, err)
+	if len(hs) != 1 || !hs[0].Datetime.Equal(hour) {
+		t.Errorf("exp the stat at %v only, got: %v", hour, hs)
+	}
+}
+
+func TestTimerangeProperty(t *testing.T) {
+	ctx := context.Background()
+	db := Open()
+	r := db.Repos()
+
+	// Records are dated by quarters of hours, so random bounds often hit
+	// them exactly.
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	quarter := func(n int) time.Time {
+		return base.Add(time.Minute * 15 * time.Duration(n))
+	}
+
+	const quarters = 16
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 64; i++ {
+		datetime := quarter(rnd.Intn(quarters))
+		_, err := r.Transactions.Save(ctx, btcount.Transaction{
+			WalletID: btcount.DefaultWalletID,
+			Amount:   btcount.DecimalFromFloat(1),
+			Datetime: datetime,
+		})
+		assertNoError(t, err)
+
+		err = r.History.Save(ctx, btcount.HistoryStat{
+			WalletID: btcount.DefaultWalletID,
+			Datetime: datetime,
+		})
+		assertNoError(t, err)
+	}
+
+	all, err := r.Transactions.Load(ctx, btcount.DefaultWalletID, btcount.NewTimeRangeQuery(time.Time{}, quarter(quarters)))
+	assertNoError(t, err)
+	if len(all) != 64 {
+		t.Fatalf("exp 64 transactions, got: %d", len(all))
+	}
+
+	for i := 0; i < 1000; i++ {
+		since := rnd.Intn(quarters + 1)
+		query := btcount.TimerangeQuery{
+			Since:        quarter(since),
+			Till:         quarter(since + rnd.Intn(quarters+1-since)),
+			ExcludeSince: rnd.Intn(2) == 0,
+			IncludeTill:  rnd.Intn(2) == 0,
+		}
+
+		var exp int
+		for _, transaction := range all {
+			if query.Contains(transaction.Datetime) {
+				exp++
+			}
+		}
+
+		ts, err := r.Transactions.Load(ctx, btcount.DefaultWalletID, query)
+		assertNoError(t, err)
+
+		hs, err := r.History.Load(ctx, btcount.DefaultWalletID, query)
+		assertNoError(t, err)
+
+		if len(ts) != exp || len(hs) != exp {
+			t.Fatalf("%+v: exp %d records, got: %d transactions and %d stats", query, exp, len(ts), len(hs))
+		}
+
+		for _, transaction := range ts {
+			if !query.Contains(transaction.Datetime) {
+				t.Fatalf("%+v: unexpected transaction %v", query, transaction)
+			}
+		}
+	}
+
+	// Deleting stats by adjacent ranges removes every stat once.
+	for n := 0; n < quarters; n += 4 {
+		err = r.History.Delete(ctx, btcount.DefaultWalletID, btcount.NewTimeRangeQuery(quarter(n), quarter(n+4)))
+		assertNoError(t, err)
+	}
+
+	hs, err := r.History.Load(ctx, btcount.DefaultWalletID, btcount.NewTimeRangeQuery(time.Time{}, quarter(quarters)))
+	assertNoError(t, err)
+	if len(hs) != 0 {
+		t.Errorf("exp no stats left, got: %v", hs)
+	}
+}
+
+func TestRestoreLegacyDeleteStats(t *testing.T) {
+	ctx := context.Background()
+	hour := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	db := Open()
+	changes := []Change{{
+		Kind:     ChangeDeleteStats,
+		WalletID: btcount.DefaultWalletID,
+		Since:    hour,
+		Till:     hour.Add(time.Hour),
+	}}
+	for _, datetime := range []time.Time{hour, hour.Add(time.Hour)} {
+		changes = append([]Change{{
+			Kind:     ChangeSaveStat,
+			WalletID: btcount.DefaultWalletID,
+			Stat:     &btcount.HistoryStat{Datetime: datetime},
+		}}, changes...)
+	}
+
+	db.Restore(changes)
+
+	// Changes journaled without the range delete stats in (since, till].
+	hs, err := db.Repos().History.Load(ctx, btcount.DefaultWalletID, btcount.NewTimeRangeQuery(time.Time{}, hour.Add(time.Hour*2)))
+	assertNoError(t, err)
+	if len(hs) != 1 || !hs[0].Datetime.Equal(hour) {
+		t.Errorf("exp the stat at %v only, got: %v", hour, hs)
+	}
+}
+
+func TestTransactionList(t *testing.T) {
+	ctx := context.Background()
+	db := Open()
+	tstore := db.Repos().Transactions
+
+	hour := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	// Two transactions share the datetime, so they are ordered by id.
+	for _, offset := range []time.Duration{time.Hour, 0, time.Hour, time.Hour * 2} {
+		_, err := tstore.Save(ctx, btcount.Transaction{
+			WalletID: btcount.DefaultWalletID,
+			Amount:   btcount.DecimalFromFloat(float64(offset / time.Hour)),
+			Datetime: hour.Add(offset),
+		})
+		assertNoError(t, err)
+	}
+
+	one := btcount.DecimalFromFloat(1)
+
+	var tt = []struct {
+		name  string
+		query btcount.TransactionListQuery
+		exp   []int64
+	}{{
+		name:  "ascending",
+		query: btcount.TransactionListQuery{Limit: 10},
+		exp:   []int64{2, 1, 3, 4},
+	}, {
+		name:  "descending",
+		query: btcount.TransactionListQuery{Limit: 10, Descending: true},
+		exp:   []int64{4, 3, 1, 2},
+	}, {
+		name:  "limited",
+		query: btcount.TransactionListQuery{Limit: 2},
+		exp:   []int64{2, 1},
+	}, {
+		name:  "half-open range",
+		query: btcount.TransactionListQuery{Limit: 10, Since: hour.Add(time.Hour), Till: hour.Add(time.Hour * 2)},
+		exp:   []int64{1, 3},
+	}, {
+		name:  "amount range",
+		query: btcount.TransactionListQuery{Limit: 10, MinAmount: &one, MaxAmount: &one},
+		exp:   []int64{1, 3},
+	}, {
+		name: "after cursor",
+		query: btcount.TransactionListQuery{Limit: 10, After: &btcount.TransactionCursor{
+			Datetime: hour.Add(time.Hour),
+			ID:       1,
+		}},
+		exp: []int64{3, 4},
+	}, {
+		name: "after cursor descending",
+		query: btcount.TransactionListQuery{Limit: 10, Descending: true, After: &btcount.TransactionCursor{
+			Datetime:   hour.Add(time.Hour),
+			ID:         3,
+			Descending: true,
+		}},
+		exp: []int64{1, 2},
+	}}
+
+	for _, tc := range tt {
+		ts, err := tstore.List(ctx, btcount.DefaultWalletID, tc.query)
+		assertNoError(t, err)
+
+		got := make([]int64, 0, len(ts))
+		for _, t := range ts {
+			got = append(got, t.ID)
+		}
+
+		if len(got) != len(tc.exp) {
+			t.Errorf("%s: exp: %v, got: %v", tc.name, tc.exp, got)
+
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tc.exp[i] {
+				t.Errorf("%s: exp: %v, got: %v", tc.name, tc.exp, got)
+
+				break
+			}
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	db := Open()
+	r := db.Repos()
+
+	datetime := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	_, err := r.Transactions.Save(ctx, btcount.Transaction{
+		WalletID:       btcount.DefaultWalletID,
+		Amount:         btcount.DecimalFromFloat(1),
+		Datetime:       datetime,
+		IdempotencyKey: "key",
+	})
+	assertNoError(t, err)
+
+	_, err = r.Transactions.Save(ctx, btcount.Transaction{
+		WalletID:       btcount.DefaultWalletID,
+		Amount:         btcount.DecimalFromFloat(1),
+		Datetime:       datetime,
+		IdempotencyKey: "key",
+	})
+	if !errors.Is(err, btcount.ErrAlreadyExists) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrAlreadyExists, err)
+	}
+
+	errRollback := errors.New("rollback")
+	err = db.WithinTx(ctx, func(tx btcount.Repos) (err error) {
+		_, err = tx.Wallets.Lock(ctx, btcount.DefaultWalletID)
+		assertNoError(t, err)
+
+		_, err = tx.Transactions.Save(ctx, btcount.Transaction{
+			WalletID:       btcount.DefaultWalletID,
+			Amount:         btcount.DecimalFromFloat(2),
+			Datetime:       datetime,
+			IdempotencyKey: "rolled back",
+		})
+		assertNoError(t, err)
+
+		err = tx.History.Save(ctx, btcount.HistoryStat{
+			WalletID: btcount.DefaultWalletID,
+			Datetime: datetime.Add(time.Hour),
+			Amount:   btcount.DecimalFromFloat(3),
+		})
+		assertNoError(t, err)
+
+		err = tx.Wallets.Delete(ctx, btcount.DefaultWalletID)
+		assertNoError(t, err)
+
+		// The wallet is locked until the transaction is finished.
+		lockctx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+		defer cancel()
+
+		err = db.WithinTx(lockctx, func(locker btcount.Repos) (err error) {
+			_, err = locker.Wallets.Lock(lockctx, btcount.DefaultWalletID)
+
+			return err
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("exp error: %v, got: %v", context.DeadlineExceeded, err)
+		}
+
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Errorf("exp error: %v, got: %v", errRollback, err)
+	}
+
+	err = db.WithinTx(ctx, func(locker btcount.Repos) (err error) {
+		_, err = locker.Wallets.Lock(ctx, btcount.DefaultWalletID)
+
+		return err
+	})
+	assertNoError(t, err)
+
+	sum, err := r.Transactions.Sum(ctx, btcount.DefaultWalletID)
+	assertNoError(t, err)
+	if !sum.Equal(btcount.DecimalFromFloat(1)) {
+		t.Errorf("exp sum: 1, got: %v", sum)
+	}
+
+	_, err = r.History.LoadLastStat(ctx, btcount.DefaultWalletID, datetime.Add(time.Hour))
+	if !errors.Is(err, btcount.ErrNotFound) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrNotFound, err)
+	}
+
+	// Idempotency keys are restored together with transactions.
+	for _, tc := range []struct {
+		key string
+		err error
+	}{
+		{key: "key", err: btcount.ErrAlreadyExists},
+		{key: "rolled back"},
+	} {
+		_, err = r.Transactions.Save(ctx, btcount.Transaction{
+			WalletID:       btcount.DefaultWalletID,
+			Amount:         btcount.DecimalFromFloat(1),
+			Datetime:       datetime,
+			IdempotencyKey: tc.key,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("key %q: exp error: %v, got: %v", tc.key, tc.err, err)
+		}
+	}
+}
+
+func TestBalance(t *testing.T) {
+	ctx := context.Background()
+	db := Open()
+	r := db.Repos()
+
+	now := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		amount float64
+		offset time.Duration
+	}{{
+		amount: 10,
+		offset: -time.Hour,
+	}, {
+		amount: -3,
+		offset: time.Hour,
+	}, {
+		amount: 5,
+		offset: time.Hour * 2,
+	}} {
+		_, err := r.Transactions.Save(ctx, btcount.Transaction{
+			WalletID: btcount.DefaultWalletID,
+			Amount:   btcount.DecimalFromFloat(tc.amount),
+			Datetime: now.Add(tc.offset),
+		})
+		assertNoError(t, err)
+	}
+
+	errRollback := errors.New("rollback")
+	err := db.WithinTx(ctx, func(tx btcount.Repos) (err error) {
+		_, err = tx.Transactions.Save(ctx, btcount.Transaction{
+			WalletID: btcount.DefaultWalletID,
+			Amount:   btcount.DecimalFromFloat(100),
+			Datetime: now,
+		})
+		assertNoError(t, err)
+
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Errorf("exp error: %v, got: %v", errRollback, err)
+	}
+
+	var tt = []struct {
+		name string
+		sum  func() (btcount.Decimal, error)
+		exp  float64
+	}{{
+		name: "running balance",
+		sum:  func() (btcount.Decimal, error) { return r.Transactions.Sum(ctx, btcount.DefaultWalletID) },
+		exp:  12,
+	}, {
+		name: "balance now",
+		sum:  func() (btcount.Decimal, error) { return r.Transactions.Balance(ctx, btcount.DefaultWalletID, now) },
+		exp:  10,
+	}, {
+		name: "balance at the scheduled withdrawal",
+		sum: func() (btcount.Decimal, error) {
+			return r.Transactions.Balance(ctx, btcount.DefaultWalletID, now.Add(time.Hour))
+		},
+		exp: 7,
+	}, {
+		name: "available now",
+		sum: func() (btcount.Decimal, error) {
+			return r.Transactions.SumAvailable(ctx, btcount.DefaultWalletID, now)
+		},
+		exp: 7,
+	}, {
+		name: "sum before the scheduled withdrawal",
+		sum: func() (btcount.Decimal, error) {
+			return r.Transactions.SumBefore(ctx, btcount.DefaultWalletID, now.Add(time.Hour))
+		},
+		exp: 10,
+	}, {
+		name: "lowest since now",
+		sum: func() (btcount.Decimal, error) {
+			return r.Transactions.LowestBalance(ctx, btcount.DefaultWalletID, now)
+		},
+		exp: 7,
+	}, {
+		name: "lowest since before the deposit",
+		sum: func() (btcount.Decimal, error) {
+			return r.Transactions.LowestBalance(ctx, btcount.DefaultWalletID, now.Add(-time.Hour*2))
+		},
+		exp: 0,
+	}}
+
+	for _, tc := range tt {
+		sum, err := tc.sum()
+		assertNoError(t, err)
+
+		if !sum.Equal(btcount.DecimalFromFloat(tc.exp)) {
+			t.Errorf("%s: exp: %v, got: %s", tc.name, tc.exp, sum)
+		}
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,375 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// TransactionStore implements btcount.TransactionStorage interface for
+// the memory database. Transactions of every wallet are kept ordered by
+// datetime and id.
+type TransactionStore struct {
+	s scope
+}
+
+// Save implements btcount.TransactionStorage interface.
+func (ts TransactionStore) Save(ctx context.Context, transaction btcount.Transaction) (saved btcount.Transaction, err error) {
+	mdb, change, err := ts.s.open()
+	if err != nil {
+		return saved, err
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	return saveTransaction(mdb, change, transaction)
+}
+
+// SaveMany implements btcount.TransactionStorage interface.
+func (ts TransactionStore) SaveMany(ctx context.Context, transactions []btcount.Transaction) (saved []btcount.Transaction, err error) {
+	mdb, change, err := ts.s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	saved = make([]btcount.Transaction, len(transactions))
+	for i := range transactions {
+		saved[i], err = saveTransaction(mdb, change, transactions[i])
+		if errors.Is(err, btcount.ErrAlreadyExists) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inserting %v: %w", transactions[i], err)
+		}
+	}
+
+	return saved, nil
+}
+
+// saveTransaction saves the transaction. The caller should hold the
+// lock.
+func saveTransaction(mdb *DB, change func(c Change) error, transaction btcount.Transaction) (saved btcount.Transaction, err error) {
+	walletID := transaction.WalletID
+	if _, ok := mdb.wallets[walletID]; !ok {
+		return saved, fmt.Errorf("%w: wallet %d", btcount.ErrNotFound, walletID)
+	}
+
+	if _, ok := mdb.keys[walletID][transaction.IdempotencyKey]; ok && transaction.IdempotencyKey != "" {
+		return saved, fmt.Errorf("%w: idempotency key %q", btcount.ErrAlreadyExists, transaction.IdempotencyKey)
+	}
+
+	mdb.transactionSeq++
+	saved = btcount.Transaction{
+		ID:             mdb.transactionSeq,
+		WalletID:       walletID,
+		Amount:         numeric(transaction.Amount),
+		Datetime:       timestamp(transaction.Datetime),
+		IdempotencyKey: transaction.IdempotencyKey,
+		CreatedAt:      timestamp(time.Now()),
+	}
+
+	err = change(Change{
+		Kind:        ChangeSaveTransaction,
+		WalletID:    walletID,
+		Transaction: &saved,
+	})
+	if err != nil {
+		return btcount.Transaction{}, err
+	}
+
+	return saved, nil
+}
+
+// Get implements btcount.TransactionStorage interface.
+func (ts TransactionStore) Get(ctx context.Context, walletID, id int64) (t btcount.Transaction, err error) {
+	return findTransaction(ts.s, walletID, func(t btcount.Transaction) bool {
+		return t.ID == id
+	})
+}
+
+// LoadByIdempotencyKey implements btcount.TransactionStorage interface.
+func (ts TransactionStore) LoadByIdempotencyKey(ctx context.Context, walletID int64, key string) (t btcount.Transaction, err error) {
+	return findTransaction(ts.s, walletID, func(t btcount.Transaction) bool {
+		return key != "" && t.IdempotencyKey == key
+	})
+}
+
+// LoadByIdempotencyKeys implements btcount.TransactionStorage interface.
+func (ts TransactionStore) LoadByIdempotencyKeys(ctx context.Context, walletID int64, keys []string) (transactions []btcount.Transaction, err error) {
+	wanted := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if key != "" {
+			wanted[key] = struct{}{}
+		}
+	}
+
+	return filterTransactions(ts.s, walletID, func(t btcount.Transaction) bool {
+		_, ok := wanted[t.IdempotencyKey]
+
+		return ok
+	})
+}
+
+// Load implements btcount.TransactionStorage interface.
+func (ts TransactionStore) Load(ctx context.Context, walletID int64, query btcount.TimerangeQuery) (transactions []btcount.Transaction, err error) {
+	return filterTransactions(ts.s, walletID, func(t btcount.Transaction) bool {
+		return query.Contains(t.Datetime)
+	})
+}
+
+// Iterate implements btcount.TransactionStorage interface. Transactions
+// are iterated over the snapshot taken at the call, so fn does not hold
+// the lock.
+func (ts TransactionStore) Iterate(ctx context.Context, walletID int64, query btcount.TimerangeQuery, fn func(t btcount.Transaction) error) (err error) {
+	mdb, _, err := ts.s.open()
+	if err != nil {
+		return err
+	}
+
+	// Changes never modify transactions of the slices taken earlier, so
+	// the snapshot is left intact.
+	mdb.mu.RLock()
+	transactions := mdb.transactions[walletID]
+	mdb.mu.RUnlock()
+
+	for _, t := range transactions {
+		if !query.Contains(t.Datetime) {
+			continue
+		}
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		err = fn(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List implements btcount.TransactionStorage interface.
+func (ts TransactionStore) List(ctx context.Context, walletID int64, query btcount.TransactionListQuery) (transactions []btcount.Transaction, err error) {
+	transactions, err = filterTransactions(ts.s, walletID, func(t btcount.Transaction) bool {
+		switch {
+		case !query.Since.IsZero() && t.Datetime.Before(query.Since),
+			!query.Till.IsZero() && !t.Datetime.Before(query.Till),
+			query.MinAmount != nil && t.Amount.LessThan(*query.MinAmount),
+			query.MaxAmount != nil && t.Amount.GreaterThan(query.MaxAmount.Decimal):
+			return false
+		case query.After != nil && query.Descending:
+			return transactionLess(btcount.NewTransactionCursor(t, true), *query.After)
+		case query.After != nil:
+			return transactionLess(*query.After, btcount.NewTransactionCursor(t, false))
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Descending {
+		for i, j := 0, len(transactions)-1; i < j; i, j = i+1, j-1 {
+			transactions[i], transactions[j] = transactions[j], transactions[i]
+		}
+	}
+
+	if len(transactions) > query.Limit {
+		transactions = transactions[:query.Limit]
+	}
+
+	return transactions, nil
+}
+
+// Sum implements btcount.TransactionStorage interface.
+func (ts TransactionStore) Sum(ctx context.Context, walletID int64) (sum btcount.Decimal, err error) {
+	mdb, _, err := ts.s.open()
+	if err != nil {
+		return sum, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	return mdb.balances[walletID], nil
+}
+
+// Balance implements btcount.TransactionStorage interface.
+func (ts TransactionStore) Balance(ctx context.Context, walletID int64, at time.Time) (sum btcount.Decimal, err error) {
+	return sumExcept(ts.s, walletID, at, func(btcount.Transaction) bool { return true })
+}
+
+// SumBefore implements btcount.TransactionStorage interface.
+func (ts TransactionStore) SumBefore(ctx context.Context, walletID int64, at time.Time) (sum btcount.Decimal, err error) {
+	mdb, _, err := ts.s.open()
+	if err != nil {
+		return sum, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	sum = mdb.balances[walletID]
+
+	transactions := mdb.transactions[walletID]
+	for i := len(transactions) - 1; i >= 0 && !transactions[i].Datetime.Before(at); i-- {
+		sum = sum.Sub(transactions[i].Amount)
+	}
+
+	return sum, nil
+}
+
+// SumAvailable implements btcount.TransactionStorage interface.
+func (ts TransactionStore) SumAvailable(ctx context.Context, walletID int64, at time.Time) (sum btcount.Decimal, err error) {
+	return sumExcept(ts.s, walletID, at, func(t btcount.Transaction) bool {
+		return t.Amount.IsPositive()
+	})
+}
+
+// LowestBalance implements btcount.TransactionStorage interface.
+func (ts TransactionStore) LowestBalance(ctx context.Context, walletID int64, at time.Time) (low btcount.Decimal, err error) {
+	mdb, _, err := ts.s.open()
+	if err != nil {
+		return low, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	transactions := mdb.transactions[walletID]
+	i := sort.Search(len(transactions), func(i int) bool {
+		return transactions[i].Datetime.After(at)
+	})
+
+	balance := mdb.balances[walletID]
+	for _, t := range transactions[i:] {
+		balance = balance.Sub(t.Amount)
+	}
+
+	low = balance
+	for _, t := range transactions[i:] {
+		balance = balance.Add(t.Amount)
+		if balance.LessThan(low) {
+			low = balance
+		}
+	}
+
+	return low, nil
+}
+
+func findTransaction(s scope, walletID int64, match func(btcount.Transaction) bool) (t btcount.Transaction, err error) {
+	transactions, err := filterTransactions(s, walletID, match)
+	if err != nil {
+		return t, err
+	}
+
+	if len(transactions) == 0 {
+		return t, fmt.Errorf("looking up transaction: %w", btcount.ErrNotFound)
+	}
+
+	return transactions[0], nil
+}
+
+// filterTransactions returns a copy of transactions of the wallet
+// matched by match in ascending order.
+func filterTransactions(s scope, walletID int64, match func(btcount.Transaction) bool) (transactions []btcount.Transaction, err error) {
+	mdb, _, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	for _, t := range mdb.transactions[walletID] {
+		if match(t) {
+			transactions = append(transactions, t)
+		}
+	}
+
+	return transactions, nil
+}
+
+// sumExcept subtracts transactions scheduled after at and matched by
+// match from the running balance of the wallet.
+func sumExcept(s scope, walletID int64, at time.Time, match func(btcount.Transaction) bool) (sum btcount.Decimal, err error) {
+	mdb, _, err := s.open()
+	if err != nil {
+		return sum, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	sum = mdb.balances[walletID]
+
+	transactions := mdb.transactions[walletID]
+	for i := len(transactions) - 1; i >= 0 && transactions[i].Datetime.After(at); i-- {
+		if match(transactions[i]) {
+			sum = sum.Sub(transactions[i].Amount)
+		}
+	}
+
+	return sum, nil
+}
+
+// transactionLess reports whether a goes before b in ascending order.
+func transactionLess(a, b btcount.TransactionCursor) bool {
+	if !a.Datetime.Equal(b.Datetime) {
+		return a.Datetime.Before(b.Datetime)
+	}
+
+	return a.ID < b.ID
+}
+
+// insertTransaction inserts t into ts keeping the order. Transactions are
+// mostly saved in order, so t is appended in place if it goes last.
+// Otherwise a new slice is returned. Either way transactions of slices
+// returned earlier are left intact.
+func insertTransaction(ts []btcount.Transaction, t btcount.Transaction) []btcount.Transaction {
+	at := btcount.NewTransactionCursor(t, false)
+	if len(ts) == 0 || !transactionLess(at, btcount.NewTransactionCursor(ts[len(ts)-1], false)) {
+		return append(ts, t)
+	}
+
+	i := sort.Search(len(ts), func(i int) bool {
+		return transactionLess(at, btcount.NewTransactionCursor(ts[i], false))
+	})
+
+	inserted := make([]btcount.Transaction, 0, len(ts)+1)
+	inserted = append(inserted, ts[:i]...)
+	inserted = append(inserted, t)
+	inserted = append(inserted, ts[i:]...)
+
+	return inserted
+}
+
+// removeTransaction removes the transaction by its id. The last one is
+// cut off in place, the capacity is cut too, so the following appends do
+// not overwrite it in slices returned earlier.
+func removeTransaction(ts []btcount.Transaction, id int64) []btcount.Transaction {
+	if n := len(ts); n > 0 && ts[n-1].ID == id {
+		return ts[: n-1 : n-1]
+	}
+
+	removed := make([]btcount.Transaction, 0, len(ts))
+	for _, t := range ts {
+		if t.ID != id {
+			removed = append(removed, t)
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// WalletStore implements btcount.WalletStorage interface for the memory
+// database.
+type WalletStore struct {
+	s scope
+}
+
+// Create implements btcount.WalletStorage interface.
+func (ws WalletStore) Create(ctx context.Context, wallet btcount.Wallet) (created btcount.Wallet, err error) {
+	mdb, change, err := ws.s.open()
+	if err != nil {
+		return created, err
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	mdb.walletSeq++
+	created = btcount.Wallet{
+		ID:        mdb.walletSeq,
+		Name:      wallet.Name,
+		CreatedAt: timestamp(time.Now()),
+	}
+
+	err = change(Change{
+		Kind:     ChangeCreateWallet,
+		WalletID: created.ID,
+		Wallet:   &created,
+	})
+	if err != nil {
+		return btcount.Wallet{}, err
+	}
+
+	return created, nil
+}
+
+// Get implements btcount.WalletStorage interface.
+func (ws WalletStore) Get(ctx context.Context, id int64) (wallet btcount.Wallet, err error) {
+	mdb, _, err := ws.s.open()
+	if err != nil {
+		return wallet, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	wallet, ok := mdb.wallets[id]
+	if !ok {
+		return wallet, fmt.Errorf("looking up wallet: %w", btcount.ErrNotFound)
+	}
+
+	return wallet, nil
+}
+
+// Lock implements btcount.WalletStorage interface. The wallet is locked
+// only within a transaction, otherwise it is just loaded.
+func (ws WalletStore) Lock(ctx context.Context, id int64) (wallet btcount.Wallet, err error) {
+	if t := ws.s.tx; t != nil && !t.done {
+		if _, locked := t.locked[id]; !locked {
+			err = ws.s.db.lockWallet(ctx, id)
+			if err != nil {
+				return wallet, fmt.Errorf("locking wallet: %w", err)
+			}
+
+			t.locked[id] = struct{}{}
+		}
+	}
+
+	return ws.Get(ctx, id)
+}
+
+// List implements btcount.WalletStorage interface.
+func (ws WalletStore) List(ctx context.Context) (wallets []btcount.Wallet, err error) {
+	mdb, _, err := ws.s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	for _, wallet := range mdb.wallets {
+		wallets = append(wallets, wallet)
+	}
+
+	sortWallets(wallets)
+
+	return wallets, nil
+}
+
+func sortWallets(wallets []btcount.Wallet) {
+	sort.Slice(wallets, func(i, j int) bool { return wallets[i].ID < wallets[j].ID })
+}
+
+// Delete implements btcount.WalletStorage interface. Transactions and
+// stats of the wallet are removed as well.
+func (ws WalletStore) Delete(ctx context.Context, id int64) (err error) {
+	mdb, change, err := ws.s.open()
+	if err != nil {
+		return err
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if _, ok := mdb.wallets[id]; !ok {
+		return fmt.Errorf("looking up wallet: %w", btcount.ErrNotFound)
+	}
+
+	return change(Change{
+		Kind:     ChangeDeleteWallet,
+		WalletID: id,
+	})
+}
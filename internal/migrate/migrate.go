@@ -0,0 +1,171 @@
+// Package migrate applies versioned migrations of the database schema.
+//
+// Migrations are SQL files embedded into the binary and named
+// VERSION_NAME.up.sql and VERSION_NAME.down.sql, e.g.
+// 0001_init.up.sql. Applied migrations are recorded in public.migrations
+// with checksums, so migrations edited after being applied are detected.
+package migrate
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// Dir is the directory of migrations relative to the root of the module.
+// New migrations are created there.
+const Dir = "internal/migrate/migrations"
+
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+var (
+	fileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+	nameRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// Migration is a single change of the schema.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	// Down reverts the migration. The migration is irreversible if it is
+	// empty.
+	Down string
+}
+
+// ID returns the identifier of the migration recorded in the database,
+// e.g. 0001_init.
+func (m Migration) ID() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Checksum returns the checksum of the up migration.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Migrations returns migrations embedded into the binary ordered by
+// version.
+func Migrations() (migrations []Migration, err error) {
+	sub, err := fs.Sub(embedded, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("opening migrations: %w", err)
+	}
+
+	return Parse(sub)
+}
+
+// Parse reads migrations from the root of fsys and returns them ordered
+// by version. Every version should have a single name and the up
+// migration.
+func Parse(fsys fs.FS) (migrations []Migration, err error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := fileRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%w: migration file name %q", btcount.ErrInvalidParameter, entry.Name())
+		}
+
+		var version int64
+		version, err = strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("%w: migration version %q", btcount.ErrInvalidParameter, match[1])
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("%w: migrations %s and %s share the version", btcount.ErrInvalidParameter, m.ID(), match[2])
+		}
+
+		var content []byte
+		content, err = fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("%w: migration %s has no up migration", btcount.ErrInvalidParameter, m.ID())
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Create creates empty up and down migrations in dir with the version
+// following the latest one.
+func Create(dir, name string, migrations []Migration) (created Migration, paths []string, err error) {
+	if !nameRe.MatchString(name) {
+		return created, nil, fmt.Errorf("%w: migration name %q should consist of a-z, 0-9 and _", btcount.ErrInvalidParameter, name)
+	}
+
+	created = Migration{Version: 1, Name: name}
+	if len(migrations) > 0 {
+		created.Version = migrations[len(migrations)-1].Version + 1
+	}
+
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, created.ID()+"."+direction+".sql")
+		content := fmt.Sprintf("-- Migration %s (%s).\n", created.ID(), direction)
+
+		// The file is never overwritten.
+		var f *os.File
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err != nil {
+			return created, paths, fmt.Errorf("creating file: %w", err)
+		}
+
+		_, err = f.WriteString(content)
+		if err != nil {
+			_ = f.Close()
+
+			return created, paths, fmt.Errorf("writing file: %w", err)
+		}
+
+		err = f.Close()
+		if err != nil {
+			return created, paths, fmt.Errorf("closing file: %w", err)
+		}
+
+		paths = append(paths, path)
+	}
+
+	return created, paths, nil
+}
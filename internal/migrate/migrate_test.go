@@ -0,0 +1,153 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+func TestParse(t *testing.T) {
+	file := func(content string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(content)}
+	}
+
+	var tt = []struct {
+		name  string
+		fsys  fstest.MapFS
+		expID []string
+		err   error
+	}{{
+		name: "ordered by version",
+		fsys: fstest.MapFS{
+			"0010_third.up.sql":   file("c"),
+			"0002_second.up.sql":  file("b"),
+			"0001_first.up.sql":   file("a"),
+			"0001_first.down.sql": file("-a"),
+		},
+		expID: []string{"0001_first", "0002_second", "0010_third"},
+	}, {
+		name: "empty",
+		fsys: fstest.MapFS{},
+	}, {
+		name: "bad file name",
+		fsys: fstest.MapFS{"0001_First.up.sql": file("a")},
+		err:  btcount.ErrInvalidParameter,
+	}, {
+		name: "zero version",
+		fsys: fstest.MapFS{"0000_init.up.sql": file("a")},
+		err:  btcount.ErrInvalidParameter,
+	}, {
+		name: "shared version",
+		fsys: fstest.MapFS{
+			"0001_first.up.sql":  file("a"),
+			"0001_second.up.sql": file("b"),
+		},
+		err: btcount.ErrInvalidParameter,
+	}, {
+		name: "no up migration",
+		fsys: fstest.MapFS{"0001_first.down.sql": file("a")},
+		err:  btcount.ErrInvalidParameter,
+	}}
+
+	for _, tc := range tt {
+		migrations, err := Parse(tc.fsys)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: exp error: %v, got: %v", tc.name, tc.err, err)
+
+			continue
+		}
+
+		if len(migrations) != len(tc.expID) {
+			t.Errorf("%s: exp %d migrations, got: %d", tc.name, len(tc.expID), len(migrations))
+
+			continue
+		}
+
+		for i, m := range migrations {
+			if m.ID() != tc.expID[i] {
+				t.Errorf("%s: exp migration %d: %s, got: %s", tc.name, i, tc.expID[i], m.ID())
+			}
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	assertNoError(t, err)
+
+	if len(migrations) == 0 {
+		t.Fatal("exp embedded migrations")
+	}
+
+	// The first migrations were recorded by the previous migrator with
+	// these names, so they should not be renamed.
+	if id := migrations[0].ID(); id != "0001_init" {
+		t.Errorf("exp first migration: 0001_init, got: %s", id)
+	}
+
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("exp version of %s: %d", m.ID(), i+1)
+		}
+
+		if m.Down == "" {
+			t.Errorf("exp down migration of %s", m.ID())
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+
+	migrations := []Migration{{Version: 1, Name: "init", Up: "a"}}
+
+	created, paths, err := Create(dir, "add_index", migrations)
+	assertNoError(t, err)
+
+	if created.ID() != "0002_add_index" {
+		t.Errorf("exp created migration: 0002_add_index, got: %s", created.ID())
+	}
+
+	if len(paths) != 2 {
+		t.Fatalf("exp 2 files, got: %v", paths)
+	}
+
+	parsed, err := Parse(os.DirFS(dir))
+	assertNoError(t, err)
+
+	if len(parsed) != 1 || parsed[0].ID() != created.ID() {
+		t.Errorf("exp created migration to be parsed, got: %v", parsed)
+	}
+
+	err = os.WriteFile(paths[0], []byte("edited"), 0o644)
+	assertNoError(t, err)
+
+	_, _, err = Create(dir, "add_index", migrations)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("exp error: %v, got: %v", os.ErrExist, err)
+	}
+
+	content, err := os.ReadFile(filepath.Clean(paths[0]))
+	assertNoError(t, err)
+
+	if string(content) != "edited" {
+		t.Errorf("exp existing migration not to be overwritten, got: %q", content)
+	}
+
+	_, _, err = Create(dir, "Bad Name", migrations)
+	if !errors.Is(err, btcount.ErrInvalidParameter) {
+		t.Errorf("exp error: %v, got: %v", btcount.ErrInvalidParameter, err)
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
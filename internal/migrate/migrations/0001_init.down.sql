@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS btcount.history_stats;
+DROP TABLE IF EXISTS btcount.transactions;
+DROP SCHEMA IF EXISTS btcount;
@@ -0,0 +1,13 @@
+CREATE SCHEMA IF NOT EXISTS btcount;
+
+CREATE TABLE IF NOT EXISTS btcount.transactions (
+    "id" BIGSERIAL PRIMARY KEY,
+    "datetime" TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT now(),
+    "amount" FLOAT8 NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS btcount.history_stats (
+    "id" BIGSERIAL PRIMARY KEY,
+    "datetime" TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT now(),
+    "amount" FLOAT8 NOT NULL
+);
@@ -0,0 +1,11 @@
+-- Data of other wallets than the default one is removed.
+DELETE FROM btcount.transactions WHERE "wallet_id" <> 1;
+DELETE FROM btcount.history_stats WHERE "wallet_id" <> 1;
+
+DROP INDEX IF EXISTS btcount.history_stats_wallet_id_datetime_idx;
+DROP INDEX IF EXISTS btcount.transactions_wallet_id_datetime_idx;
+
+ALTER TABLE btcount.history_stats DROP COLUMN "wallet_id";
+ALTER TABLE btcount.transactions DROP COLUMN "wallet_id";
+
+DROP TABLE IF EXISTS btcount.wallets;
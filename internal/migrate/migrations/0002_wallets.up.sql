@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS btcount.wallets (
+    "id" BIGSERIAL PRIMARY KEY,
+    "name" TEXT NOT NULL,
+    "created_at" TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (now() AT TIME ZONE 'utc')
+);
+
+INSERT INTO btcount.wallets ("name") VALUES ('default');
+
+ALTER TABLE btcount.transactions
+    ADD COLUMN "wallet_id" BIGINT NOT NULL DEFAULT 1
+    REFERENCES btcount.wallets ("id") ON DELETE CASCADE;
+ALTER TABLE btcount.transactions ALTER COLUMN "wallet_id" DROP DEFAULT;
+
+ALTER TABLE btcount.history_stats
+    ADD COLUMN "wallet_id" BIGINT NOT NULL DEFAULT 1
+    REFERENCES btcount.wallets ("id") ON DELETE CASCADE;
+ALTER TABLE btcount.history_stats ALTER COLUMN "wallet_id" DROP DEFAULT;
+
+CREATE INDEX IF NOT EXISTS transactions_wallet_id_datetime_idx
+    ON btcount.transactions ("wallet_id", "datetime");
+CREATE INDEX IF NOT EXISTS history_stats_wallet_id_datetime_idx
+    ON btcount.history_stats ("wallet_id", "datetime");
@@ -0,0 +1,2 @@
+ALTER TABLE btcount.history_stats ALTER COLUMN "amount" TYPE FLOAT8;
+ALTER TABLE btcount.transactions ALTER COLUMN "amount" TYPE FLOAT8;
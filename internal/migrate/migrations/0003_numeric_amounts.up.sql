@@ -0,0 +1,8 @@
+-- Amounts are rounded to satoshi precision, see btcount.MaxAmountScale.
+ALTER TABLE btcount.transactions
+    ALTER COLUMN "amount" TYPE NUMERIC(28, 8)
+    USING round("amount"::NUMERIC, 8);
+
+ALTER TABLE btcount.history_stats
+    ALTER COLUMN "amount" TYPE NUMERIC(28, 8)
+    USING round("amount"::NUMERIC, 8);
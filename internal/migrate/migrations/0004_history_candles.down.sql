@@ -0,0 +1,7 @@
+ALTER TABLE btcount.history_stats
+    DROP COLUMN "open",
+    DROP COLUMN "high",
+    DROP COLUMN "low",
+    DROP COLUMN "inflow",
+    DROP COLUMN "outflow",
+    DROP COLUMN "count";
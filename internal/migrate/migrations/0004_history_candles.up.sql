@@ -0,0 +1,41 @@
+-- Existing stats are backfilled from transactions, the open balance is
+-- the balance before the first transaction of the hour.
+ALTER TABLE btcount.history_stats
+    ADD COLUMN "open" NUMERIC(28, 8) NOT NULL DEFAULT 0,
+    ADD COLUMN "high" NUMERIC(28, 8) NOT NULL DEFAULT 0,
+    ADD COLUMN "low" NUMERIC(28, 8) NOT NULL DEFAULT 0,
+    ADD COLUMN "inflow" NUMERIC(28, 8) NOT NULL DEFAULT 0,
+    ADD COLUMN "outflow" NUMERIC(28, 8) NOT NULL DEFAULT 0,
+    ADD COLUMN "count" BIGINT NOT NULL DEFAULT 0;
+
+UPDATE btcount.history_stats SET
+    "open" = "amount",
+    "high" = "amount",
+    "low" = "amount";
+
+WITH balances AS (
+    SELECT "wallet_id",
+        date_trunc('hour', "datetime") + INTERVAL '1 hour' AS "bucket",
+        "amount",
+        SUM("amount") OVER (PARTITION BY "wallet_id" ORDER BY "datetime", "id") AS "balance",
+        row_number() OVER (PARTITION BY "wallet_id", date_trunc('hour', "datetime") ORDER BY "datetime", "id") AS "n"
+    FROM btcount.transactions
+), candles AS (
+    SELECT "wallet_id", "bucket",
+        MAX("balance" - "amount") FILTER (WHERE "n" = 1) AS "open",
+        MAX("balance") AS "high",
+        MIN("balance") AS "low",
+        SUM(GREATEST("amount", 0)) AS "inflow",
+        SUM(GREATEST(-"amount", 0)) AS "outflow",
+        COUNT(1) AS "count"
+    FROM balances GROUP BY "wallet_id", "bucket"
+)
+UPDATE btcount.history_stats AS s SET
+    "open" = c."open",
+    "high" = GREATEST(c."high", c."open"),
+    "low" = LEAST(c."low", c."open"),
+    "inflow" = c."inflow",
+    "outflow" = c."outflow",
+    "count" = c."count"
+FROM candles AS c
+WHERE s."wallet_id" = c."wallet_id" AND s."datetime" = c."bucket";
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS btcount.transactions_wallet_id_idempotency_key_idx;
+
+ALTER TABLE btcount.transactions DROP COLUMN "idempotency_key";
@@ -0,0 +1,8 @@
+-- Empty keys are not unique, so transactions without a key are not
+-- affected by the index.
+ALTER TABLE btcount.transactions
+    ADD COLUMN "idempotency_key" TEXT NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_wallet_id_idempotency_key_idx
+    ON btcount.transactions ("wallet_id", "idempotency_key")
+    WHERE "idempotency_key" <> '';
@@ -0,0 +1,5 @@
+CREATE INDEX IF NOT EXISTS transactions_wallet_id_datetime_idx
+    ON btcount.transactions ("wallet_id", "datetime");
+DROP INDEX IF EXISTS btcount.transactions_wallet_id_datetime_id_idx;
+
+ALTER TABLE btcount.transactions DROP COLUMN "created_at";
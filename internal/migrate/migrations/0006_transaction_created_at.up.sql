@@ -0,0 +1,8 @@
+-- Existing transactions get the time of the migration. The index is
+-- extended by the id for keyset pagination.
+ALTER TABLE btcount.transactions
+    ADD COLUMN "created_at" TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (now() AT TIME ZONE 'utc');
+
+CREATE INDEX IF NOT EXISTS transactions_wallet_id_datetime_id_idx
+    ON btcount.transactions ("wallet_id", "datetime", "id");
+DROP INDEX IF EXISTS btcount.transactions_wallet_id_datetime_idx;
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS wallets_notify_deleted ON btcount.wallets;
+DROP FUNCTION IF EXISTS btcount.notify_wallet_deleted();
+
+DROP TRIGGER IF EXISTS transactions_notify_saved ON btcount.transactions;
+DROP FUNCTION IF EXISTS btcount.notify_transaction_saved();
@@ -0,0 +1,29 @@
+-- Every instance of the service listens to the changes to keep its cache
+-- consistent. Timestamps are formatted as UTC, the same way they are
+-- stored.
+CREATE OR REPLACE FUNCTION btcount.notify_transaction_saved() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('btcount_transactions', json_build_object(
+        'id', NEW."id",
+        'walletId', NEW."wallet_id",
+        'amount', NEW."amount"::TEXT,
+        'datetime', to_char(NEW."datetime", 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+        'idempotencyKey', NEW."idempotency_key",
+        'createdAt', to_char(NEW."created_at", 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+    )::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER transactions_notify_saved AFTER INSERT ON btcount.transactions
+    FOR EACH ROW EXECUTE PROCEDURE btcount.notify_transaction_saved();
+
+CREATE OR REPLACE FUNCTION btcount.notify_wallet_deleted() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('btcount_wallets', OLD."id"::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER wallets_notify_deleted AFTER DELETE ON btcount.wallets
+    FOR EACH ROW EXECUTE PROCEDURE btcount.notify_wallet_deleted();
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS btcount.wallet_balances;
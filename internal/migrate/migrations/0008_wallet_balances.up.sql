@@ -0,0 +1,11 @@
+-- The running balance is the sum of all transactions of the wallet.
+-- Transactions are locked from inserting while it is backfilled.
+CREATE TABLE IF NOT EXISTS btcount.wallet_balances (
+    "wallet_id" BIGINT PRIMARY KEY REFERENCES btcount.wallets ("id") ON DELETE CASCADE,
+    "amount" NUMERIC(28, 8) NOT NULL DEFAULT 0
+);
+
+LOCK TABLE btcount.transactions IN SHARE MODE;
+
+INSERT INTO btcount.wallet_balances ("wallet_id", "amount")
+    SELECT "wallet_id", SUM("amount") FROM btcount.transactions GROUP BY "wallet_id";
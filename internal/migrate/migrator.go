@@ -0,0 +1,436 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// lockKey is the key of the advisory lock held while migrating, so
+// concurrent migrators wait for each other.
+const lockKey int64 = 0x6274636f756e74 // "btcount"
+
+// Status is the state of the migration in the database.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is set if the migration is changed after being applied.
+	Modified bool
+	// Unknown is set if the migration is applied but it is not known.
+	// Such migration has the version and the name only.
+	Unknown bool
+}
+
+// Migrator applies migrations to the database.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New creates a migrator of the database with known migrations ordered
+// by version.
+func New(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}
+}
+
+// record is the applied migration.
+type record struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Status returns states of known and unknown applied migrations ordered
+// by version.
+func (m *Migrator) Status(ctx context.Context) (statuses []Status, err error) {
+	err = m.locked(ctx, func(conn *sql.Conn, records map[int64]record) error {
+		statuses = m.status(records)
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+func (m *Migrator) status(records map[int64]record) (statuses []Status) {
+	known := make(map[int64]struct{}, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = struct{}{}
+
+		s := Status{Migration: migration}
+		if r, ok := records[migration.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = r.appliedAt
+			// Migrations recorded before checksums were introduced are
+			// trusted.
+			s.Modified = r.checksum != "" && r.checksum != migration.Checksum()
+		}
+
+		statuses = append(statuses, s)
+	}
+
+	for version, r := range records {
+		if _, ok := known[version]; ok {
+			continue
+		}
+
+		statuses = append(statuses, Status{
+			Migration: Migration{Version: version, Name: r.name},
+			Applied:   true,
+			AppliedAt: r.appliedAt,
+			Unknown:   true,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses
+}
+
+// Version returns the latest applied version or 0 if nothing is applied.
+func (m *Migrator) Version(ctx context.Context) (version int64, err error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range statuses {
+		if s.Applied && s.Version > version {
+			version = s.Version
+		}
+	}
+
+	return version, nil
+}
+
+// Check returns the latest applied version and the amount of pending
+// migrations. It fails if the database has unknown or modified
+// migrations, so the schema is not the one the migrations make.
+func (m *Migrator) Check(ctx context.Context) (version int64, pending int, err error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	statuses, err = checkStatuses(statuses)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, s := range statuses {
+		if !s.Applied {
+			pending++
+
+			continue
+		}
+
+		if s.Version > version {
+			version = s.Version
+		}
+	}
+
+	return version, pending, nil
+}
+
+// Up applies all pending migrations in order.
+func (m *Migrator) Up(ctx context.Context) (applied []Migration, err error) {
+	var latest int64
+	if len(m.migrations) > 0 {
+		latest = m.migrations[len(m.migrations)-1].Version
+	}
+
+	applied, _, err = m.Goto(ctx, latest)
+
+	return applied, err
+}
+
+// Down reverts n latest applied migrations.
+func (m *Migrator) Down(ctx context.Context, n int) (reverted []Migration, err error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: amount of migrations to revert should be positive", btcount.ErrInvalidParameter)
+	}
+
+	err = m.locked(ctx, func(conn *sql.Conn, records map[int64]record) (err error) {
+		statuses, err := checkStatuses(m.status(records))
+		if err != nil {
+			return err
+		}
+
+		for i := len(statuses) - 1; i >= 0 && len(reverted) < n; i-- {
+			if !statuses[i].Applied {
+				continue
+			}
+
+			err = revert(ctx, conn, statuses[i].Migration)
+			if err != nil {
+				return err
+			}
+
+			reverted = append(reverted, statuses[i].Migration)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Goto applies pending migrations up to the version and reverts applied
+// migrations after it. Version 0 reverts all migrations.
+func (m *Migrator) Goto(ctx context.Context, version int64) (applied, reverted []Migration, err error) {
+	if version != 0 && !m.known(version) {
+		return nil, nil, fmt.Errorf("%w: unknown migration version %d", btcount.ErrInvalidParameter, version)
+	}
+
+	err = m.locked(ctx, func(conn *sql.Conn, records map[int64]record) (err error) {
+		statuses, err := checkStatuses(m.status(records))
+		if err != nil {
+			return err
+		}
+
+		for i := len(statuses) - 1; i >= 0; i-- {
+			if !statuses[i].Applied || statuses[i].Version <= version {
+				continue
+			}
+
+			err = revert(ctx, conn, statuses[i].Migration)
+			if err != nil {
+				return err
+			}
+
+			reverted = append(reverted, statuses[i].Migration)
+		}
+
+		for _, s := range statuses {
+			if s.Version > version {
+				break
+			}
+
+			if s.Applied {
+				// Migrations recorded before checksums were introduced
+				// get them.
+				if records[s.Version].checksum == "" {
+					err = adopt(ctx, conn, s.Migration)
+					if err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			err = apply(ctx, conn, s.Migration)
+			if err != nil {
+				return err
+			}
+
+			applied = append(applied, s.Migration)
+		}
+
+		return nil
+	})
+
+	return applied, reverted, err
+}
+
+func (m *Migrator) known(version int64) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkStatuses checks the applied migrations are the known ones, so the
+// schema is in the known state.
+func checkStatuses(statuses []Status) ([]Status, error) {
+	for _, s := range statuses {
+		if s.Unknown {
+			return nil, fmt.Errorf("%w: migration %s is applied but unknown", btcount.ErrSchemaNewer, s.ID())
+		}
+
+		if s.Modified {
+			return nil, fmt.Errorf("%w: %s", btcount.ErrMigrationModified, s.ID())
+		}
+	}
+
+	return statuses, nil
+}
+
+// locked runs fn holding the advisory lock on a single connection with
+// applied migrations loaded.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, records map[int64]record) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("acquiring connection: %w", err)
+	}
+	defer func() {
+		// The lock is released with the session if unlocking fails.
+		errclose := conn.Close()
+		if err == nil && errclose != nil {
+			err = fmt.Errorf("closing connection: %w", errclose)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return fmt.Errorf("acquiring lock: %w", err)
+	}
+	defer func() {
+		_, errunlock := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+		if err == nil && errunlock != nil {
+			err = fmt.Errorf("releasing lock: %w", errunlock)
+		}
+	}()
+
+	err = makeschema(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("making schema: %w", err)
+	}
+
+	records, err := loadRecords(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("loading applied migrations: %w", err)
+	}
+
+	return fn(conn, records)
+}
+
+// makeschema creates the table of applied migrations. The table created
+// by the previous migrator has names only, so the other columns are
+// added and the versions are taken from the names.
+func makeschema(ctx context.Context, conn *sql.Conn) (err error) {
+	const query = `CREATE TABLE IF NOT EXISTS public.migrations ("name" TEXT PRIMARY KEY);
+	ALTER TABLE public.migrations` +
+		` ADD COLUMN IF NOT EXISTS "version" BIGINT` +
+		`, ADD COLUMN IF NOT EXISTS "checksum" TEXT NOT NULL DEFAULT ''` +
+		`, ADD COLUMN IF NOT EXISTS "applied_at" TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (now() AT TIME ZONE 'utc');
+	UPDATE public.migrations SET "version" = split_part("name", '_', 1)::BIGINT WHERE "version" IS NULL;`
+
+	_, err = conn.ExecContext(ctx, query)
+
+	return err
+}
+
+func loadRecords(ctx context.Context, conn *sql.Conn) (records map[int64]record, err error) {
+	const query = `SELECT "version", "name", "checksum", "applied_at" FROM public.migrations`
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %w", err)
+	}
+	defer func() {
+		// The error is checked by rows.Err.
+		_ = rows.Close()
+	}()
+
+	records = make(map[int64]record)
+	for rows.Next() {
+		var r record
+		err = rows.Scan(&r.version, &r.name, &r.checksum, &r.appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+
+		// The name is recorded together with the version.
+		if parts := strings.SplitN(r.name, "_", 2); len(parts) == 2 {
+			r.name = parts[1]
+		}
+
+		records[r.version] = r
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+
+	return records, nil
+}
+
+func apply(ctx context.Context, conn *sql.Conn, migration Migration) (err error) {
+	const query = `INSERT INTO public.migrations ("name", "version", "checksum") VALUES ($1, $2, $3)`
+
+	return withinTx(ctx, conn, func(tx *sql.Tx) (err error) {
+		_, err = tx.ExecContext(ctx, migration.Up)
+		if err != nil {
+			return fmt.Errorf("applying migration %s: %w", migration.ID(), err)
+		}
+
+		_, err = tx.ExecContext(ctx, query, migration.ID(), migration.Version, migration.Checksum())
+		if err != nil {
+			return fmt.Errorf("recording migration %s: %w", migration.ID(), err)
+		}
+
+		return nil
+	})
+}
+
+func revert(ctx context.Context, conn *sql.Conn, migration Migration) (err error) {
+	const query = `DELETE FROM public.migrations WHERE "version" = $1`
+
+	if strings.TrimSpace(migration.Down) == "" {
+		return fmt.Errorf("%w: %s", btcount.ErrIrreversible, migration.ID())
+	}
+
+	return withinTx(ctx, conn, func(tx *sql.Tx) (err error) {
+		_, err = tx.ExecContext(ctx, migration.Down)
+		if err != nil {
+			return fmt.Errorf("reverting migration %s: %w", migration.ID(), err)
+		}
+
+		_, err = tx.ExecContext(ctx, query, migration.Version)
+		if err != nil {
+			return fmt.Errorf("unrecording migration %s: %w", migration.ID(), err)
+		}
+
+		return nil
+	})
+}
+
+func adopt(ctx context.Context, conn *sql.Conn, migration Migration) (err error) {
+	const query = `UPDATE public.migrations SET "checksum" = $2 WHERE "version" = $1`
+
+	_, err = conn.ExecContext(ctx, query, migration.Version, migration.Checksum())
+	if err != nil {
+		return fmt.Errorf("recording checksum of migration %s: %w", migration.ID(), err)
+	}
+
+	return nil
+}
+
+// withinTx runs fn within a transaction, so every migration is applied
+// or reverted entirely.
+func withinTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+
+	err = fn(tx)
+	if err != nil {
+		// The error of the migration is more relevant.
+		_ = tx.Rollback()
+
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+
+	"go.uber.org/zap"
+)
+
+// Follower publishes transactions saved by every instance of the service
+// to the broker. It implements btcount.ChangeHandler interface.
+type Follower struct {
+	b     *Broker
+	store btcount.Store
+	log   *zap.Logger
+}
+
+// NewFollower creates a follower publishing to the broker.
+func NewFollower(b *Broker, store btcount.Store, log *zap.Logger) *Follower {
+	return &Follower{
+		b:     b,
+		store: store,
+		log:   log,
+	}
+}
+
+// Resync implements btcount.ChangeHandler interface. Changes made while
+// the feed was disconnected are unknown, so the broker is reset and
+// subscribers reload the balance.
+func (f *Follower) Resync(ctx context.Context) (err error) {
+	f.log.Debug("resetting events")
+	f.b.Reset()
+
+	return nil
+}
+
+// TransactionsSaved implements btcount.ChangeHandler interface.
+// Transactions are published with the current balance of their wallet,
+// which is loaded once per wallet, so batches do not load it for every
+// transaction. Transactions of wallets nobody is subscribed to are
+// skipped without loading the balance.
+func (f *Follower) TransactionsSaved(ctx context.Context, ts []btcount.Transaction) (err error) {
+	now := time.Now().UTC()
+	balances := make(map[int64]btcount.Decimal)
+	skipped := make(map[int64]bool)
+
+	for i := range ts {
+		t := ts[i]
+		if skipped[t.WalletID] {
+			continue
+		}
+
+		balance, ok := balances[t.WalletID]
+		if !ok {
+			if f.b.Skip(t.WalletID) {
+				skipped[t.WalletID] = true
+
+				continue
+			}
+
+			balance, err = f.store.Repos().Transactions.Balance(ctx, t.WalletID, now)
+			if err != nil {
+				return fmt.Errorf("loading balance of wallet %d: %w", t.WalletID, err)
+			}
+
+			balances[t.WalletID] = balance
+		}
+
+		f.b.Publish(Event{
+			Kind:        KindTransaction,
+			WalletID:    t.WalletID,
+			Transaction: &t,
+			Balance:     balance,
+		})
+	}
+
+	return nil
+}
+
+// WalletDeleted implements btcount.ChangeHandler interface.
+func (f *Follower) WalletDeleted(ctx context.Context, walletID int64) (err error) {
+	return nil
+}
@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/memory"
+
+	"go.uber.org/zap"
+)
+
+func TestFollower(t *testing.T) {
+	ctx := context.Background()
+	store := memory.Open()
+
+	b := NewBroker(4)
+	follower := NewFollower(b, store, zap.NewNop())
+
+	sub, _, _ := b.Subscribe(btcount.DefaultWalletID, "", 2)
+	defer b.Unsubscribe(sub)
+
+	saved, err := store.Repos().Transactions.SaveMany(ctx, []btcount.Transaction{
+		{
+			WalletID: btcount.DefaultWalletID,
+			Amount:   btcount.DecimalFromFloat(1.5),
+			Datetime: time.Now().Add(-time.Minute * 2),
+		},
+		{
+			WalletID: btcount.DefaultWalletID,
+			Amount:   btcount.DecimalFromFloat(0.5),
+			Datetime: time.Now().Add(-time.Minute),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Transactions saved by any instance are published in order with the
+	// balance after all of them.
+	err = follower.TransactionsSaved(ctx, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance := btcount.DecimalFromFloat(2.0)
+
+	var e Event
+	for _, expected := range saved {
+		e = <-sub.Events()
+		if e.Kind != KindTransaction || e.Transaction == nil || e.Transaction.ID != expected.ID || !e.Balance.Equal(balance) {
+			t.Fatalf("exp transaction %d with balance %s, got: %+v", expected.ID, balance, e)
+		}
+	}
+
+	// Changes may be missed while the feed is disconnected, so events are
+	// not resumed after resync and subscribers reload the balance.
+	err = follower.Resync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-sub.Events(); ok {
+		t.Error("exp subscription to be dropped on resync")
+	}
+
+	resumedSub, missed, resumed := b.Subscribe(btcount.DefaultWalletID, e.ID, 2)
+	defer b.Unsubscribe(resumedSub)
+
+	if resumed || len(missed) != 0 {
+		t.Errorf("exp events not to be resumed after resync, got resumed: %t, missed: %v", resumed, missed)
+	}
+}
@@ -0,0 +1,241 @@
+// Package notify delivers events of wallets to subscribers within the
+// instance of the service. Events are published either by the instance
+// which made the change or, if the store is shared by several instances,
+// by Follower from the changes of every instance. Ids of events are issued
+// by the broker of the instance, so subscriptions are resumed on the same
+// instance only.
+package notify
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcount"
+)
+
+// Kind is the kind of the event.
+type Kind string
+
+const (
+	// KindTransaction is published when the transaction is saved.
+	KindTransaction Kind = "transaction"
+	// KindStat is published when the hourly stat is saved by the worker,
+	// i.e. the hour is closed.
+	KindStat Kind = "stat"
+)
+
+// Event is a change of the wallet.
+type Event struct {
+	// ID is assigned on publishing. Ids grow within the broker, so they
+	// resume subscriptions.
+	ID       string
+	Kind     Kind
+	WalletID int64
+	// Transaction is set for KindTransaction.
+	Transaction *btcount.Transaction
+	// Balance is the current balance of the wallet when the transaction
+	// is published. It is set for KindTransaction.
+	Balance btcount.Decimal
+	// Stat is set for KindStat.
+	Stat *btcount.HistoryStat
+
+	seq uint64
+}
+
+// Broker delivers published events to subscribers of their wallets and
+// keeps the latest events, so subscribers may resume after reconnecting.
+type Broker struct {
+	// epoch distinguishes ids of brokers, so ids issued before restart
+	// are not taken for the ones of this broker.
+	epoch       string
+	historySize int
+
+	mu      sync.Mutex
+	seq     uint64
+	history []Event
+	subs    map[*Subscription]struct{}
+	// skipped is the last sequence number issued before an event of the
+	// wallet is skipped, so subscriptions are not resumed across it.
+	skipped map[int64]uint64
+}
+
+// NewBroker creates a broker keeping historySize latest events.
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		epoch:       newEpoch(),
+		historySize: historySize,
+		subs:        make(map[*Subscription]struct{}),
+		skipped:     make(map[int64]uint64),
+	}
+}
+
+func newEpoch() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// Subscription receives events of the wallet.
+type Subscription struct {
+	walletID int64
+	events   chan Event
+}
+
+// Events returns the channel of events. The channel is closed once the
+// subscriber falls behind by the size of its buffer, so slow subscribers
+// do not block publishers and resume later instead.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Publish assigns the id to the event and delivers it to subscribers of
+// its wallet without blocking.
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.seq = b.seq
+	e.ID = b.epoch + "-" + strconv.FormatUint(e.seq, 10)
+
+	b.history = append(b.history, e)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for sub := range b.subs {
+		if sub.walletID != e.WalletID {
+			continue
+		}
+
+		select {
+		case sub.events <- e:
+		default:
+			b.drop(sub)
+		}
+	}
+}
+
+// Skip skips the event of the wallet if nobody is subscribed to it, so
+// publishers do not prepare events nobody receives. Subscriptions are not
+// resumed across the skipped event. It returns false if the event should
+// be published.
+func (b *Broker) Skip(walletID int64) (skipped bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		if sub.walletID == walletID {
+			return false
+		}
+	}
+
+	b.skipped[walletID] = b.seq
+
+	return true
+}
+
+// Subscribe subscribes to events of the wallet published after the event
+// with lastEventID. Kept events published after it are returned to be
+// handled before the ones of the subscription. Resumed is false if the
+// events can not be resumed, e.g. lastEventID is empty, too old or issued
+// by another broker, so the subscriber should reload the state instead.
+func (b *Broker) Subscribe(walletID int64, lastEventID string, buffer int) (sub *Subscription, missed []Event, resumed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &Subscription{
+		walletID: walletID,
+		events:   make(chan Event, buffer),
+	}
+	b.subs[sub] = struct{}{}
+
+	seq, err := b.parseID(lastEventID)
+	if err != nil {
+		return sub, nil, false
+	}
+
+	// The event right before the oldest kept one is the last one which
+	// may be resumed without a gap.
+	if seq < b.seq && (len(b.history) == 0 || seq+1 < b.history[0].seq) {
+		return sub, nil, false
+	}
+
+	if last, ok := b.skipped[walletID]; ok && seq <= last {
+		return sub, nil, false
+	}
+
+	for _, e := range b.history {
+		if e.seq > seq && e.WalletID == walletID {
+			missed = append(missed, e)
+		}
+	}
+
+	return sub, missed, true
+}
+
+// Reset forgets published events and drops all subscriptions, so
+// subscribers reload the state. Ids issued before the reset are not
+// resumed.
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The clock may not advance since the previous epoch.
+	epoch := b.epoch
+	for b.epoch == epoch {
+		b.epoch = newEpoch()
+	}
+
+	b.seq = 0
+	b.history = nil
+	b.skipped = make(map[int64]uint64)
+
+	for sub := range b.subs {
+		b.drop(sub)
+	}
+}
+
+// Unsubscribe stops delivering events to the subscription. It is safe to
+// unsubscribe the dropped subscription.
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[sub]; ok {
+		b.drop(sub)
+	}
+}
+
+// drop removes the subscription and closes its channel. The caller should
+// hold the lock.
+func (b *Broker) drop(sub *Subscription) {
+	delete(b.subs, sub)
+	close(sub.events)
+}
+
+// parseID parses the sequence number of the event id issued by the
+// broker. The caller should hold the lock.
+func (b *Broker) parseID(id string) (seq uint64, err error) {
+	epoch, raw, ok := cut(id, "-")
+	if !ok || epoch != b.epoch {
+		return 0, fmt.Errorf("%w: event id %q", btcount.ErrInvalidParameter, id)
+	}
+
+	seq, err = strconv.ParseUint(raw, 10, 64)
+	if err != nil || seq > b.seq {
+		return 0, fmt.Errorf("%w: event id %q", btcount.ErrInvalidParameter, id)
+	}
+
+	return seq, nil
+}
+
+// cut slices s around the first instance of sep.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+
+	return s, "", false
+}
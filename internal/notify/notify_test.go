@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	b := NewBroker(3)
+
+	sub, missed, resumed := b.Subscribe(1, "", 2)
+	if resumed || len(missed) != 0 {
+		t.Fatalf("exp fresh subscription, got resumed: %t, missed: %v", resumed, missed)
+	}
+
+	b.Publish(Event{Kind: KindTransaction, WalletID: 1})
+	b.Publish(Event{Kind: KindTransaction, WalletID: 2})
+	b.Publish(Event{Kind: KindStat, WalletID: 1})
+
+	first := <-sub.Events()
+	second := <-sub.Events()
+	if first.ID == "" || first.Kind != KindTransaction || second.Kind != KindStat {
+		t.Fatalf("exp events of wallet 1 in order, got: %+v, %+v", first, second)
+	}
+
+	// The buffer of 2 events is exceeded, so the subscription is dropped.
+	for i := 0; i < 3; i++ {
+		b.Publish(Event{Kind: KindTransaction, WalletID: 1})
+	}
+
+	var received int
+	for range sub.Events() {
+		received++
+	}
+
+	if received != 2 {
+		t.Errorf("exp 2 events before the drop, got: %d", received)
+	}
+
+	b.Unsubscribe(sub)
+
+	var tt = []struct {
+		name        string
+		lastEventID string
+		expResumed  bool
+		expMissed   int
+	}{
+		{name: "empty id", lastEventID: ""},
+		{name: "malformed id", lastEventID: "42"},
+		{name: "id of another broker", lastEventID: "0-1"},
+		{name: "id from the future", lastEventID: b.epoch + "-100"},
+		{name: "id before kept events", lastEventID: first.ID},
+		{name: "id right before kept events", lastEventID: b.epoch + "-3", expResumed: true, expMissed: 3},
+		{name: "last id", lastEventID: b.epoch + "-6", expResumed: true},
+	}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			sub, missed, resumed := b.Subscribe(1, tc.lastEventID, 1)
+			defer b.Unsubscribe(sub)
+
+			if resumed != tc.expResumed || len(missed) != tc.expMissed {
+				t.Errorf("exp resumed: %t with %d missed, got: %t with %v", tc.expResumed, tc.expMissed, resumed, missed)
+			}
+		})
+	}
+}
+
+func TestBrokerSkip(t *testing.T) {
+	b := NewBroker(4)
+
+	sub, _, _ := b.Subscribe(1, "", 2)
+	b.Publish(Event{Kind: KindTransaction, WalletID: 1})
+	last := <-sub.Events()
+
+	if b.Skip(1) {
+		t.Fatal("exp event of the subscribed wallet not to be skipped")
+	}
+
+	b.Unsubscribe(sub)
+
+	if !b.Skip(1) {
+		t.Fatal("exp event of the wallet without subscribers to be skipped")
+	}
+
+	b.Publish(Event{Kind: KindTransaction, WalletID: 1})
+
+	sub, missed, resumed := b.Subscribe(1, last.ID, 2)
+	defer b.Unsubscribe(sub)
+
+	if resumed || len(missed) != 0 {
+		t.Errorf("exp subscription not to be resumed across the skipped event, got resumed: %t, missed: %v", resumed, missed)
+	}
+
+	// Subscriptions of other wallets are not affected by the skipped event.
+	next, missed, resumed := b.Subscribe(2, last.ID, 2)
+	defer b.Unsubscribe(next)
+
+	if !resumed || len(missed) != 0 {
+		t.Errorf("exp subscription of another wallet to be resumed, got resumed: %t, missed: %v", resumed, missed)
+	}
+}
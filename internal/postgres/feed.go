@@ -0,0 +1,180 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ferux/btcount/internal/btcontext"
+	"github.com/ferux/btcount/internal/btcount"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Channels notified by triggers of the tables.
+const (
+	transactionsChannel = "btcount_transactions"
+	walletsChannel      = "btcount_wallets"
+)
+
+// followRetryDelay is the delay before reconnecting to the database
+// after the connection is lost.
+const followRetryDelay = time.Second * 5
+
+// Notifications received within followDrainWait one after another, up to
+// followDrainSize, are handled together, so transactions committed at
+// once, e.g. by a batch, are handled at once too.
+const (
+	followDrainWait = time.Millisecond * 10
+	followDrainSize = 1000
+)
+
+// Follow implements btcount.ChangeFeed interface. Changes are delivered
+// by LISTEN/NOTIFY on a connection acquired from the pool for the whole
+// time the feed is followed.
+func (db *DB) Follow(ctx context.Context, h btcount.ChangeHandler) (err error) {
+	log := btcontext.Logger(ctx)
+
+	for {
+		err = db.follow(ctx, h)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Error("following changes interrupted, reconnecting",
+			zap.Error(err),
+			zap.Duration("retry_delay", followRetryDelay),
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(followRetryDelay):
+		}
+	}
+}
+
+// follow listens to the changes until the connection fails.
+func (db *DB) follow(ctx context.Context, h btcount.ChangeHandler) (err error) {
+	var conn *pgxpool.Conn
+	conn, err = db.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquiring connection: %w", err)
+	}
+	defer func() {
+		// The connection is left listening, so it is closed instead of
+		// being returned to the pool.
+		_ = conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+
+	for _, channel := range []string{transactionsChannel, walletsChannel} {
+		_, err = conn.Exec(ctx, "LISTEN "+channel)
+		if err != nil {
+			return fmt.Errorf("listening %s: %w", channel, err)
+		}
+	}
+
+	// Changes made before listening are missed, so the state is reloaded
+	// after it.
+	err = h.Resync(ctx)
+	if err != nil {
+		return fmt.Errorf("resyncing: %w", err)
+	}
+
+	var n *pgconn.Notification
+	for {
+		n, err = conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for notification: %w", err)
+		}
+
+		var ns []*pgconn.Notification
+		ns, err = drainNotifications(ctx, conn.Conn(), n)
+		if err != nil {
+			return fmt.Errorf("waiting for notification: %w", err)
+		}
+
+		err = handleNotifications(ctx, h, ns)
+		if err != nil {
+			// The state may be inconsistent, so it is resynced on
+			// reconnection.
+			return fmt.Errorf("handling notifications: %w", err)
+		}
+	}
+}
+
+// drainNotifications returns the notification with the ones received
+// right after it. Waiting for a notification with a timeout leaves the
+// connection usable.
+func drainNotifications(ctx context.Context, conn *pgx.Conn, n *pgconn.Notification) (ns []*pgconn.Notification, err error) {
+	ns = append(ns, n)
+	for len(ns) < followDrainSize {
+		waitctx, cancel := context.WithTimeout(ctx, followDrainWait)
+		n, err = conn.WaitForNotification(waitctx)
+		cancel()
+
+		if err != nil && ctx.Err() == nil && waitctx.Err() != nil {
+			return ns, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ns = append(ns, n)
+	}
+
+	return ns, nil
+}
+
+// handleNotifications passes notifications to h in order. Consecutive
+// transactions are passed at once.
+func handleNotifications(ctx context.Context, h btcount.ChangeHandler, ns []*pgconn.Notification) (err error) {
+	var ts []btcount.Transaction
+	flush := func() (err error) {
+		if len(ts) == 0 {
+			return nil
+		}
+
+		err = h.TransactionsSaved(ctx, ts)
+		ts = nil
+
+		return err
+	}
+
+	for _, n := range ns {
+		switch n.Channel {
+		case transactionsChannel:
+			var t btcount.Transaction
+			err = json.Unmarshal([]byte(n.Payload), &t)
+			if err != nil {
+				return fmt.Errorf("decoding transaction: %w", err)
+			}
+
+			ts = append(ts, t)
+		case walletsChannel:
+			var walletID int64
+			walletID, err = strconv.ParseInt(n.Payload, 10, 64)
+			if err != nil {
+				return fmt.Errorf("decoding wallet id: %w", err)
+			}
+
+			err = flush()
+			if err != nil {
+				return err
+			}
+
+			err = h.WalletDeleted(ctx, walletID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
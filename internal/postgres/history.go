@@ -5,32 +5,51 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/ferux/btcount/internal/btcontext"
 	"github.com/ferux/btcount/internal/btcount"
 
-	"go.uber.org/zap"
+	"github.com/jackc/pgx/v4"
 )
 
-// NewHistoryStore creates new history store.
-func NewHistoryStore() HistoryStore { return HistoryStore{} }
-
 // HistoryStore implements btcount.HistoryStorage interface
 // for postgres database based on pgx driver.
-type HistoryStore struct{}
+type HistoryStore struct {
+	q querier
+}
 
-const historyColumns = `"datetime"` +
-	`, "amount"`
+const historyColumns = `"wallet_id"` +
+	`, "datetime"` +
+	`, "amount"` +
+	`, "open"` +
+	`, "high"` +
+	`, "low"` +
+	`, "inflow"` +
+	`, "outflow"` +
+	`, "count"`
 
 // Save implements btcount.HistoryStorage interface.
-func (HistoryStore) Save(ctx context.Context, db btcount.Database, stat btcount.HistoryStat) (err error) {
+func (hs HistoryStore) Save(ctx context.Context, stat btcount.HistoryStat) (err error) {
 	const query = `INSERT INTO btcount.history_stats (` + historyColumns + `) VALUES (` +
 		`  $1` +
 		`, $2` +
+		`, $3` +
+		`, $4` +
+		`, $5` +
+		`, $6` +
+		`, $7` +
+		`, $8` +
+		`, $9` +
 		`)`
 
-	err = db.Exec(ctx, query,
+	_, err = hs.q.Exec(ctx, query,
+		stat.WalletID,
 		stat.Datetime,
 		stat.Amount,
+		stat.Open,
+		stat.High,
+		stat.Low,
+		stat.Inflow,
+		stat.Outflow,
+		stat.Count,
 	)
 	if err != nil {
 		return fmt.Errorf("executing query: %w", err)
@@ -40,7 +59,7 @@ func (HistoryStore) Save(ctx context.Context, db btcount.Database, stat btcount.
 }
 
 // SaveMany implements btcount.HistoryStorage interface.
-func (hs HistoryStore) SaveMany(ctx context.Context, db btcount.Database, stats []btcount.HistoryStat) (err error) {
+func (hs HistoryStore) SaveMany(ctx context.Context, stats []btcount.HistoryStat) (err error) {
 	if len(stats) == 0 {
 		return nil
 	}
@@ -48,34 +67,35 @@ func (hs HistoryStore) SaveMany(ctx context.Context, db btcount.Database, stats
 	const query = `INSERT INTO btcount.history_stats (` + historyColumns + `) VALUES (` +
 		`  $1` +
 		`, $2` +
+		`, $3` +
+		`, $4` +
+		`, $5` +
+		`, $6` +
+		`, $7` +
+		`, $8` +
+		`, $9` +
 		`)`
 
-	batch := newBatch()
+	batch := &pgx.Batch{}
 	for i := range stats {
 		batch.Queue(query,
+			stats[i].WalletID,
 			stats[i].Datetime,
 			stats[i].Amount,
+			stats[i].Open,
+			stats[i].High,
+			stats[i].Low,
+			stats[i].Inflow,
+			stats[i].Outflow,
+			stats[i].Count,
 		)
 	}
 
-	results := db.SendBatch(ctx, batch)
-	defer func() {
-		errclose := results.Close()
-		if errclose == nil {
-			return
-		}
-
-		if err == nil {
-			err = errclose
-		} else {
-			btcontext.
-				Logger(ctx).
-				Error("unable to close results", zap.Error(errclose))
-		}
-	}()
+	results := hs.q.SendBatch(ctx, batch)
+	defer closeBatch(ctx, results, &err)
 
 	for i := 0; i < len(stats); i++ {
-		err = results.Exec()
+		_, err = results.Exec()
 		if err != nil {
 			return fmt.Errorf("inserting %v: %w", stats[i], err)
 		}
@@ -85,58 +105,82 @@ func (hs HistoryStore) SaveMany(ctx context.Context, db btcount.Database, stats
 }
 
 // Load implements btcount.HistoryStorage interface.
-func (HistoryStore) Load(ctx context.Context, db btcount.Database, query btcount.TimerangeQuery) (hs []btcount.HistoryStat, err error) {
-	const q = `SELECT ` + historyColumns +
+func (hs HistoryStore) Load(ctx context.Context, walletID int64, query btcount.TimerangeQuery) (stats []btcount.HistoryStat, err error) {
+	err = hs.Iterate(ctx, walletID, query, func(stat btcount.HistoryStat) error {
+		stats = append(stats, stat)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Iterate implements btcount.HistoryStorage interface. Rows are scanned
+// as they are received, so the query is canceled together with ctx.
+func (hs HistoryStore) Iterate(ctx context.Context, walletID int64, query btcount.TimerangeQuery, fn func(stat btcount.HistoryStat) error) (err error) {
+	q := `SELECT ` + historyColumns +
 		` FROM btcount.history_stats` +
-		` WHERE "datetime" > $1 AND "datetime" <= $2` +
+		` WHERE "wallet_id" = $1 AND ` + datetimeRange(query) +
 		` ORDER BY "datetime" ASC;`
 
-	var rows btcount.DBRows
-	rows, err = db.Query(ctx, q, query.Since, query.Till)
+	var rows pgx.Rows
+	rows, err = hs.q.Query(ctx, q, walletID, query.Since, query.Till)
 	if err != nil {
-		return nil, fmt.Errorf("querying: %w", err)
+		return fmt.Errorf("querying: %w", err)
 	}
-	defer func() {
-		errclose := rows.Close()
-		if errclose == nil {
-			return
-		}
-
-		if err == nil {
-			err = errclose
-		} else {
-			btcontext.
-				Logger(ctx).
-				Error("unable to close rows", zap.Error(errclose))
-		}
-	}()
+	defer rows.Close()
 
 	for rows.Next() {
 		var stat btcount.HistoryStat
 		err = rows.Scan(
+			&stat.WalletID,
 			&stat.Datetime,
 			&stat.Amount,
+			&stat.Open,
+			&stat.High,
+			&stat.Low,
+			&stat.Inflow,
+			&stat.Outflow,
+			&stat.Count,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("scanning row: %w", err)
+			return fmt.Errorf("scanning row: %w", err)
 		}
 
-		hs = append(hs, stat)
+		err = fn(stat)
+		if err != nil {
+			return err
+		}
 	}
 
-	return hs, nil
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("reading rows: %w", err)
+	}
+
+	return nil
 }
 
 // LoadLastStat implements btcount.HistoryStorage interface.
-func (HistoryStore) LoadLastStat(ctx context.Context, db btcount.Database, ts time.Time) (h btcount.HistoryStat, err error) {
+func (hs HistoryStore) LoadLastStat(ctx context.Context, walletID int64, ts time.Time) (h btcount.HistoryStat, err error) {
 	const query = `SELECT ` + historyColumns +
 		` FROM btcount.history_stats` +
-		` WHERE "datetime" <= $1` +
+		` WHERE "wallet_id" = $1 AND "datetime" <= $2` +
 		` ORDER BY "datetime" DESC LIMIT 1;`
 
-	err = db.QueryRow(ctx, query, ts).Scan(
+	err = scan(hs.q.QueryRow(ctx, query, walletID, ts),
+		&h.WalletID,
 		&h.Datetime,
 		&h.Amount,
+		&h.Open,
+		&h.High,
+		&h.Low,
+		&h.Inflow,
+		&h.Outflow,
+		&h.Count,
 	)
 	if err != nil {
 		return h, fmt.Errorf("scanning row: %w", err)
@@ -144,3 +188,16 @@ func (HistoryStore) LoadLastStat(ctx context.Context, db btcount.Database, ts ti
 
 	return h, nil
 }
+
+// Delete implements btcount.HistoryStorage interface.
+func (hs HistoryStore) Delete(ctx context.Context, walletID int64, query btcount.TimerangeQuery) (err error) {
+	q := `DELETE FROM btcount.history_stats` +
+		` WHERE "wallet_id" = $1 AND ` + datetimeRange(query) + `;`
+
+	_, err = hs.q.Exec(ctx, q, walletID, query.Since, query.Till)
+	if err != nil {
+		return fmt.Errorf("executing query: %w", err)
+	}
+
+	return nil
+}
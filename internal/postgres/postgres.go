@@ -6,10 +6,13 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/ferux/btcount/internal/btcontext"
 	"github.com/ferux/btcount/internal/btcount"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
 )
 
 // Config defines params for the database connection.
@@ -38,110 +41,114 @@ func Open(ctx context.Context, dsn string, cfg Config) (db *DB, err error) {
 	return &DB{pool: pool}, nil
 }
 
+// DB implements btcount.Store interface for postgres database based on
+// pgx driver.
 type DB struct {
 	pool *pgxpool.Pool
 }
 
-// Exec implements btcount.Database interface.
-func (db *DB) Exec(ctx context.Context, query string, args ...interface{}) (err error) {
-	_, err = db.pool.Exec(ctx, query, args...)
-
-	return err
-}
-
-// QueryRow implementa btcount.Database interface.
-func (db *DB) QueryRow(ctx context.Context, query string, args ...interface{}) btcount.DBRow {
-	return &dbrow{Row: db.pool.QueryRow(ctx, query, args...)}
+// Repos implements btcount.Store interface.
+func (db *DB) Repos() btcount.Repos {
+	return newRepos(db.pool)
 }
 
-// Query implements btcount.Database interface.
-func (db *DB) Query(ctx context.Context, query string, args ...interface{}) (rows btcount.DBRows, err error) {
-	var pgrows pgx.Rows
-	pgrows, err = db.pool.Query(ctx, query, args...)
+// WithinTx implements btcount.Store interface.
+func (db *DB) WithinTx(ctx context.Context, fn func(r btcount.Repos) error) (err error) {
+	var tx pgx.Tx
+	tx, err = db.pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("beginning transaction: %w", err)
 	}
 
-	return &dbrows{Rows: pgrows}, nil
-}
+	defer func() {
+		if err == nil {
+			err = tx.Commit(ctx)
+			if err != nil {
+				err = fmt.Errorf("committing transaction: %w", err)
+			}
+
+			return
+		}
 
-// SendBatch implements btcount.Database interface.
-func (db *DB) SendBatch(ctx context.Context, b btcount.Batch) btcount.BatchResults {
-	batch := b.(*pgx.Batch)
-	results := db.pool.SendBatch(ctx, batch)
+		errtx := tx.Rollback(ctx)
+		if errtx != nil {
+			btcontext.
+				Logger(ctx).
+				Error("unable to rollback transaction", zap.Error(errtx))
+		}
+	}()
 
-	return &batchresults{BatchResults: results}
+	return fn(newRepos(tx))
 }
 
-// Close implements btcount.Database interface.
+// Close implements btcount.Store interface.
 func (db *DB) Close() error {
 	db.pool.Close()
 
 	return nil
 }
 
-func (db *DB) Begin(ctx context.Context) (tx btcount.Database, err error) {
-	pgxtx, err := db.pool.Begin(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("beginning transaction")
-	}
-
-	return &Tx{tx: pgxtx}, nil
-}
-
-type dbrows struct{ pgx.Rows }
-
-// Close implements btcount.DBRows interface.
-func (r *dbrows) Close() error {
-	r.Rows.Close()
-
-	return nil
+// querier is implemented by both the pool and transactions, so the
+// stores work the same way within transactions and outside of them.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
 }
 
-func newBatch() btcount.Batch {
-	return &pgx.Batch{}
+func newRepos(q querier) btcount.Repos {
+	return btcount.Repos{
+		Wallets:      WalletStore{q: q},
+		Transactions: TransactionStore{q: q},
+		History:      HistoryStore{q: q},
+	}
 }
 
-type batchresults struct{ pgx.BatchResults }
-
-// Exec implements btcount.BatchResults interface.
-func (br *batchresults) Exec() (err error) {
-	_, err = br.BatchResults.Exec()
-
-	return err
-}
+// datetimeRange returns the condition matching "datetime" column by the
+// range bounds passed as $2 and $3.
+func datetimeRange(query btcount.TimerangeQuery) (condition string) {
+	since, till := ">=", "<"
+	if query.ExcludeSince {
+		since = ">"
+	}
 
-// Query implements btcount.BatchResults interface.
-func (br *batchresults) Query() (btcount.DBRows, error) {
-	rows, err := br.BatchResults.Query()
-	if err != nil {
-		return nil, err
+	if query.IncludeTill {
+		till = "<="
 	}
 
-	return &dbrows{rows}, nil
+	return `"datetime" ` + since + ` $2 AND "datetime" ` + till + ` $3`
 }
 
-// QueryRow implements btcount.BatchResults interface.
-func (br *batchresults) QueryRow() btcount.DBRow {
-	return br.BatchResults.QueryRow()
+// scan scans the row mapping missing rows to btcount.ErrNotFound.
+func scan(row pgx.Row, dest ...interface{}) (err error) {
+	return mapError(row.Scan(dest...))
 }
 
-type dbrow struct{ pgx.Row }
-
-// Scan implements btcount.DBRow interface.
-func (dbrow *dbrow) Scan(dest ...interface{}) (err error) {
-	err = dbrow.Row.Scan(dest...)
+// closeBatch closes the batch results returning the error if err is nil
+// or logging it otherwise.
+func closeBatch(ctx context.Context, results pgx.BatchResults, err *error) {
+	errclose := results.Close()
+	if errclose == nil {
+		return
+	}
 
-	return mapError(err)
+	if *err == nil {
+		*err = errclose
+	} else {
+		btcontext.
+			Logger(ctx).
+			Error("unable to close results", zap.Error(errclose))
+	}
 }
 
 func mapError(err error) (mapped error) {
 	if err == nil {
 		return nil
 	}
-	if errors.Is(err, sql.ErrNoRows) {
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, pgx.ErrNoRows) {
 		return btcount.ErrNotFound
 	}
 
-	return nil
+	return err
 }
@@ -2,77 +2,346 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/ferux/btcount/internal/btcontext"
 	"github.com/ferux/btcount/internal/btcount"
 
-	"go.uber.org/zap"
+	"github.com/jackc/pgx/v4"
 )
 
-// NewTransactionStore creates new transaction store.
-func NewTransactionStore() TransactionStore { return TransactionStore{} }
+// TransactionStore implements btcount.TransactionStorage interface
+// for postgres database based on pgx driver.
+type TransactionStore struct {
+	q querier
+}
 
-type TransactionStore struct{}
+const transactionColumns = `"wallet_id"` +
+	`, "datetime"` +
+	`, "amount"` +
+	`, "idempotency_key"`
 
-const transactionColumns = `"datetime"` +
-	`, "amount"`
+// transactionSelectColumns also contains columns filled by the database.
+const transactionSelectColumns = `"id"` +
+	`, "created_at"` +
+	`, ` + transactionColumns
 
-func (TransactionStore) Save(ctx context.Context, db btcount.Database, transaction btcount.Transaction) (err error) {
-	const query = `INSERT INTO btcount.transactions (` + transactionColumns + `) VALUES (` +
-		`  $1` +
-		`, $2` +
-		`)`
+// saveTransactionQuery inserts the transaction and updates the running
+// balance by the same statement, so it is consistent with transactions
+// even outside of a database transaction.
+//
+// Conflicting rows are skipped instead of failing, so the surrounding
+// transaction is not aborted. Nothing is returned in such case.
+const saveTransactionQuery = `WITH inserted AS (` +
+	`INSERT INTO btcount.transactions (` + transactionColumns + `) VALUES (` +
+	`  $1` +
+	`, $2` +
+	`, $3` +
+	`, $4` +
+	`) ON CONFLICT ("wallet_id", "idempotency_key") WHERE "idempotency_key" <> '' DO NOTHING` +
+	` RETURNING ` + transactionSelectColumns +
+	`), balance AS (` +
+	`INSERT INTO btcount.wallet_balances ("wallet_id", "amount")` +
+	` SELECT "wallet_id", "amount" FROM inserted` +
+	` ON CONFLICT ("wallet_id") DO UPDATE SET "amount" = btcount.wallet_balances."amount" + EXCLUDED."amount"` +
+	`) SELECT ` + transactionSelectColumns + ` FROM inserted`
 
-	err = db.Exec(ctx, query,
+func (ts TransactionStore) Save(ctx context.Context, transaction btcount.Transaction) (saved btcount.Transaction, err error) {
+	saved, err = scanTransaction(ts.q.QueryRow(ctx, saveTransactionQuery,
+		transaction.WalletID,
 		transaction.Datetime,
 		transaction.Amount,
-	)
+		transaction.IdempotencyKey,
+	))
 	if err != nil {
-		return fmt.Errorf("executing query: %w", err)
+		if errors.Is(err, btcount.ErrNotFound) {
+			return saved, fmt.Errorf("%w: idempotency key %q", btcount.ErrAlreadyExists, transaction.IdempotencyKey)
+		}
+
+		return saved, fmt.Errorf("executing query: %w", err)
 	}
 
-	return nil
+	return saved, nil
 }
 
-func (TransactionStore) Load(ctx context.Context, db btcount.Database, params btcount.TimerangeQuery) (ts []btcount.Transaction, err error) {
-	const query = `SELECT ` + transactionColumns +
+// SaveMany sends all transactions in a single batch.
+func (ts TransactionStore) SaveMany(ctx context.Context, transactions []btcount.Transaction) (saved []btcount.Transaction, err error) {
+	if len(transactions) == 0 {
+		return nil, nil
+	}
+
+	batch := &pgx.Batch{}
+	for i := range transactions {
+		batch.Queue(saveTransactionQuery,
+			transactions[i].WalletID,
+			transactions[i].Datetime,
+			transactions[i].Amount,
+			transactions[i].IdempotencyKey,
+		)
+	}
+
+	results := ts.q.SendBatch(ctx, batch)
+	defer closeBatch(ctx, results, &err)
+
+	saved = make([]btcount.Transaction, len(transactions))
+	for i := range transactions {
+		saved[i], err = scanTransaction(results.QueryRow())
+		if errors.Is(err, btcount.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inserting %v: %w", transactions[i], err)
+		}
+	}
+
+	return saved, nil
+}
+
+func (ts TransactionStore) Get(ctx context.Context, walletID, id int64) (t btcount.Transaction, err error) {
+	const query = `SELECT ` + transactionSelectColumns +
 		`  FROM btcount.transactions` +
-		`  WHERE "datetime" BETWEEN $1 AND $2`
+		`  WHERE "wallet_id" = $1 AND "id" = $2`
 
-	var rows btcount.DBRows
-	rows, err = db.Query(ctx, query, params.Since, params.Till)
+	t, err = scanTransaction(ts.q.QueryRow(ctx, query, walletID, id))
 	if err != nil {
-		return nil, fmt.Errorf("querying rows: %w", err)
+		return t, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return t, nil
+}
+
+func (ts TransactionStore) LoadByIdempotencyKey(ctx context.Context, walletID int64, key string) (t btcount.Transaction, err error) {
+	const query = `SELECT ` + transactionSelectColumns +
+		`  FROM btcount.transactions` +
+		`  WHERE "wallet_id" = $1 AND "idempotency_key" = $2 AND "idempotency_key" <> ''`
+
+	t, err = scanTransaction(ts.q.QueryRow(ctx, query, walletID, key))
+	if err != nil {
+		return t, fmt.Errorf("scanning row: %w", err)
 	}
 
-	defer func() {
-		errclose := rows.Close()
-		if errclose == nil {
-			return
+	return t, nil
+}
+
+func (ts TransactionStore) LoadByIdempotencyKeys(ctx context.Context, walletID int64, keys []string) (transactions []btcount.Transaction, err error) {
+	const query = `SELECT ` + transactionSelectColumns +
+		`  FROM btcount.transactions` +
+		`  WHERE "wallet_id" = $1 AND "idempotency_key" = ANY($2) AND "idempotency_key" <> ''`
+
+	return ts.query(ctx, query, walletID, keys)
+}
+
+func (ts TransactionStore) Load(ctx context.Context, walletID int64, params btcount.TimerangeQuery) (transactions []btcount.Transaction, err error) {
+	err = ts.Iterate(ctx, walletID, params, func(t btcount.Transaction) error {
+		transactions = append(transactions, t)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// Iterate implements btcount.TransactionStorage interface. Rows are
+// scanned as they are received, so the query is canceled together with
+// ctx.
+func (ts TransactionStore) Iterate(ctx context.Context, walletID int64, params btcount.TimerangeQuery, fn func(t btcount.Transaction) error) (err error) {
+	query := `SELECT ` + transactionSelectColumns +
+		`  FROM btcount.transactions` +
+		`  WHERE "wallet_id" = $1 AND ` + datetimeRange(params) +
+		`  ORDER BY "datetime" ASC, "id" ASC`
+
+	var rows pgx.Rows
+	rows, err = ts.q.Query(ctx, query, walletID, params.Since, params.Till)
+	if err != nil {
+		return fmt.Errorf("querying rows: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t btcount.Transaction
+		t, err = scanTransaction(rows)
+		if err != nil {
+			return fmt.Errorf("scanning row: %w", err)
 		}
 
-		if err == nil {
-			err = errclose
-		} else {
-			btcontext.
-				Logger(ctx).
-				Error("unable to close rows", zap.Error(err))
+		err = fn(t)
+		if err != nil {
+			return err
 		}
-	}()
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("reading rows: %w", err)
+	}
+
+	return nil
+}
+
+func (ts TransactionStore) List(ctx context.Context, walletID int64, params btcount.TransactionListQuery) (transactions []btcount.Transaction, err error) {
+	args := []interface{}{walletID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conditions := []string{`"wallet_id" = $1`}
+	if !params.Since.IsZero() {
+		conditions = append(conditions, `"datetime" >= `+arg(params.Since))
+	}
+
+	if !params.Till.IsZero() {
+		conditions = append(conditions, `"datetime" < `+arg(params.Till))
+	}
+
+	if params.MinAmount != nil {
+		conditions = append(conditions, `"amount" >= `+arg(*params.MinAmount))
+	}
+
+	if params.MaxAmount != nil {
+		conditions = append(conditions, `"amount" <= `+arg(*params.MaxAmount))
+	}
+
+	order, cmp := "ASC", ">"
+	if params.Descending {
+		order, cmp = "DESC", "<"
+	}
+
+	if params.After != nil {
+		conditions = append(conditions, `("datetime", "id") `+cmp+` (`+arg(params.After.Datetime)+`, `+arg(params.After.ID)+`)`)
+	}
+
+	query := `SELECT ` + transactionSelectColumns +
+		`  FROM btcount.transactions` +
+		`  WHERE ` + strings.Join(conditions, " AND ") +
+		`  ORDER BY "datetime" ` + order + `, "id" ` + order +
+		`  LIMIT ` + arg(params.Limit)
+
+	return ts.query(ctx, query, args...)
+}
+
+// Sum reads the running balance of the wallet.
+func (ts TransactionStore) Sum(ctx context.Context, walletID int64) (sum btcount.Decimal, err error) {
+	const query = `SELECT COALESCE((` +
+		`SELECT "amount" FROM btcount.wallet_balances WHERE "wallet_id" = $1` +
+		`), 0)`
+
+	err = scan(ts.q.QueryRow(ctx, query, walletID), &sum)
+	if err != nil {
+		return sum, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return sum, nil
+}
+
+// Balance subtracts transactions scheduled after at from the running
+// balance.
+func (ts TransactionStore) Balance(ctx context.Context, walletID int64, at time.Time) (sum btcount.Decimal, err error) {
+	return ts.sumExcept(ctx, walletID, at, `TRUE`)
+}
+
+// SumBefore sums transactions dated before at by the range scan of the
+// (wallet_id, datetime) index, so its cost does not depend on the amount
+// of later transactions.
+func (ts TransactionStore) SumBefore(ctx context.Context, walletID int64, at time.Time) (sum btcount.Decimal, err error) {
+	const query = `SELECT COALESCE(SUM("amount"), 0) FROM btcount.transactions` +
+		` WHERE "wallet_id" = $1 AND "datetime" < $2`
+
+	err = scan(ts.q.QueryRow(ctx, query, walletID, at), &sum)
+	if err != nil {
+		return sum, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return sum, nil
+}
+
+// SumAvailable subtracts deposits scheduled after at from the running
+// balance.
+func (ts TransactionStore) SumAvailable(ctx context.Context, walletID int64, at time.Time) (sum btcount.Decimal, err error) {
+	return ts.sumExcept(ctx, walletID, at, `"amount" > 0`)
+}
+
+// LowestBalance adds the least running sum of transactions scheduled
+// after at to the balance at at unless all of them are positive.
+func (ts TransactionStore) LowestBalance(ctx context.Context, walletID int64, at time.Time) (low btcount.Decimal, err error) {
+	const query = `WITH later AS (` +
+		`SELECT "amount", SUM("amount") OVER (ORDER BY "datetime", "id") AS "running"` +
+		` FROM btcount.transactions` +
+		` WHERE "wallet_id" = $1 AND "datetime" > $2` +
+		`) SELECT COALESCE((` +
+		`SELECT "amount" FROM btcount.wallet_balances WHERE "wallet_id" = $1` +
+		`), 0) - COALESCE((SELECT SUM("amount") FROM later), 0)` +
+		` + LEAST(COALESCE((SELECT MIN("running") FROM later), 0), 0)`
+
+	err = scan(ts.q.QueryRow(ctx, query, walletID, at), &low)
+	if err != nil {
+		return low, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return low, nil
+}
+
+// sumExcept subtracts transactions scheduled after at and matched by
+// the condition from the running balance. Scheduled transactions are
+// rare, so only a few rows are summed.
+func (ts TransactionStore) sumExcept(ctx context.Context, walletID int64, at time.Time, condition string) (sum btcount.Decimal, err error) {
+	query := `SELECT COALESCE((` +
+		`SELECT "amount" FROM btcount.wallet_balances WHERE "wallet_id" = $1` +
+		`), 0) - COALESCE((` +
+		`SELECT SUM("amount") FROM btcount.transactions` +
+		` WHERE "wallet_id" = $1 AND "datetime" > $2 AND ` + condition +
+		`), 0)`
+
+	err = scan(ts.q.QueryRow(ctx, query, walletID, at), &sum)
+	if err != nil {
+		return sum, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return sum, nil
+}
+
+func (ts TransactionStore) query(ctx context.Context, query string, args ...interface{}) (transactions []btcount.Transaction, err error) {
+	var rows pgx.Rows
+	rows, err = ts.q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %w", err)
+	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var t btcount.Transaction
-		err = rows.Scan(
-			&t.Datetime,
-			&t.Amount,
-		)
+		t, err = scanTransaction(rows)
 		if err != nil {
 			return nil, fmt.Errorf("scanning row: %w", err)
 		}
 
-		ts = append(ts, t)
+		transactions = append(transactions, t)
 	}
 
-	return ts, nil
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+
+	return transactions, nil
+}
+
+func scanTransaction(row pgx.Row) (t btcount.Transaction, err error) {
+	err = scan(row,
+		&t.ID,
+		&t.CreatedAt,
+		&t.WalletID,
+		&t.Datetime,
+		&t.Amount,
+		&t.IdempotencyKey,
+	)
+
+	return t, err
 }
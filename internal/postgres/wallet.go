@@ -0,0 +1,126 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ferux/btcount/internal/btcount"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// WalletStore implements btcount.WalletStorage interface
+// for postgres database based on pgx driver.
+type WalletStore struct {
+	q querier
+}
+
+const walletColumns = `"id"` +
+	`, "name"` +
+	`, "created_at"`
+
+// Create implements btcount.WalletStorage interface.
+func (ws WalletStore) Create(ctx context.Context, wallet btcount.Wallet) (created btcount.Wallet, err error) {
+	const query = `INSERT INTO btcount.wallets ("name") VALUES (` +
+		`  $1` +
+		`) RETURNING ` + walletColumns
+
+	err = scan(ws.q.QueryRow(ctx, query, wallet.Name),
+		&created.ID,
+		&created.Name,
+		&created.CreatedAt,
+	)
+	if err != nil {
+		return created, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return created, nil
+}
+
+// Get implements btcount.WalletStorage interface.
+func (ws WalletStore) Get(ctx context.Context, id int64) (wallet btcount.Wallet, err error) {
+	const query = `SELECT ` + walletColumns +
+		` FROM btcount.wallets` +
+		` WHERE "id" = $1;`
+
+	err = scan(ws.q.QueryRow(ctx, query, id),
+		&wallet.ID,
+		&wallet.Name,
+		&wallet.CreatedAt,
+	)
+	if err != nil {
+		return wallet, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return wallet, nil
+}
+
+// Lock implements btcount.WalletStorage interface.
+func (ws WalletStore) Lock(ctx context.Context, id int64) (wallet btcount.Wallet, err error) {
+	const query = `SELECT ` + walletColumns +
+		` FROM btcount.wallets` +
+		` WHERE "id" = $1` +
+		` FOR UPDATE;`
+
+	err = scan(ws.q.QueryRow(ctx, query, id),
+		&wallet.ID,
+		&wallet.Name,
+		&wallet.CreatedAt,
+	)
+	if err != nil {
+		return wallet, fmt.Errorf("scanning row: %w", err)
+	}
+
+	return wallet, nil
+}
+
+// List implements btcount.WalletStorage interface.
+func (ws WalletStore) List(ctx context.Context) (wallets []btcount.Wallet, err error) {
+	const query = `SELECT ` + walletColumns +
+		` FROM btcount.wallets` +
+		` ORDER BY "id" ASC;`
+
+	var rows pgx.Rows
+	rows, err = ws.q.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("querying: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var wallet btcount.Wallet
+		err = rows.Scan(
+			&wallet.ID,
+			&wallet.Name,
+			&wallet.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+
+		wallets = append(wallets, wallet)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+
+	return wallets, nil
+}
+
+// Delete implements btcount.WalletStorage interface. Transactions and
+// stats of the wallet are removed by the foreign key cascade.
+func (ws WalletStore) Delete(ctx context.Context, id int64) (err error) {
+	const query = `DELETE FROM btcount.wallets` +
+		` WHERE "id" = $1` +
+		` RETURNING "id";`
+
+	var deleted int64
+	err = scan(ws.q.QueryRow(ctx, query, id), &deleted)
+	if err != nil {
+		return fmt.Errorf("scanning row: %w", err)
+	}
+
+	return nil
+}
@@ -7,16 +7,16 @@ import (
 	"time"
 
 	"github.com/ferux/btcount/internal/btcount"
+	"github.com/ferux/btcount/internal/notify"
 
 	"go.uber.org/zap"
 )
 
 type StatMakerWorkerConfig struct {
-	TStore btcount.TransactionStorage
-	HStore btcount.HistoryStatStorage
-
-	DB         btcount.Database
+	Store      btcount.Store
 	RetryDelay time.Duration
+	// Events is optional. Stats of closed hours are published to it.
+	Events *notify.Broker
 }
 
 // RunStatMakerWorker fetchs all transactions for the previous hours
@@ -25,10 +25,9 @@ func RunStatMakerWorker(ctx context.Context, cfg StatMakerWorkerConfig, log *zap
 	log = log.With(zap.String("worker", "stat_maker_worker"))
 
 	var (
-		hstore     = cfg.HStore
-		tstore     = cfg.TStore
-		db         = cfg.DB
+		store      = cfg.Store
 		retrydelay = cfg.RetryDelay
+		events     = cfg.Events
 
 		num  int
 		till time.Time
@@ -36,7 +35,7 @@ func RunStatMakerWorker(ctx context.Context, cfg StatMakerWorkerConfig, log *zap
 	)
 
 	for {
-		num, err = syncstats(ctx, hstore, tstore, db, time.Now().Truncate(time.Hour).Add(-time.Hour))
+		num, err = syncwallets(ctx, store, events, time.Now().Truncate(time.Hour).Add(-time.Hour))
 		if err != nil {
 			log.Error("unable to handle first tick", zap.Error(err))
 
@@ -67,7 +66,7 @@ func RunStatMakerWorker(ctx context.Context, cfg StatMakerWorkerConfig, log *zap
 
 		log.Debug("handle tick for stats", zap.Time("till", till))
 
-		num, err = syncstats(ctx, hstore, tstore, db, till)
+		num, err = syncwallets(ctx, store, events, till)
 		if err != nil {
 			log.Error("unable to handle tick", zap.Error(err))
 
@@ -86,32 +85,122 @@ func untilNextHour() time.Duration {
 	return time.Until(time.Now().Add(time.Hour).Truncate(time.Hour))
 }
 
-func syncstats(ctx context.Context, hstore btcount.HistoryStatStorage, tstore btcount.TransactionStorage, db btcount.Database, till time.Time) (amount int, err error) {
+// syncwallets syncs stats of every wallet and returns the total amount of
+// inserted stats. Stats of closed hours are published to events if it is
+// set.
+func syncwallets(ctx context.Context, store btcount.Store, events *notify.Broker, till time.Time) (amount int, err error) {
+	var wallets []btcount.Wallet
+	wallets, err = store.Repos().Wallets.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("listing wallets: %w", err)
+	}
+
+	for _, wallet := range wallets {
+		// The wallet is locked so stats are not repaired by backdated
+		// transactions at the same time.
+		walletID := wallet.ID
+
+		var stats []btcount.HistoryStat
+		err = store.WithinTx(ctx, func(r btcount.Repos) (err error) {
+			_, err = r.Wallets.Lock(ctx, walletID)
+			if err != nil {
+				return fmt.Errorf("locking wallet: %w", err)
+			}
+
+			stats, err = syncstats(ctx, r, walletID, till)
+
+			return err
+		})
+		if errors.Is(err, btcount.ErrNotFound) {
+			// The wallet has been deleted meanwhile.
+			continue
+		}
+		if err != nil {
+			return amount, fmt.Errorf("syncing stats of wallet %d: %w", wallet.ID, err)
+		}
+
+		amount += len(stats)
+
+		if events == nil {
+			continue
+		}
+
+		err = publishstats(ctx, store.Repos(), events, walletID, stats, till)
+		if err != nil {
+			return amount, fmt.Errorf("publishing stats of wallet %d: %w", wallet.ID, err)
+		}
+	}
+
+	return amount, nil
+}
+
+// publishstats publishes inserted stats followed by the stat of the hour
+// closed by till unless it is inserted. So every closed hour is published
+// even if it has no transactions or its stat is inserted by another
+// instance.
+func publishstats(ctx context.Context, r btcount.Repos, events *notify.Broker, walletID int64, stats []btcount.HistoryStat, till time.Time) (err error) {
+	till = till.UTC()
+	if n := len(stats); n == 0 || !stats[n-1].Datetime.Equal(till) {
+		var last btcount.HistoryStat
+		last, err = r.History.LoadLastStat(ctx, walletID, till)
+		if err != nil && !errors.Is(err, btcount.ErrNotFound) {
+			return fmt.Errorf("loading last history stat: %w", err)
+		}
+
+		// The hour without transactions carries the balance forward.
+		if !last.Datetime.Equal(till) {
+			last = btcount.HistoryStat{
+				WalletID: walletID,
+				Datetime: till,
+				Amount:   last.Amount,
+				Open:     last.Amount,
+				High:     last.Amount,
+				Low:      last.Amount,
+			}
+		}
+
+		stats = append(stats, last)
+	}
+
+	for i := range stats {
+		events.Publish(notify.Event{
+			Kind:     notify.KindStat,
+			WalletID: walletID,
+			Stat:     &stats[i],
+		})
+	}
+
+	return nil
+}
+
+func syncstats(ctx context.Context, r btcount.Repos, walletID int64, till time.Time) (stats []btcount.HistoryStat, err error) {
 	var hstat btcount.HistoryStat
-	hstat, err = hstore.LoadLastStat(ctx, db, till)
+	hstat, err = r.History.LoadLastStat(ctx, walletID, till)
 	if err != nil && !errors.Is(err, btcount.ErrNotFound) {
-		return 0, fmt.Errorf("loading last history stat: %w", err)
+		return nil, fmt.Errorf("loading last history stat: %w", err)
 	}
 
 	if !hstat.Datetime.Before(till) {
-		return 0, nil
+		return nil, nil
 	}
 
+	// The last stat covers transactions dated before its datetime and
+	// the stat dated by till will cover transactions dated before till.
 	var ts []btcount.Transaction
-	ts, err = tstore.Load(ctx, db, btcount.NewTimeRangeQuery(hstat.Datetime, till))
+	ts, err = r.Transactions.Load(ctx, walletID, btcount.NewTimeRangeQuery(hstat.Datetime, till))
 	if err != nil {
-		return 0, fmt.Errorf("loading transactions: %w", err)
+		return nil, fmt.Errorf("loading transactions: %w", err)
 	}
 
 	if len(ts) == 0 {
-		return 0, nil
+		return nil, nil
 	}
 
-	stats := btcount.CollectTransactionsIntoStats(ts, hstat.Amount)
-	err = hstore.SaveMany(ctx, db, stats)
+	stats = btcount.CollectTransactionsIntoStats(ts, hstat.Amount)
+	err = r.History.SaveMany(ctx, stats)
 	if err != nil {
-		return 0, fmt.Errorf("saving many stats: %w", err)
+		return nil, fmt.Errorf("saving many stats: %w", err)
 	}
 
-	return len(stats), nil
+	return stats, nil
 }